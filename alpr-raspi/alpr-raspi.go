@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"benchmark"
+	"detector"
+	detectorconfig "detector/config"
+	"health"
+	"logging"
+	"pipeline"
+	"replay"
+	"settings"
+	"shutdown"
+	"uploader"
+	uploaderconfig "uploader/config"
+	"watcher"
+	watcherconfig "watcher/config"
+)
+
+const usage = "usage: alpr-raspi watch|detect|upload|all|replay|benchmark|migrate [options]\n" +
+	"  all only takes --config, the shared options, --queue and --buffer: give the\n" +
+	"  stages' own options in their config file sections or env vars"
+
+// Options for running every stage in one process. They are read from the
+// "alpr-raspi" section of the config file, each stage still reading its own.
+type Options struct {
+	settings.Common
+
+	Queue  string `long:"queue" env:"LPR_QUEUE" default:"memory" choice:"memory" choice:"beanstalk" description:"Pass jobs between the stages in memory or through beanstalkd"`
+	Buffer int    `long:"buffer" env:"LPR_BUFFER" default:"100" description:"Jobs each in-memory tube holds before the stage putting them waits"`
+}
+
+// Validate checks the options.
+func (o *Options) Validate() error {
+	if o.Buffer < 1 {
+		return errors.New("buffer must be at least 1")
+	}
+	return o.Common.Validate()
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Println(usage)
+		os.Exit(2)
+	}
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "watch":
+		os.Exit(watcher.Main(args))
+	case "detect":
+		os.Exit(detector.Main(args))
+	case "upload":
+		os.Exit(uploader.Main(args))
+	case "all":
+		os.Exit(all(args))
+	case "replay":
+		os.Exit(replay.Main(args))
+	case "benchmark":
+		os.Exit(benchmark.Main(args))
+	case "migrate":
+		os.Exit(uploader.MigrateMain(args))
+	default:
+		log.Println(usage)
+		os.Exit(2)
+	}
+}
+
+// all runs the watcher, detector and uploader together. With the memory
+// queue a stage stops once the one before it has and its input is drained,
+// so jobs in hand at shutdown aren't lost unless the shutdown timeout runs
+// out. Beanstalkd keeps the jobs, so with it every stage stops on the signal.
+//
+// Every stage parses the same args, so they can only be the ones all of them
+// take; a stage's own options would be unknown to the others.
+func all(args []string) int {
+	var opts Options
+	if err := settings.Parse("alpr-raspi", &opts, args); err != nil {
+		log.Println(err)
+		log.Println(usage)
+		return 1
+	}
+	stageArgs := withoutFlags(args, "--queue", "--buffer")
+	watcherconfig.Init(stageArgs)
+	detectorconfig.Init(stageArgs)
+	uploaderconfig.Init(stageArgs)
+	if err := opts.SetupLogging("alpr-raspi"); err != nil {
+		log.Println(err)
+		return 1
+	}
+	logging.Info("All-in-one startup", "queue", opts.Queue, "buffer", opts.Buffer)
+
+	ctx := shutdown.OnSignal(opts.ShutdownTimeout())
+
+	w, err := watcher.New()
+	if err != nil {
+		logging.Error("Startup", "err", err)
+		return 1
+	}
+	d, err := detector.New()
+	if err != nil {
+		logging.Error("Startup", "err", err)
+		return 1
+	}
+	defer d.Close()
+	u, err := uploader.New()
+	if err != nil {
+		logging.Error("Startup", "err", err)
+		return 1
+	}
+	defer u.Close()
+
+	registries := []*health.Registry{w.Status(), d.Status(), u.Status()}
+	health.Watchdog(registries...)
+	for _, r := range registries {
+		r.NotifyStopping(ctx)
+	}
+
+	tubes := pipeline.Memory(opts.MotionTube, opts.DetectionTube, opts.Buffer)
+	if opts.Queue == "beanstalk" {
+		tubes = pipeline.Beanstalk(opts.BeanstalkAddr, opts.MotionTube, opts.DetectionTube, opts.JobPriority, opts.JobTTR())
+	}
+	code := 0
+	if err := pipeline.Run(ctx, w, d, u, tubes); err != nil {
+		logging.Error("Stopped", "err", err)
+		code = 1
+	}
+	logging.Info("All-in-one stopped")
+	return code
+}
+
+// withoutFlags drops the named flags and their values from args, leaving
+// those every stage understands.
+func withoutFlags(args []string, names ...string) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		drop := false
+		for _, name := range names {
+			if args[i] == name {
+				drop = true
+				i++
+			} else if strings.HasPrefix(args[i], name+"=") {
+				drop = true
+			}
+		}
+		if !drop {
+			kept = append(kept, args[i])
+		}
+	}
+	return kept
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+
+	"api"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "report":
+			os.Exit(api.ReportMain(os.Args[2:]))
+		case "migrate":
+			os.Exit(api.MigrateMain(os.Args[2:]))
+		case "pseudonym":
+			os.Exit(api.PseudonymMain(os.Args[2:]))
+		}
+	}
+	os.Exit(api.Main(os.Args[1:]))
+}
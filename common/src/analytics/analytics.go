@@ -0,0 +1,220 @@
+package analytics
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"events"
+)
+
+// Role is what a camera's sightings say about a visit.
+type Role int
+
+// A camera watching the way in starts visits and one watching the way out
+// ends them. Sightings by other cameras only show the car was there.
+const (
+	Neutral Role = iota
+	Entry
+	Exit
+)
+
+// Rules say how sightings are grouped into visits.
+type Rules struct {
+	// Roles of the cameras, by camera@site. Cameras not listed are neutral.
+	Roles map[string]Role
+	// Gap is the longest two sightings of a visit without an entry can be
+	// apart, and how close repeated reads at the gate must be to count as
+	// the same arrival or departure.
+	Gap time.Duration
+	// MaxVisit is the longest a visit with an entry can last without its
+	// exit being seen.
+	MaxVisit time.Duration
+}
+
+// Margin is how far beyond a time range sightings are needed to find the
+// visits starting within it.
+func (r Rules) Margin() time.Duration {
+	if r.MaxVisit > r.Gap {
+		return r.MaxVisit
+	}
+	return r.Gap
+}
+
+func (r Rules) role(event events.Event) Role {
+	return r.Roles[event.Camera+"@"+event.Site]
+}
+
+// Visit is a stay by a plate at a site, from its first sighting to its last.
+type Visit struct {
+	Plate       string        `json:"plate"`
+	Site        string        `json:"site"`
+	Start       time.Time     `json:"start"`
+	End         time.Time     `json:"end"`
+	Dwell       time.Duration `json:"-"`
+	Sightings   int           `json:"sightings"`
+	EntryCamera string        `json:"entry_camera,omitempty"`
+	ExitCamera  string        `json:"exit_camera,omitempty"`
+	// Complete is set when both the entry and the exit were seen.
+	Complete bool `json:"complete"`
+	// DwellSeconds is Dwell, for JSON.
+	DwellSeconds float64 `json:"dwell_seconds"`
+
+	lastRole Role
+}
+
+func (v *Visit) add(event events.Event, role Role) {
+	if v.Sightings == 0 {
+		v.Plate, v.Site, v.Start = event.Plate, event.Site, event.Time
+	}
+	v.End = event.Time
+	v.Sightings++
+	v.lastRole = role
+	switch role {
+	case Entry:
+		if v.EntryCamera == "" {
+			v.EntryCamera = event.Camera
+		}
+	case Exit:
+		v.ExitCamera = event.Camera
+	}
+}
+
+func (v *Visit) finish() Visit {
+	v.Dwell = v.End.Sub(v.Start)
+	v.DwellSeconds = v.Dwell.Seconds()
+	v.Complete = v.EntryCamera != "" && v.ExitCamera != ""
+	return *v
+}
+
+// Visits groups the events into visits. The events must be sorted by plate,
+// site and time. The visits come out in the same order.
+func Visits(sorted []events.Event, rules Rules) []Visit {
+	var visits []Visit
+	var open *Visit
+	for _, event := range sorted {
+		role := rules.role(event)
+		if open != nil && !open.continues(event, role, rules) {
+			visits = append(visits, open.finish())
+			open = nil
+		}
+		if open == nil {
+			open = &Visit{}
+		}
+		open.add(event, role)
+	}
+	if open != nil {
+		visits = append(visits, open.finish())
+	}
+	return visits
+}
+
+// continues reports whether the event belongs to the open visit.
+func (v *Visit) continues(event events.Event, role Role, rules Rules) bool {
+	if event.Plate != v.Plate || event.Site != v.Site {
+		return false
+	}
+	sinceLast := event.Time.Sub(v.End)
+	switch {
+	case v.ExitCamera != "":
+		// Gone, bar more reads on the way out.
+		return role == Exit && sinceLast <= rules.Gap
+	case role == Entry:
+		// Another arrival, unless it's the same car still at the gate.
+		return v.lastRole == Entry && sinceLast <= rules.Gap
+	case v.EntryCamera != "":
+		return event.Time.Sub(v.Start) <= rules.MaxVisit
+	default:
+		return sinceLast <= rules.Gap
+	}
+}
+
+// Starting keeps the visits that start within [from, to).
+func Starting(visits []Visit, from, to time.Time) []Visit {
+	kept := []Visit{}
+	for _, visit := range visits {
+		if !visit.Start.Before(from) && visit.Start.Before(to) {
+			kept = append(kept, visit)
+		}
+	}
+	return kept
+}
+
+// PlateSummary is how often a plate visited a site.
+type PlateSummary struct {
+	Plate     string    `json:"plate"`
+	Site      string    `json:"site"`
+	Visits    int       `json:"visits"`
+	DaysSeen  int       `json:"days_seen"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Dwell times, in seconds.
+	TotalDwell   float64 `json:"total_dwell_seconds"`
+	MeanDwell    float64 `json:"mean_dwell_seconds"`
+	LongestDwell float64 `json:"longest_dwell_seconds"`
+}
+
+// Summarize sums up the visits of each plate to each site, counting days in
+// loc. The summaries are sorted by visits, most first, then plate and site.
+func Summarize(visits []Visit, loc *time.Location) []PlateSummary {
+	type key struct{ plate, site string }
+	summaries := make(map[key]*PlateSummary)
+	days := make(map[key]map[string]bool)
+	for _, visit := range visits {
+		k := key{visit.Plate, visit.Site}
+		s, ok := summaries[k]
+		if !ok {
+			s = &PlateSummary{Plate: visit.Plate, Site: visit.Site, FirstSeen: visit.Start, LastSeen: visit.End}
+			summaries[k] = s
+			days[k] = make(map[string]bool)
+		}
+		s.Visits++
+		if visit.Start.Before(s.FirstSeen) {
+			s.FirstSeen = visit.Start
+		}
+		if visit.End.After(s.LastSeen) {
+			s.LastSeen = visit.End
+		}
+		s.TotalDwell += visit.DwellSeconds
+		if visit.DwellSeconds > s.LongestDwell {
+			s.LongestDwell = visit.DwellSeconds
+		}
+		for day := visit.Start.In(loc); !day.After(visit.End.In(loc)); day = day.AddDate(0, 0, 1) {
+			days[k][day.Format("2006-01-02")] = true
+		}
+		days[k][visit.End.In(loc).Format("2006-01-02")] = true
+	}
+	list := make([]PlateSummary, 0, len(summaries))
+	for k, s := range summaries {
+		s.DaysSeen = len(days[k])
+		s.MeanDwell = s.TotalDwell / float64(s.Visits)
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Visits != list[j].Visits {
+			return list[i].Visits > list[j].Visits
+		}
+		if list[i].Plate != list[j].Plate {
+			return list[i].Plate < list[j].Plate
+		}
+		return list[i].Site < list[j].Site
+	})
+	return list
+}
+
+// WriteCSV writes the visits with a header row, times in RFC 3339.
+func WriteCSV(w io.Writer, visits []Visit) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"plate", "site", "start", "end", "dwell_seconds", "sightings", "entry_camera", "exit_camera", "complete"})
+	for _, v := range visits {
+		out.Write([]string{
+			v.Plate, v.Site, v.Start.Format(time.RFC3339), v.End.Format(time.RFC3339),
+			strconv.FormatFloat(v.DwellSeconds, 'f', 0, 64), strconv.Itoa(v.Sightings),
+			v.EntryCamera, v.ExitCamera, strconv.FormatBool(v.Complete),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
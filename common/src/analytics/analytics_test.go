@@ -0,0 +1,144 @@
+package analytics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"events"
+)
+
+var base = time.Date(2016, 9, 20, 8, 0, 0, 0, time.UTC)
+
+func sighting(plate, camera string, minutes int) events.Event {
+	return events.Event{Plate: plate, Camera: camera, Site: "depot", Time: base.Add(time.Duration(minutes) * time.Minute)}
+}
+
+var rules = Rules{
+	Roles:    map[string]Role{"gate-in@depot": Entry, "gate-out@depot": Exit},
+	Gap:      30 * time.Minute,
+	MaxVisit: 24 * time.Hour,
+}
+
+func TestVisitsByGap(t *testing.T) {
+	visits := Visits([]events.Event{
+		sighting("AB12", "yard", 0),
+		sighting("AB12", "yard", 20),
+		sighting("AB12", "yard", 45),
+		sighting("AB12", "yard", 120),
+		sighting("CD34", "yard", 121),
+	}, rules)
+	if len(visits) != 3 {
+		t.Fatalf("Expected 3 visits, got %+v", visits)
+	}
+	if visits[0].Sightings != 3 || visits[0].Dwell != 45*time.Minute || visits[0].Complete {
+		t.Errorf("Unexpected first visit %+v", visits[0])
+	}
+	if visits[1].Start != base.Add(2*time.Hour) || visits[1].Dwell != 0 {
+		t.Errorf("Unexpected second visit %+v", visits[1])
+	}
+	if visits[2].Plate != "CD34" {
+		t.Errorf("Expected a visit for another plate, got %+v", visits[2])
+	}
+}
+
+func TestVisitsEntryExit(t *testing.T) {
+	visits := Visits([]events.Event{
+		sighting("AB12", "gate-in", 0),
+		sighting("AB12", "gate-in", 1),
+		sighting("AB12", "yard", 200),
+		sighting("AB12", "gate-out", 480),
+		sighting("AB12", "gate-out", 481),
+		sighting("AB12", "gate-in", 500),
+		sighting("AB12", "gate-out", 560),
+	}, rules)
+	if len(visits) != 2 {
+		t.Fatalf("Expected 2 visits, got %+v", visits)
+	}
+	first := visits[0]
+	if !first.Complete || first.Sightings != 5 || first.Dwell != 481*time.Minute ||
+		first.EntryCamera != "gate-in" || first.ExitCamera != "gate-out" {
+		t.Errorf("Unexpected first visit %+v", first)
+	}
+	if second := visits[1]; !second.Complete || second.Dwell != time.Hour || second.DwellSeconds != 3600 {
+		t.Errorf("Unexpected second visit %+v", second)
+	}
+}
+
+func TestVisitsRepeatedEntry(t *testing.T) {
+	// Entering twice without leaving means the exit was missed.
+	visits := Visits([]events.Event{
+		sighting("AB12", "gate-in", 0),
+		sighting("AB12", "yard", 10),
+		sighting("AB12", "gate-in", 300),
+	}, rules)
+	if len(visits) != 2 || visits[0].Complete || visits[0].Sightings != 2 || visits[1].Start != base.Add(5*time.Hour) {
+		t.Errorf("Unexpected visits %+v", visits)
+	}
+}
+
+func TestVisitsMaxVisit(t *testing.T) {
+	visits := Visits([]events.Event{
+		sighting("AB12", "gate-in", 0),
+		sighting("AB12", "yard", 23*60),
+		sighting("AB12", "yard", 25*60),
+	}, rules)
+	if len(visits) != 2 || visits[0].Sightings != 2 || visits[1].EntryCamera != "" {
+		t.Errorf("Unexpected visits %+v", visits)
+	}
+}
+
+func TestStarting(t *testing.T) {
+	visits := Visits([]events.Event{
+		sighting("AB12", "yard", 0),
+		sighting("AB12", "yard", 60),
+		sighting("AB12", "yard", 120),
+	}, rules)
+	kept := Starting(visits, base.Add(time.Hour), base.Add(2*time.Hour))
+	if len(kept) != 1 || kept[0].Start != base.Add(time.Hour) {
+		t.Errorf("Unexpected visits %+v", kept)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	visits := Visits([]events.Event{
+		sighting("AB12", "gate-in", 0),
+		sighting("AB12", "gate-out", 60),
+		sighting("AB12", "gate-in", 24*60),
+		sighting("AB12", "gate-out", 24*60+120),
+		sighting("CD34", "yard", 0),
+	}, rules)
+	summaries := Summarize(visits, time.UTC)
+	if len(summaries) != 2 {
+		t.Fatalf("Expected 2 summaries, got %+v", summaries)
+	}
+	s := summaries[0]
+	if s.Plate != "AB12" || s.Visits != 2 || s.DaysSeen != 2 || s.TotalDwell != 3*3600 ||
+		s.MeanDwell != 1.5*3600 || s.LongestDwell != 2*3600 ||
+		s.FirstSeen != base || s.LastSeen != base.Add(26*time.Hour) {
+		t.Errorf("Unexpected summary %+v", s)
+	}
+	if summaries[1].Plate != "CD34" || summaries[1].Visits != 1 || summaries[1].DaysSeen != 1 {
+		t.Errorf("Unexpected summary %+v", summaries[1])
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	visits := Visits([]events.Event{
+		sighting("AB12", "gate-in", 0),
+		sighting("AB12", "gate-out", 90),
+	}, rules)
+	var out bytes.Buffer
+	if err := WriteCSV(&out, visits); err != nil {
+		t.Fatal(err)
+	}
+	expected := "plate,site,start,end,dwell_seconds,sightings,entry_camera,exit_camera,complete\n" +
+		"AB12,depot,2016-09-20T08:00:00Z,2016-09-20T09:30:00Z,5400,2,gate-in,gate-out,true\n"
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 2 {
+		t.Errorf("Expected 2 lines, got %d", lines)
+	}
+}
@@ -0,0 +1,558 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"api/config"
+	"events"
+	"health"
+	"logging"
+	"metrics"
+	"pseudonym"
+	"reports"
+	"settings"
+	"shutdown"
+)
+
+var logger = logging.With("service", "api")
+
+// Store is where the events are searched and corrected.
+type Store interface {
+	Search(ctx context.Context, q events.Query) (events.Page, error)
+	Get(ctx context.Context, id int64) (events.Event, error)
+	Since(ctx context.Context, afterID int64, limit int) ([]events.Event, error)
+	Cameras(ctx context.Context) ([]events.Camera, error)
+	Correct(ctx context.Context, c events.Correction) (events.Event, error)
+	Corrections(ctx context.Context, eventID int64) ([]events.Correction, error)
+	Sightings(ctx context.Context, plate, site string, from, to time.Time, limit int) ([]events.Event, error)
+	PlateHistory(ctx context.Context, plate string) ([]events.PlateSite, error)
+	PlateHours(ctx context.Context, from, to time.Time, loc *time.Location) ([]events.PlateHour, error)
+}
+
+// Server answers queries over the recorded events, and streams new ones,
+// for clients holding one of the configured keys.
+type Server struct {
+	store    Store
+	feed     Feed
+	hub      *hub
+	stopping chan struct{}
+	status   *health.Registry
+}
+
+// New connects to the events database configured in config.Opts, which
+// config.Init must have filled in. Close disconnects.
+func New() (*Server, error) {
+	logger.Info("API startup")
+	logger.Info("Postgres", "host", config.Opts.PostgresHost, "db", config.Opts.PostgresDB, "sslmode", config.Opts.PostgresSSLMode)
+	if config.Opts.DB().Superuser() {
+		logger.Warn("Connecting as the postgres superuser, use lpr_api from scripts/roles.sql instead")
+	}
+	connectStr := config.ConnectString()
+	store, err := events.Open(connectStr)
+	if err != nil {
+		return nil, fmt.Errorf("DB: %s", err)
+	}
+	if err := ensureSchema(store, config.Opts.Migrate == "auto"); err != nil {
+		store.Close()
+		return nil, err
+	}
+	listener, err := events.Listen(connectStr, func(err error) {
+		logger.Error("Listen", "channel", events.Channel, "err", err)
+	})
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("listen: %s", err)
+	}
+	s := NewWith(store)
+	s.feed = listener
+	return s, nil
+}
+
+// NewWith serves the events in store. A store that can be pinged is checked
+// for readiness, and one that can be closed is closed by Close. Nothing is
+// streamed unless the server is given a feed.
+func NewWith(store Store) *Server {
+	s := &Server{store: store, hub: newHub(), stopping: make(chan struct{}), status: health.New(0)}
+	if p, ok := store.(interface {
+		Ping(ctx context.Context) error
+	}); ok {
+		s.status.Check("db", p.Ping)
+	}
+	return s
+}
+
+// ensureSchema brings the events database up to date, if auto, or checks
+// it is, since the queries assume the columns of the schema they were built
+// with.
+func ensureSchema(store *events.Postgres, auto bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	applied, err := events.Schema.Ensure(ctx, store.DB, auto)
+	if err != nil {
+		return fmt.Errorf("%s schema: %s", events.Schema.Name, err)
+	}
+	if len(applied) > 0 {
+		logger.Info("Migrated", "schema", events.Schema.Name, "applied", applied, "version", events.Schema.Latest())
+	}
+	return nil
+}
+
+// MigrateMain brings the events database's schema up to date.
+func MigrateMain(args []string) int {
+	config.Init(args)
+	store, err := events.Open(config.ConnectString())
+	if err != nil {
+		logger.Error("DB", "err", err)
+		return 1
+	}
+	defer store.Close()
+	if err := ensureSchema(store, true); err != nil {
+		logger.Error("Migrate", "err", err)
+		return 1
+	}
+	logger.Info("Schema up to date", "schema", events.Schema.Name, "version", events.Schema.Latest())
+	return 0
+}
+
+// Status is the API's health.
+func (s *Server) Status() *health.Registry {
+	return s.status
+}
+
+// Close closes the store and feed if they can be closed.
+func (s *Server) Close() {
+	for _, dep := range []interface{}{s.feed, s.store} {
+		if c, ok := dep.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// Handler serves the API under /v1, which needs a key, along with the
+// dashboard, metrics and health endpoints, which don't.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.status.Handle(mux)
+	handleDashboard(mux)
+	mux.Handle("/metrics", metrics.Handler(metrics.API()...))
+	mux.Handle("/v1/events", s.route("search", s.search, "GET"))
+	mux.Handle("/v1/cameras", s.route("cameras", s.cameras, "GET"))
+	mux.Handle("/v1/stream", s.route("stream", s.stream, "GET"))
+	mux.Handle("/v1/visits", s.route("visits", s.visits, "GET"))
+	mux.Handle("/v1/visits/summary", s.route("visit_summary", s.visitSummary, "GET"))
+	mux.Handle("/v1/plates/", s.route("plate", s.plate, "GET"))
+	event := s.route("event", s.event, "GET")
+	corrections := s.route("corrections", s.corrections, "GET", "POST")
+	reveal := s.route("reveal", s.reveal, "GET")
+	mux.HandleFunc("/v1/events/", func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/corrections") {
+			corrections.ServeHTTP(w, req)
+			return
+		}
+		if strings.HasSuffix(req.URL.Path, "/plate") {
+			reveal.ServeHTTP(w, req)
+			return
+		}
+		event.ServeHTTP(w, req)
+	})
+	mux.Handle("/v1/", s.route("other", func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, http.StatusNotFound, "not found")
+	}, "GET"))
+	return mux
+}
+
+// Run serves the API on the configured address until ctx is cancelled, then
+// gives the requests in hand the shutdown grace to finish.
+func (s *Server) Run(ctx context.Context) error {
+	// Keys and limits can be changed without a restart.
+	settings.OnSighup(func() {
+		changed, err := config.Reload()
+		if err != nil {
+			logger.Error("Reload", "err", err)
+			return
+		}
+		logger.Info("Reloaded configuration", "changed", changed)
+	})
+
+	server := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	listener, err := net.Listen("tcp", config.Opts.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	logger.Info("Serving", "addr", listener.Addr())
+	s.status.NotifyReady()
+
+	if s.feed != nil {
+		go s.follow(ctx, s.feed)
+	}
+	if sinks := reportSinks(config.Opts); len(sinks) > 0 {
+		go reports.Daily(ctx, func() (string, *time.Location) {
+			opts := config.Snapshot()
+			return opts.ReportTime, opts.Location
+		}, func(ctx context.Context, due time.Time) {
+			s.report(ctx, sinks, due)
+		})
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	// Streams never finish by themselves, so end them for the shutdown.
+	close(s.stopping)
+	grace, cancel := context.WithTimeout(context.Background(), config.Opts.ShutdownGrace())
+	defer cancel()
+	if err := server.Shutdown(grace); err != nil {
+		return err
+	}
+	logger.Info("API stopped")
+	return nil
+}
+
+type clientKey struct{}
+
+// client is the name of the key the request was made with.
+func client(req *http.Request) string {
+	name, _ := req.Context().Value(clientKey{}).(string)
+	return name
+}
+
+// route checks the request's key and method, and counts and times it. GET
+// routes also answer HEAD.
+func (s *Server) route(name string, handler http.HandlerFunc, methods ...string) http.Handler {
+	allowed := map[string]bool{}
+	for _, method := range methods {
+		allowed[method] = true
+	}
+	if allowed["GET"] {
+		allowed["HEAD"] = true
+		methods = append(methods, "HEAD")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started := time.Now()
+		rec := &recorder{ResponseWriter: w, code: http.StatusOK}
+		clientName, ok := authorize(req, config.Snapshot().Clients)
+		switch {
+		case !ok:
+			logger.Warn("Unauthorized", "remote_addr", req.RemoteAddr, "path", req.URL.Path)
+			rec.Header().Set("WWW-Authenticate", `Bearer realm="lpr"`)
+			writeError(rec, http.StatusUnauthorized, "missing or unknown API key")
+		case !allowed[req.Method]:
+			rec.Header().Set("Allow", strings.Join(methods, ", "))
+			writeError(rec, http.StatusMethodNotAllowed, "method not allowed")
+		default:
+			handler(rec, req.WithContext(context.WithValue(req.Context(), clientKey{}, clientName)))
+		}
+		elapsed := time.Since(started)
+		metrics.APIRequests.WithLabelValues(name, strconv.Itoa(rec.code)).Inc()
+		metrics.APIRequestSeconds.WithLabelValues(name).Observe(elapsed.Seconds())
+		logger.Debug("Request", "route", name, "client", clientName, "method", req.Method, "query", req.URL.RawQuery,
+			"code", rec.code, "elapsed", elapsed)
+	})
+}
+
+// authorize returns the name of the key the request carries, either as a
+// bearer token or in X-API-Key, and whether it is one of clients.
+func authorize(req *http.Request, clients map[string]string) (string, bool) {
+	key := req.Header.Get("X-API-Key")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key == "" {
+		return "", false
+	}
+	// Compare against every key, so the time taken doesn't give away how
+	// close a guess was.
+	var name string
+	for k, n := range clients {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			name = n
+		}
+	}
+	return name, name != ""
+}
+
+// search serves GET /v1/events.
+func (s *Server) search(w http.ResponseWriter, req *http.Request) {
+	opts := config.Snapshot()
+	q, err := parseQuery(req.URL.Query(), opts.PageSize, opts.MaxPageSize)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if q.Match == events.Exact && q.Plate != "" && !pseudonym.Is(q.Plate) {
+		q.Pseudonyms = opts.Pseudonyms.All(q.Plate)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), opts.QueryTimeout)
+	defer cancel()
+	page, err := s.store.Search(ctx, q)
+	if err != nil {
+		s.storeError(ctx, w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// eventID reads the id from /v1/events/{id}, followed by suffix.
+func eventID(path string, suffix string) (int64, bool) {
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "/v1/events/"), suffix)
+	id, err := strconv.ParseInt(path, 10, 64)
+	return id, err == nil && id > 0
+}
+
+// event serves GET /v1/events/{id}.
+func (s *Server) event(w http.ResponseWriter, req *http.Request) {
+	id, ok := eventID(req.URL.Path, "")
+	if !ok {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), config.Snapshot().QueryTimeout)
+	defer cancel()
+	event, err := s.store.Get(ctx, id)
+	switch {
+	case err == events.ErrNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		s.storeError(ctx, w, err)
+	default:
+		writeJSON(w, http.StatusOK, event)
+	}
+}
+
+// cameras serves GET /v1/cameras, flagging those quiet for too long.
+func (s *Server) cameras(w http.ResponseWriter, req *http.Request) {
+	opts := config.Snapshot()
+	ctx, cancel := context.WithTimeout(req.Context(), opts.QueryTimeout)
+	defer cancel()
+	cameras, err := s.store.Cameras(ctx)
+	if err != nil {
+		s.storeError(ctx, w, err)
+		return
+	}
+	type status struct {
+		events.Camera
+		Quiet bool `json:"quiet"`
+	}
+	statuses := make([]status, 0, len(cameras))
+	for _, camera := range cameras {
+		statuses = append(statuses, status{Camera: camera, Quiet: time.Since(camera.LastSeen) > opts.CameraQuiet()})
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// corrections serves GET /v1/events/{id}/corrections, the event's audit
+// trail, and POST, which corrects its plate:
+//
+//	{"plate": "CA982063", "reason": "0 read as O"}
+func (s *Server) corrections(w http.ResponseWriter, req *http.Request) {
+	id, ok := eventID(req.URL.Path, "/corrections")
+	if !ok {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	opts := config.Snapshot()
+	ctx, cancel := context.WithTimeout(req.Context(), opts.QueryTimeout)
+	defer cancel()
+	if req.Method != http.MethodPost {
+		corrections, err := s.store.Corrections(ctx, id)
+		if err != nil {
+			s.storeError(ctx, w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, corrections)
+		return
+	}
+
+	editor := client(req)
+	if !opts.IsEditor(editor) {
+		writeError(w, http.StatusForbidden, "this key may not correct plates")
+		return
+	}
+	var body struct {
+		Plate  string `json:"plate"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON with a plate and reason")
+		return
+	}
+	plate := events.NormalizePlate(body.Plate)
+	if err := events.ValidPlate(plate); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body.Reason) > 500 {
+		writeError(w, http.StatusBadRequest, "reason must be at most 500 characters")
+		return
+	}
+	// A correction would record the plate as typed, where only pseudonyms
+	// may be kept.
+	if current, err := s.store.Get(ctx, id); err == nil && pseudonym.Is(current.Plate) {
+		writeError(w, http.StatusConflict, "a hashed plate can't be corrected")
+		return
+	}
+	event, err := s.store.Correct(ctx, events.Correction{EventID: id, NewPlate: plate, Editor: editor, Reason: body.Reason})
+	switch {
+	case err == events.ErrNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	case err == events.ErrUnchanged:
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		s.storeError(ctx, w, err)
+	default:
+		logger.Info("Plate corrected", "event_id", id, "plate", plate, "editor", editor)
+		writeJSON(w, http.StatusOK, event)
+	}
+}
+
+// reveal serves GET /v1/events/{id}/plate, the plate of an event recorded
+// as its pseudonym, opened from the sealed copy for the keys allowed to.
+// Every reveal is logged.
+func (s *Server) reveal(w http.ResponseWriter, req *http.Request) {
+	id, ok := eventID(req.URL.Path, "/plate")
+	if !ok {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	opts := config.Snapshot()
+	revealer := client(req)
+	if !opts.IsRevealer(revealer) {
+		writeError(w, http.StatusForbidden, "this key may not reveal plates")
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), opts.QueryTimeout)
+	defer cancel()
+	event, err := s.store.Get(ctx, id)
+	switch {
+	case err == events.ErrNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		s.storeError(ctx, w, err)
+		return
+	case event.PlateSealed == "":
+		writeError(w, http.StatusNotFound, "event has no sealed plate")
+		return
+	}
+	plate, err := opts.Opener.Open(event.PlateSealed, event.Plate)
+	if err != nil {
+		logger.Error("Open plate", "event_id", id, "err", err)
+		writeError(w, http.StatusInternalServerError, "plate can't be opened with the configured keys")
+		return
+	}
+	logger.Info("Plate revealed", "event_id", id, "client", revealer)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"event_id": id, "plate": plate})
+}
+
+// storeError reports a failed query without giving away its details.
+func (s *Server) storeError(ctx context.Context, w http.ResponseWriter, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Warn("Query timed out", "err", err)
+		writeError(w, http.StatusServiceUnavailable, "query timed out")
+		return
+	}
+	logger.Error("Query", "err", err)
+	writeError(w, http.StatusInternalServerError, "internal error")
+}
+
+// parseQuery reads a search from the request's query string:
+//
+//	plate, match (exact, prefix, wildcard or fuzzy), distance, camera, site,
+//	from and to (RFC 3339), limit and cursor
+func parseQuery(values url.Values, pageSize, maxPageSize int) (events.Query, error) {
+	q := events.Query{
+		Plate:  values.Get("plate"),
+		Match:  values.Get("match"),
+		Camera: values.Get("camera"),
+		Site:   values.Get("site"),
+		Limit:  pageSize,
+		After:  values.Get("cursor"),
+	}
+	var err error
+	if v := values.Get("distance"); v != "" {
+		if q.Distance, err = strconv.Atoi(v); err != nil {
+			return q, errors.New("distance must be a number")
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			return q, errors.New("limit must be a number")
+		}
+		if q.Limit > maxPageSize {
+			return q, fmt.Errorf("limit must be at most %d", maxPageSize)
+		}
+	}
+	for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := values.Get(name); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+		}
+	}
+	return q, q.Validate()
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// recorder keeps the status code written, for the metrics.
+type recorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *recorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush passes on flushes, for streaming.
+func (r *recorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Main runs the API until SIGINT or SIGTERM.
+func Main(args []string) int {
+	config.Init(args)
+	ctx := shutdown.OnSignal(config.Opts.ShutdownTimeout())
+
+	s, err := New()
+	if err != nil {
+		logger.Error("Startup", "err", err)
+		return 1
+	}
+	defer s.Close()
+	s.Status().Watchdog()
+	s.Status().NotifyStopping(ctx)
+
+	if err := s.Run(ctx); err != nil {
+		logger.Error("Stopped", "err", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,398 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"analytics"
+	"api/config"
+	"events"
+	"logging"
+	"pseudonym"
+)
+
+const (
+	key       = "0123456789abcdef"
+	editorKey = "fedcba9876543210"
+)
+
+// fakeStore returns its events as one page, recording the last query and
+// the corrections made.
+type fakeStore struct {
+	events      []events.Event
+	cameras     []events.Camera
+	query       events.Query
+	corrections []events.Correction
+	err         error
+}
+
+func (s *fakeStore) Search(ctx context.Context, q events.Query) (events.Page, error) {
+	s.query = q
+	return events.Page{Events: s.events, Next: "next"}, s.err
+}
+
+func (s *fakeStore) Get(ctx context.Context, id int64) (events.Event, error) {
+	for _, event := range s.events {
+		if event.ID == id {
+			return event, nil
+		}
+	}
+	return events.Event{}, events.ErrNotFound
+}
+
+func (s *fakeStore) Since(ctx context.Context, afterID int64, limit int) ([]events.Event, error) {
+	var found []events.Event
+	for _, event := range s.events {
+		if event.ID > afterID && len(found) < limit {
+			found = append(found, event)
+		}
+	}
+	return found, s.err
+}
+
+func (s *fakeStore) Cameras(ctx context.Context) ([]events.Camera, error) {
+	return s.cameras, s.err
+}
+
+func (s *fakeStore) Correct(ctx context.Context, c events.Correction) (events.Event, error) {
+	event, err := s.Get(ctx, c.EventID)
+	if err != nil {
+		return event, err
+	}
+	if c.NewPlate == event.Plate {
+		return event, events.ErrUnchanged
+	}
+	c.OldPlate = event.Plate
+	s.corrections = append(s.corrections, c)
+	event.Plate, event.Corrected = c.NewPlate, true
+	return event, nil
+}
+
+func (s *fakeStore) Corrections(ctx context.Context, eventID int64) ([]events.Correction, error) {
+	return s.corrections, s.err
+}
+
+func (s *fakeStore) Sightings(ctx context.Context, plate, site string, from, to time.Time, limit int) ([]events.Event, error) {
+	var found []events.Event
+	for _, event := range s.events {
+		if !event.Time.Before(from) && event.Time.Before(to) && (plate == "" || event.Plate == plate) && (site == "" || event.Site == site) {
+			found = append(found, event)
+		}
+	}
+	if len(found) > limit {
+		return nil, events.ErrTooMany
+	}
+	return found, s.err
+}
+
+func (s *fakeStore) PlateHistory(ctx context.Context, plate string) ([]events.PlateSite, error) {
+	sites := []events.PlateSite{}
+	for _, event := range s.events {
+		if event.Plate != plate {
+			continue
+		}
+		if len(sites) == 0 || sites[len(sites)-1].Site != event.Site {
+			sites = append(sites, events.PlateSite{Site: event.Site, FirstSeen: event.Time})
+		}
+		sites[len(sites)-1].LastSeen = event.Time
+		sites[len(sites)-1].Events++
+	}
+	return sites, s.err
+}
+
+func (s *fakeStore) PlateHours(ctx context.Context, from, to time.Time, loc *time.Location) ([]events.PlateHour, error) {
+	var hours []events.PlateHour
+	for _, event := range s.events {
+		if event.Time.Before(from) || !event.Time.Before(to) {
+			continue
+		}
+		t := event.Time.In(loc)
+		hour := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+		hours = append(hours, events.PlateHour{Camera: event.Camera, Site: event.Site, Plate: event.Plate, Hour: hour, Events: 1})
+	}
+	return hours, s.err
+}
+
+func newTestServer(store *fakeStore) http.Handler {
+	config.Opts.Keys = []string{"reports=" + key, "alice=" + editorKey}
+	config.Opts.Clients = map[string]string{key: "reports", editorKey: "alice"}
+	config.Opts.Editors = []string{"alice"}
+	config.Opts.CameraQuietMins = 60
+	config.Opts.PageSize = 50
+	config.Opts.MaxPageSize = 500
+	config.Opts.QueryTimeout = time.Second
+	config.Opts.AnalyticsMax = 1000
+	config.Opts.Location = time.UTC
+	config.Opts.Rules = analytics.Rules{
+		Roles:    map[string]analytics.Role{"gate-in@depot": analytics.Entry, "gate-out@depot": analytics.Exit},
+		Gap:      30 * time.Minute,
+		MaxVisit: 24 * time.Hour,
+	}
+	logging.SetOutput(ioutil.Discard)
+	return NewWith(store).Handler()
+}
+
+func get(h http.Handler, url string, headers ...string) *httptest.ResponseRecorder {
+	return request(h, "GET", url, "", headers...)
+}
+
+func request(h http.Handler, method, url, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuth(t *testing.T) {
+	h := newTestServer(&fakeStore{})
+	tests := []struct {
+		headers  []string
+		expected int
+	}{
+		{nil, http.StatusUnauthorized},
+		{[]string{"Authorization", "Bearer wrong"}, http.StatusUnauthorized},
+		{[]string{"Authorization", "Basic " + key}, http.StatusUnauthorized},
+		{[]string{"Authorization", "Bearer " + key}, http.StatusOK},
+		{[]string{"X-API-Key", key}, http.StatusOK},
+	}
+	for _, test := range tests {
+		if w := get(h, "/v1/events", test.headers...); w.Code != test.expected {
+			t.Errorf("%q: expected %d, got %d", test.headers, test.expected, w.Code)
+		}
+	}
+	if w := get(h, "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("Expected /healthz without a key, got %d", w.Code)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	at := time.Date(2016, 9, 20, 13, 54, 26, 0, time.UTC)
+	store := &fakeStore{events: []events.Event{{
+		ID: 1, Time: at, Camera: "gate", Site: "depot", Plate: "CA982063",
+		PlateImage: "https://store.test/01.plate.jpg", FrameImage: "https://store.test/01.frame.jpg",
+	}}}
+	h := newTestServer(store)
+
+	w := get(h, "/v1/events?plate=ca98*&match=wildcard&camera=gate&from=2016-09-20T00:00:00Z&limit=10&cursor=", "X-API-Key", key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	expected := events.Query{Plate: "CA98*", Match: events.Wildcard, Camera: "gate", From: at.Truncate(24 * time.Hour), Limit: 10}
+	if !reflect.DeepEqual(store.query, expected) {
+		t.Errorf("Expected query %+v, got %+v", expected, store.query)
+	}
+	var page struct {
+		Events []map[string]interface{}
+		Next   string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 1 || page.Events[0]["plate"] != "CA982063" || page.Events[0]["frame_image"] != "https://store.test/01.frame.jpg" ||
+		page.Events[0]["time"] != "2016-09-20T13:54:26Z" || page.Next != "next" {
+		t.Errorf("Unexpected page %s", w.Body)
+	}
+
+	get(h, "/v1/events", "X-API-Key", key)
+	if store.query.Limit != 50 || store.query.Match != events.Exact {
+		t.Errorf("Expected the default page size and exact match, got %+v", store.query)
+	}
+
+	for _, query := range []string{"limit=501", "limit=ten", "match=prefix", "from=yesterday", "distance=9&plate=A&match=fuzzy"} {
+		w := get(h, "/v1/events?"+query, "X-API-Key", key)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"error"`) {
+			t.Errorf("%s: expected a 400 with an error, got %d: %s", query, w.Code, w.Body)
+		}
+	}
+
+	store.err = errors.New("connection refused")
+	if w := get(h, "/v1/events", "X-API-Key", key); w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "refused") {
+		t.Errorf("Expected a 500 without the details, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestEvent(t *testing.T) {
+	h := newTestServer(&fakeStore{events: []events.Event{{ID: 7, Plate: "CA982063"}}})
+	tests := map[string]int{
+		"/v1/events/7":  http.StatusOK,
+		"/v1/events/8":  http.StatusNotFound,
+		"/v1/events/x":  http.StatusNotFound,
+		"/v1/elsewhere": http.StatusNotFound,
+	}
+	for url, expected := range tests {
+		if w := get(h, url, "X-API-Key", key); w.Code != expected {
+			t.Errorf("%s: expected %d, got %d", url, expected, w.Code)
+		}
+	}
+	if w := request(h, "DELETE", "/v1/events/7", "", "X-API-Key", key); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected DELETE not allowed, got %d", w.Code)
+	}
+}
+
+func TestCorrections(t *testing.T) {
+	store := &fakeStore{events: []events.Event{{ID: 7, Plate: "CA982O63"}}}
+	h := newTestServer(store)
+	tests := []struct {
+		key, body string
+		expected  int
+	}{
+		{key, `{"plate": "CA982063"}`, http.StatusForbidden},
+		{editorKey, `{"plate": "CA98 2O63"}`, http.StatusConflict},
+		{editorKey, `{"plate": "CA98%"}`, http.StatusBadRequest},
+		{editorKey, `plate=CA982063`, http.StatusBadRequest},
+		{editorKey, `{"plate": "ca98-2063", "reason": "0 read as O"}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		if w := request(h, "POST", "/v1/events/7/corrections", test.body, "X-API-Key", test.key); w.Code != test.expected {
+			t.Errorf("%s: expected %d, got %d: %s", test.body, test.expected, w.Code, w.Body)
+		}
+	}
+	if w := request(h, "POST", "/v1/events/8/corrections", `{"plate": "CA982063"}`, "X-API-Key", editorKey); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown event not found, got %d", w.Code)
+	}
+
+	expected := []events.Correction{{EventID: 7, OldPlate: "CA982O63", NewPlate: "CA982063", Editor: "alice", Reason: "0 read as O"}}
+	if !reflect.DeepEqual(store.corrections, expected) {
+		t.Errorf("Expected corrections %+v, got %+v", expected, store.corrections)
+	}
+	w := get(h, "/v1/events/7/corrections", "X-API-Key", key)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"editor":"alice"`) {
+		t.Errorf("Expected the audit trail, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCameras(t *testing.T) {
+	h := newTestServer(&fakeStore{cameras: []events.Camera{
+		{Camera: "gate", Site: "depot", LastSeen: time.Now().Add(-time.Minute), Events: 12},
+		{Camera: "exit", Site: "depot", LastSeen: time.Now().Add(-2 * time.Hour)},
+	}})
+	w := get(h, "/v1/cameras", "X-API-Key", key)
+	var cameras []struct {
+		Camera string
+		Quiet  bool
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &cameras); err != nil {
+		t.Fatal(err)
+	}
+	if len(cameras) != 2 || cameras[0].Quiet || !cameras[1].Quiet {
+		t.Errorf("Expected only exit quiet, got %s", w.Body)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	h := newTestServer(&fakeStore{})
+	for url, expected := range map[string]string{
+		"/":        "text/html; charset=utf-8",
+		"/app.js":  "application/javascript; charset=utf-8",
+		"/app.css": "text/css; charset=utf-8",
+	} {
+		w := get(h, url)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != expected || w.Header().Get("Content-Security-Policy") == "" {
+			t.Errorf("%s: expected %s without a key, got %d %s", url, expected, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+	if w := get(h, "/index.php"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown files not found, got %d", w.Code)
+	}
+}
+
+// sealKeys makes a key pair to seal plates with, in files as the uploader
+// and API are given them.
+func sealKeys(t *testing.T) (*pseudonym.Sealer, pseudonym.Opener) {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, pseudonym.MinKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	ioutil.WriteFile(filepath.Join(dir, "plates.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "plates.key"), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	sealer, err := pseudonym.LoadSealer(filepath.Join(dir, "plates.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opener, err := pseudonym.LoadOpener([]string{filepath.Join(dir, "plates.key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealer, opener
+}
+
+func TestHashedPlates(t *testing.T) {
+	keys, _ := pseudonym.ParseKeys([]string{"k2=the newest secret key", "k1=an older secret key"})
+	old, _ := pseudonym.ParseKeys([]string{"k1=an older secret key"})
+	sealer, opener := sealKeys(t)
+	// Recorded before the plate keys were rotated.
+	hashed := old.Pseudonym("CA982063")
+	sealed, err := sealer.Seal("CA982063", hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeStore{events: []events.Event{{ID: 7, Plate: hashed, PlateSealed: sealed}, {ID: 8, Plate: keys.Pseudonym("AB12CDE")}}}
+	h := newTestServer(store)
+	config.Opts.Pseudonyms, config.Opts.Opener, config.Opts.Revealers = keys, opener, []string{"alice"}
+	config.Opts.Watchlists = []string{"stolen=CA982063", "fleet=" + keys.Pseudonym("AB12CDE"), "local=CA98*"}
+	defer func() {
+		config.Opts.Pseudonyms, config.Opts.Opener, config.Opts.Revealers, config.Opts.Watchlists = nil, nil, nil, nil
+	}()
+
+	// An exact search finds the plate whichever key hashed it.
+	if w := get(h, "/v1/events?plate=ca982063", "X-API-Key", key); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if !reflect.DeepEqual(store.query.Pseudonyms, keys.All("CA982063")) {
+		t.Errorf("Expected the plate's pseudonyms searched for, got %v", store.query.Pseudonyms)
+	}
+
+	// Watchlists match by plate or pseudonym, but not by pattern.
+	if lists := config.Opts.Watchlisted(hashed); !reflect.DeepEqual(lists, []string{"stolen"}) {
+		t.Errorf("Expected [stolen], got %v", lists)
+	}
+	if lists := config.Opts.Watchlisted(keys.Pseudonym("AB12CDE")); !reflect.DeepEqual(lists, []string{"fleet"}) {
+		t.Errorf("Expected [fleet], got %v", lists)
+	}
+
+	tests := []struct {
+		url, key string
+		expected int
+	}{
+		{"/v1/events/7/plate", key, http.StatusForbidden},
+		{"/v1/events/8/plate", editorKey, http.StatusNotFound},
+		{"/v1/events/9/plate", editorKey, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if w := get(h, test.url, "X-API-Key", test.key); w.Code != test.expected {
+			t.Errorf("%s: expected %d, got %d: %s", test.url, test.expected, w.Code, w.Body)
+		}
+	}
+	w := get(h, "/v1/events/7/plate", "X-API-Key", editorKey)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"plate":"CA982063"`) {
+		t.Errorf("Expected the plate revealed, got %d: %s", w.Code, w.Body)
+	}
+
+	// A correction would record the plate as typed.
+	if w := request(h, "POST", "/v1/events/7/corrections", `{"plate": "CA982064"}`, "X-API-Key", editorKey); w.Code != http.StatusConflict {
+		t.Errorf("Expected a hashed plate not corrected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,306 @@
+package config
+
+import (
+	"analytics"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"pgconn"
+	"pseudonym"
+	"settings"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options describes all the CLI flags that can be passed. Those tagged
+// reload:"true" are re-read from the config file on SIGHUP.
+type Options struct {
+	settings.Common
+
+	HTTPAddr         string   `long:"http-addr" env:"API_HTTP_ADDR" default:":9104" description:"Serves the API, /metrics, /healthz and /readyz"`
+	Keys             []string `long:"keys" env:"API_KEYS" env-delim:"," description:"API keys clients may use, as name=key" reload:"true" secret:"true"`
+	Editors          []string `long:"editors" env:"API_EDITORS" env-delim:"," description:"Names of the keys that may correct plates" reload:"true"`
+	CameraQuietMins  int      `long:"camera-quiet" env:"API_CAMERA_QUIET" default:"60" description:"Minutes without an event before the dashboard flags a camera" reload:"true"`
+	Watchlists       []string `long:"watchlist" env:"API_WATCHLISTS" env-delim:"," description:"Plates streamed events are checked against, as list=plate with * and ? wildcards" reload:"true"`
+	StreamBacklog    int      `long:"stream-backlog" env:"API_STREAM_BACKLOG" default:"1000" description:"Most missed events a resumed stream is sent" reload:"true"`
+	EntryCameras     []string `long:"entry-cameras" env:"API_ENTRY_CAMERAS" env-delim:"," description:"Cameras watching the way in, as camera@site, which start visits" reload:"true"`
+	ExitCameras      []string `long:"exit-cameras" env:"API_EXIT_CAMERAS" env-delim:"," description:"Cameras watching the way out, as camera@site, which end visits" reload:"true"`
+	VisitGapMins     int      `long:"visit-gap" env:"API_VISIT_GAP" default:"30" description:"Minutes between sightings after which a plate without an entry read has left" reload:"true"`
+	MaxVisitHours    int      `long:"max-visit" env:"API_MAX_VISIT" default:"24" description:"Hours after an entry read a visit ends if its exit isn't seen" reload:"true"`
+	AnalyticsMax     int      `long:"analytics-max-events" env:"API_ANALYTICS_MAX_EVENTS" default:"200000" description:"Most events read to work out visits" reload:"true"`
+	Timezone         string   `long:"timezone" env:"API_TIMEZONE" default:"UTC" description:"Where days start and end, for visit summaries and reports" reload:"true"`
+	ReportDir        string   `long:"report-dir" env:"API_REPORT_DIR" description:"Directory the daily reports are written to, if set"`
+	ReportS3Bucket   string   `long:"report-s3-bucket" env:"API_REPORT_S3_BUCKET" description:"Bucket the daily reports are uploaded to, if set"`
+	ReportS3Prefix   string   `long:"report-s3-prefix" env:"API_REPORT_S3_PREFIX" default:"reports"`
+	ReportS3Region   string   `long:"report-s3-region" env:"API_REPORT_S3_REGION" default:"eu-west-1"`
+	ReportTime       string   `long:"report-time" env:"API_REPORT_TIME" default:"01:00" description:"Time of day, as HH:MM in timezone, the daily reports are written" reload:"true"`
+	TrafficReports   []string `long:"traffic-reports" env:"API_TRAFFIC_REPORTS" env-delim:"," default:"day" description:"Traffic reports written: day each day, week on Mondays, month on the 1st" reload:"true"`
+	PageSize         int      `long:"page-size" env:"API_PAGE_SIZE" default:"50" description:"Events per page when the request doesn't say" reload:"true"`
+	MaxPageSize      int      `long:"max-page-size" env:"API_MAX_PAGE_SIZE" default:"500" reload:"true"`
+	QueryTimeoutSecs int      `long:"query-timeout" env:"API_QUERY_TIMEOUT" default:"10" reload:"true"`
+	PostgresDSN      string   `long:"postgres-dsn" env:"API_POSTGRES_DSN" description:"Connection string, as a postgres:// URL or key=value pairs, instead of the other postgres settings but the password" secret:"true"`
+	PostgresHost     string   `long:"postgres-host" env:"API_POSTGRES_HOST"`
+	PostgresPort     int      `long:"postgres-port" env:"API_POSTGRES_PORT" default:"5432"`
+	PostgresUser     string   `long:"postgres-user" env:"API_POSTGRES_USER" default:"lpr_api"`
+	PostgresPass     string   `long:"postgres-pass" env:"API_POSTGRES_PASS" secret:"true"`
+	PostgresDB       string   `long:"postgres-db" env:"API_POSTGRES_DB" default:"postgres"`
+	PostgresSSLMode  string   `long:"postgres-sslmode" env:"API_POSTGRES_SSLMODE" default:"verify-full"`
+	PostgresSSLRoot  string   `long:"postgres-sslrootcert" env:"API_POSTGRES_SSLROOTCERT" description:"CA certificate the server's is checked against"`
+	PostgresSSLCert  string   `long:"postgres-sslcert" env:"API_POSTGRES_SSLCERT" description:"Client certificate, if the server asks for one"`
+	PostgresSSLKey   string   `long:"postgres-sslkey" env:"API_POSTGRES_SSLKEY" description:"Client certificate's key"`
+	AllowInsecureDB  bool     `long:"allow-insecure-db" env:"API_ALLOW_INSECURE_DB" description:"Connect to the database without verify-full TLS"`
+	Migrate          string   `long:"migrate" env:"API_MIGRATE" default:"check" choice:"check" choice:"auto" description:"On startup, check the events database's schema is current, or bring it up to date"`
+	PlateKeys        []string `long:"plate-keys" env:"API_PLATE_KEYS" env-delim:"," description:"Keys the uploaders hash plates with, as id=key, to match watchlists and searches against hashed plates" secret:"true"`
+	PlateOpenKeys    []string `long:"plate-open-keys" env:"API_PLATE_OPEN_KEYS" env-delim:"," description:"RSA private keys, as PEM files, that open the plates the uploaders sealed"`
+	Revealers        []string `long:"revealers" env:"API_REVEALERS" env-delim:"," description:"Names of the keys that may reveal hashed plates" reload:"true"`
+	QueryTimeout     time.Duration
+	// Clients is the name of each key.
+	Clients map[string]string
+	// Visits are worked out by these rules, with days in Location.
+	Rules    analytics.Rules
+	Location *time.Location
+	// Pseudonyms and Opener are the plate keys and open keys.
+	Pseudonyms pseudonym.Keys
+	Opener     pseudonym.Opener
+}
+
+// Validate checks the options make sense together.
+func (o *Options) Validate() error {
+	switch {
+	case o.HTTPAddr == "":
+		return errors.New("http-addr must be set")
+	case len(o.Keys) == 0:
+		return errors.New("at least one key must be set")
+	case o.PageSize <= 0 || o.MaxPageSize < o.PageSize:
+		return errors.New("page-size must be positive and not over max-page-size")
+	case o.QueryTimeoutSecs <= 0:
+		return errors.New("query-timeout must be positive")
+	case o.CameraQuietMins <= 0:
+		return errors.New("camera-quiet must be positive")
+	case o.StreamBacklog <= 0:
+		return errors.New("stream-backlog must be positive")
+	case o.VisitGapMins <= 0:
+		return errors.New("visit-gap must be positive")
+	case o.MaxVisitHours <= 0:
+		return errors.New("max-visit must be positive")
+	case o.AnalyticsMax <= 0:
+		return errors.New("analytics-max-events must be positive")
+	case o.PostgresHost == "" && o.PostgresDSN == "":
+		return errors.New("postgres-host or postgres-dsn must be set")
+	}
+	if err := o.DB().Check(o.AllowInsecureDB); err != nil {
+		return fmt.Errorf("events database: %s", err)
+	}
+	if _, err := time.LoadLocation(o.Timezone); err != nil {
+		return fmt.Errorf("timezone: %s", err)
+	}
+	if _, err := time.Parse("15:04", o.ReportTime); err != nil {
+		return errors.New("report-time must be given as HH:MM")
+	}
+	for _, period := range o.TrafficReports {
+		if period != "day" && period != "week" && period != "month" {
+			return fmt.Errorf("traffic report %s must be day, week or month", period)
+		}
+	}
+	for _, camera := range append(append([]string{}, o.EntryCameras...), o.ExitCameras...) {
+		if i := strings.Index(camera, "@"); i <= 0 || i == len(camera)-1 {
+			return fmt.Errorf("camera %s must be given as camera@site", camera)
+		}
+	}
+	for _, camera := range o.EntryCameras {
+		if contains(o.ExitCameras, camera) {
+			return fmt.Errorf("camera %s can't be both an entry and an exit", camera)
+		}
+	}
+	names := make(map[string]bool)
+	for _, entry := range o.Keys {
+		name, key, err := parseKey(entry)
+		if err != nil {
+			return err
+		}
+		if names[name] {
+			return fmt.Errorf("key name %s is used twice", name)
+		}
+		names[name] = true
+		if len(key) < 16 {
+			return fmt.Errorf("key %s must be at least 16 characters", name)
+		}
+	}
+	for _, name := range o.Editors {
+		if !names[name] {
+			return fmt.Errorf("editor %s has no key", name)
+		}
+	}
+	for _, name := range o.Revealers {
+		if !names[name] {
+			return fmt.Errorf("revealer %s has no key", name)
+		}
+	}
+	if len(o.Revealers) > 0 && len(o.PlateOpenKeys) == 0 {
+		return errors.New("revealers need plate-open-keys")
+	}
+	if _, err := pseudonym.ParseKeys(o.PlateKeys); err != nil {
+		return err
+	}
+	if _, err := pseudonym.LoadOpener(o.PlateOpenKeys); err != nil {
+		return fmt.Errorf("plate-open-keys: %s", err)
+	}
+	for _, entry := range o.Watchlists {
+		i := strings.Index(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return errors.New("watchlist entries must be given as list=plate")
+		}
+		if _, err := path.Match(entry[i+1:], ""); err != nil {
+			return fmt.Errorf("watchlist %s: %s", entry, err)
+		}
+	}
+	return o.Common.Validate()
+}
+
+// parseKey splits a name=key entry. The name identifies the client in logs
+// and the corrections it makes.
+func parseKey(entry string) (string, string, error) {
+	i := strings.Index(entry, "=")
+	if i <= 0 {
+		return "", "", errors.New("keys must be given as name=key")
+	}
+	return entry[:i], entry[i+1:], nil
+}
+
+func (o *Options) derive() {
+	o.QueryTimeout = time.Duration(o.QueryTimeoutSecs) * time.Second
+	o.Clients = make(map[string]string, len(o.Keys))
+	for _, entry := range o.Keys {
+		name, key, _ := parseKey(entry)
+		o.Clients[key] = name
+	}
+	o.Rules = analytics.Rules{
+		Roles:    make(map[string]analytics.Role),
+		Gap:      time.Duration(o.VisitGapMins) * time.Minute,
+		MaxVisit: time.Duration(o.MaxVisitHours) * time.Hour,
+	}
+	for _, camera := range o.EntryCameras {
+		o.Rules.Roles[camera] = analytics.Entry
+	}
+	for _, camera := range o.ExitCameras {
+		o.Rules.Roles[camera] = analytics.Exit
+	}
+	o.Location, _ = time.LoadLocation(o.Timezone)
+	o.Pseudonyms, _ = pseudonym.ParseKeys(o.PlateKeys)
+	o.Opener, _ = pseudonym.LoadOpener(o.PlateOpenKeys)
+}
+
+// DB is how to connect to the events database.
+func (o *Options) DB() pgconn.Config {
+	return pgconn.Config{
+		DSN:         o.PostgresDSN,
+		Host:        o.PostgresHost,
+		Port:        o.PostgresPort,
+		User:        o.PostgresUser,
+		Password:    o.PostgresPass,
+		DB:          o.PostgresDB,
+		SSLMode:     o.PostgresSSLMode,
+		SSLRootCert: o.PostgresSSLRoot,
+		SSLCert:     o.PostgresSSLCert,
+		SSLKey:      o.PostgresSSLKey,
+	}
+}
+
+// ConnectString is the events database's connection string. Validate has
+// checked it can be made.
+func ConnectString() string {
+	connectStr, _ := Opts.DB().ConnectString()
+	return connectStr
+}
+
+// CameraQuiet is how long a camera may go without an event before the
+// dashboard flags it.
+func (o *Options) CameraQuiet() time.Duration {
+	return time.Duration(o.CameraQuietMins) * time.Minute
+}
+
+// Watchlisted returns the names of the watchlists the plate is on, sorted.
+// A plate recorded as its pseudonym is on the lists with the pseudonym, or
+// with the plate, if the plate keys are known. Patterns can't match it.
+func (o *Options) Watchlisted(plate string) []string {
+	lists := []string{}
+	hashed := pseudonym.Is(plate)
+	for _, entry := range o.Watchlists {
+		i := strings.Index(entry, "=")
+		list, pattern := entry[:i], strings.ToUpper(entry[i+1:])
+		matched, _ := path.Match(pattern, plate)
+		if !matched && hashed && !strings.ContainsAny(pattern, `*?[\`) {
+			matched = o.Pseudonyms.Matches(plate, pattern)
+		}
+		if matched && !contains(lists, list) {
+			lists = append(lists, list)
+		}
+	}
+	sort.Strings(lists)
+	return lists
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEditor reports whether the named client may correct plates.
+func (o *Options) IsEditor(name string) bool {
+	return contains(o.Editors, name)
+}
+
+// IsRevealer reports whether the named client may read hashed plates.
+func (o *Options) IsRevealer(name string) bool {
+	return contains(o.Revealers, name)
+}
+
+// Opts is the application config struct that we allow external access too.
+// Reloadable settings must be read through Snapshot.
+var Opts Options
+
+var (
+	mu   sync.RWMutex
+	args []string
+)
+
+// Init parses the options from the config file, env vars and args.
+func Init(cliArgs []string) {
+	args = cliArgs
+	err := settings.Parse("api", &Opts, args)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	Opts.derive()
+	Opts.SetupLogging("api")
+}
+
+// Reload re-reads the configuration and applies the reloadable settings,
+// returning the names of those that changed.
+func Reload() ([]string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	changed, err := settings.Reload("api", &Opts, args)
+	if err != nil {
+		return nil, err
+	}
+	Opts.derive()
+	Opts.ReloadLogging()
+	return changed, nil
+}
+
+// Snapshot returns a copy of the options that is safe to read during a reload.
+func Snapshot() Options {
+	mu.RLock()
+	defer mu.RUnlock()
+	return Opts
+}
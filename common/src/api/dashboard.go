@@ -0,0 +1,382 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// startTime is when the dashboard's files last changed, as far as caches
+// are concerned.
+var startTime = time.Now()
+
+// handleDashboard serves the operators' dashboard: a single page that asks
+// for a key and then uses the API like any other client. The page itself
+// holds no data, so it is served without a key.
+func handleDashboard(mux *http.ServeMux) {
+	files := map[string]struct {
+		contentType string
+		body        string
+	}{
+		"/":        {"text/html; charset=utf-8", dashboardHTML},
+		"/app.js":  {"application/javascript; charset=utf-8", dashboardJS},
+		"/app.css": {"text/css; charset=utf-8", dashboardCSS},
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		file, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		// Images come from the object store, everything else from here.
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' https: data:")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Type", file.contentType)
+		http.ServeContent(w, req, req.URL.Path, startTime, strings.NewReader(file.body))
+	})
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>LPR</title>
+<link rel="stylesheet" href="/app.css">
+</head>
+<body>
+<header>
+  <h1>LPR</h1>
+  <button id="forget" hidden>Forget key</button>
+</header>
+
+<form id="login" hidden>
+  <label>API key <input id="key" type="password" autocomplete="off" required></label>
+  <button>Open</button>
+  <p class="error" id="login-error"></p>
+</form>
+
+<main id="main" hidden>
+  <section>
+    <h2>Cameras</h2>
+    <table id="cameras">
+      <thead><tr><th>Site</th><th>Camera</th><th>Last read</th><th>Reads, 24h</th></tr></thead>
+      <tbody></tbody>
+    </table>
+  </section>
+
+  <section>
+    <h2>Search</h2>
+    <form id="search">
+      <input name="plate" placeholder="Plate">
+      <select name="match">
+        <option value="exact">Exact</option>
+        <option value="prefix">Starts with</option>
+        <option value="wildcard">Wildcard (* ?)</option>
+        <option value="fuzzy">Similar</option>
+      </select>
+      <input name="camera" placeholder="Camera">
+      <input name="site" placeholder="Site">
+      <label>From <input name="from" type="datetime-local"></label>
+      <label>To <input name="to" type="datetime-local"></label>
+      <button>Search</button>
+    </form>
+    <p class="error" id="search-error"></p>
+    <ol class="reads" id="results"></ol>
+    <button id="more" hidden>More</button>
+  </section>
+
+  <section>
+    <h2>Live <span class="note" id="live-status"></span></h2>
+    <ol class="reads" id="live"></ol>
+  </section>
+</main>
+
+<template id="read">
+  <li class="read">
+    <img class="plate-image" alt="Plate">
+    <a class="frame-link" target="_blank" rel="noopener"><img class="frame-image" alt="Frame"></a>
+    <div>
+      <div><strong class="plate"></strong> <span class="badge" hidden>corrected</span></div>
+      <div class="where"></div>
+      <time></time>
+      <details class="evidence" hidden>
+        <summary></summary>
+        <ol class="candidates"></ol>
+        <div class="detail"></div>
+      </details>
+      <div>
+        <button class="correct">Correct plate</button>
+        <button class="history">History</button>
+      </div>
+      <ul class="trail" hidden></ul>
+    </div>
+  </li>
+</template>
+
+<script src="/app.js"></script>
+</body>
+</html>
+`
+
+const dashboardJS = `"use strict";
+
+var keyName = "lpr-api-key";
+var livePollMs = 5000;
+var liveSize = 20;
+var seen = {};
+var nextCursor = "";
+var lastSearch = null;
+var timer = null;
+var liveIDs = "";
+
+function $(id) { return document.getElementById(id); }
+
+function api(method, path, body) {
+  var options = {method: method, headers: {"Authorization": "Bearer " + sessionStorage.getItem(keyName)}};
+  if (body) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  return fetch(path, options).then(function (res) {
+    return res.json().then(function (data) {
+      if (res.status === 401) {
+        logout("That key isn't valid.");
+      }
+      if (!res.ok) {
+        throw new Error(data.error || res.statusText);
+      }
+      return data;
+    });
+  });
+}
+
+function login(event) {
+  event.preventDefault();
+  sessionStorage.setItem(keyName, $("key").value);
+  $("key").value = "";
+  start();
+}
+
+function logout(message) {
+  sessionStorage.removeItem(keyName);
+  clearTimeout(timer);
+  $("main").hidden = true;
+  $("forget").hidden = true;
+  $("login").hidden = false;
+  $("login-error").textContent = message || "";
+}
+
+function start() {
+  if (!sessionStorage.getItem(keyName)) {
+    logout();
+    return;
+  }
+  $("login").hidden = true;
+  $("main").hidden = false;
+  $("forget").hidden = false;
+  poll();
+}
+
+function poll() {
+  clearTimeout(timer);
+  Promise.all([
+    api("GET", "/v1/events?limit=" + liveSize).then(showLive),
+    api("GET", "/v1/cameras").then(showCameras)
+  ]).then(function () {
+    $("live-status").textContent = "updated " + new Date().toLocaleTimeString();
+  }, function (err) {
+    $("live-status").textContent = err.message;
+  }).then(function () {
+    if (sessionStorage.getItem(keyName)) {
+      timer = setTimeout(poll, livePollMs);
+    }
+  });
+}
+
+// showLive redraws the live reads when there are new ones, leaving any open
+// history alone otherwise.
+function showLive(page) {
+  var ids = page.events.map(function (event) { return event.id; }).join(",");
+  if (ids === liveIDs) {
+    return;
+  }
+  liveIDs = ids;
+  var list = $("live");
+  var first = Object.keys(seen).length === 0;
+  list.textContent = "";
+  page.events.forEach(function (event) {
+    var item = renderRead(event);
+    if (!first && !seen[event.id]) {
+      item.classList.add("new");
+    }
+    seen[event.id] = true;
+    list.appendChild(item);
+  });
+}
+
+function showCameras(cameras) {
+  var body = $("cameras").tBodies[0];
+  body.textContent = "";
+  cameras.forEach(function (camera) {
+    var row = body.insertRow();
+    [camera.site, camera.camera, new Date(camera.last_seen).toLocaleString(), camera.events_24h].forEach(function (value) {
+      row.insertCell().textContent = value;
+    });
+    if (camera.quiet) {
+      row.classList.add("quiet");
+      row.title = "No reads for a while";
+    }
+  });
+}
+
+function renderRead(event) {
+  var item = document.importNode($("read").content, true).firstElementChild;
+  item.querySelector(".plate-image").src = event.plate_image;
+  item.querySelector(".frame-image").src = event.frame_image;
+  item.querySelector(".frame-link").href = event.frame_image;
+  item.querySelector(".plate").textContent = event.plate;
+  item.querySelector(".badge").hidden = !event.corrected;
+  item.querySelector(".where").textContent = event.camera + " @ " + event.site;
+  var time = item.querySelector("time");
+  time.dateTime = event.time;
+  time.textContent = new Date(event.time).toLocaleString();
+  if (event.evidence) {
+    showEvidence(event, item.querySelector(".evidence"));
+  }
+  item.querySelector(".correct").addEventListener("click", function () {
+    correct(event, item);
+  });
+  item.querySelector(".history").addEventListener("click", function () {
+    showHistory(event, item);
+  });
+  return item;
+}
+
+// showEvidence lists what OpenALPR made of the plate, for checking a read
+// before correcting it.
+function showEvidence(event, details) {
+  var e = event.evidence;
+  var summary = event.confidence.toFixed(1) + "% confident";
+  if (e.region) {
+    summary += ", " + e.region + (e.matches_template ? " pattern" : "");
+  }
+  details.querySelector("summary").textContent = summary;
+  (e.candidates || []).forEach(function (c) {
+    var line = c.plate + " " + c.confidence.toFixed(1) + "%";
+    if (c.matches_template) {
+      line += " (matches pattern)";
+    }
+    details.querySelector(".candidates").appendChild(document.createElement("li")).textContent = line;
+  });
+  details.querySelector(".detail").textContent = [
+    e.image_width + "x" + e.image_height,
+    e.processing_ms.toFixed(0) + " ms",
+    e.host,
+    "job " + e.job_id,
+    e.correlation_id
+  ].join(" · ");
+  details.hidden = false;
+}
+
+function correct(event, item) {
+  var plate = prompt("Correct plate for " + event.plate, event.plate);
+  if (plate === null || plate === event.plate) {
+    return;
+  }
+  var reason = prompt("Reason for the correction", "");
+  if (reason === null) {
+    return;
+  }
+  api("POST", "/v1/events/" + event.id + "/corrections", {plate: plate, reason: reason}).then(function (corrected) {
+    var updated = renderRead(corrected);
+    item.replaceWith(updated);
+    showHistory(corrected, updated);
+  }, function (err) {
+    alert("Couldn't correct the plate: " + err.message);
+  });
+}
+
+function showHistory(event, item) {
+  var trail = item.querySelector(".trail");
+  api("GET", "/v1/events/" + event.id + "/corrections").then(function (corrections) {
+    trail.textContent = "";
+    if (corrections.length === 0) {
+      trail.appendChild(document.createElement("li")).textContent = "Not corrected";
+    }
+    corrections.forEach(function (c) {
+      var line = new Date(c.time).toLocaleString() + ": " + c.old_plate + " to " + c.new_plate + " by " + c.editor;
+      if (c.reason) {
+        line += " (" + c.reason + ")";
+      }
+      trail.appendChild(document.createElement("li")).textContent = line;
+    });
+    trail.hidden = false;
+  }, function (err) {
+    alert("Couldn't load the history: " + err.message);
+  });
+}
+
+function search(event) {
+  if (event) {
+    event.preventDefault();
+    $("results").textContent = "";
+    nextCursor = "";
+    lastSearch = new URLSearchParams();
+    new FormData($("search")).forEach(function (value, name) {
+      if (value === "") {
+        return;
+      }
+      if (name === "from" || name === "to") {
+        value = new Date(value).toISOString().replace(/\.\d+Z$/, "Z");
+      }
+      lastSearch.set(name, value);
+    });
+  }
+  var params = new URLSearchParams(lastSearch);
+  if (nextCursor) {
+    params.set("cursor", nextCursor);
+  }
+  $("search-error").textContent = "";
+  api("GET", "/v1/events?" + params).then(function (page) {
+    page.events.forEach(function (e) {
+      $("results").appendChild(renderRead(e));
+    });
+    if (page.events.length === 0 && !nextCursor) {
+      $("search-error").textContent = "No reads found.";
+    }
+    nextCursor = page.next || "";
+    $("more").hidden = !nextCursor;
+  }, function (err) {
+    $("search-error").textContent = err.message;
+  });
+}
+
+$("login").addEventListener("submit", login);
+$("forget").addEventListener("click", function () { logout(); });
+$("search").addEventListener("submit", search);
+$("more").addEventListener("click", function () { search(); });
+start();
+`
+
+const dashboardCSS = `body { font-family: sans-serif; margin: 0 1em 2em; color: #222; }
+header { display: flex; align-items: center; justify-content: space-between; }
+section { margin-bottom: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 1em 0.2em 0; text-align: left; }
+tr.quiet td { color: #b00; }
+form input, form select, form button { margin: 0 0.5em 0.5em 0; }
+.error { color: #b00; }
+.note { font-size: 0.6em; font-weight: normal; color: #777; }
+.reads { list-style: none; padding: 0; }
+.read { display: flex; gap: 1em; align-items: flex-start; padding: 0.5em 0; border-bottom: 1px solid #ddd; }
+.read.new { background: #ffd; }
+.plate-image { height: 60px; }
+.frame-image { height: 120px; }
+.plate { font-family: monospace; font-size: 1.4em; letter-spacing: 0.1em; }
+.badge { background: #ddf; padding: 0 0.4em; border-radius: 0.3em; font-size: 0.8em; }
+.where, time { color: #555; display: block; }
+.trail { font-size: 0.9em; color: #555; }
+.evidence { font-size: 0.9em; color: #555; }
+.candidates { font-family: monospace; margin: 0.2em 0; }
+`
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+	"log"
+
+	"api/config"
+	"events"
+	"settings"
+)
+
+// PseudonymOptions are the flags of `api pseudonym`.
+type PseudonymOptions struct {
+	settings.Common
+
+	Plates []string `long:"plate" required:"true" description:"Plate to print the pseudonyms of, given once for each"`
+}
+
+// PseudonymMain prints each plate's pseudonym under each of the plate keys,
+// newest first, for watchlists that mustn't hold the plates themselves.
+func PseudonymMain(args []string) int {
+	var opts PseudonymOptions
+	if err := settings.Parse("pseudonym", &opts, args); err != nil {
+		log.Println(err)
+		return 1
+	}
+	var apiArgs []string
+	if opts.ConfigFile != "" {
+		apiArgs = []string{"--config", opts.ConfigFile}
+	}
+	config.Init(apiArgs)
+	if len(config.Opts.Pseudonyms) == 0 {
+		log.Println("plate-keys must be set")
+		return 1
+	}
+	for _, plate := range opts.Plates {
+		plate = events.NormalizePlate(plate)
+		for _, p := range config.Opts.Pseudonyms.All(plate) {
+			fmt.Println(plate, p)
+		}
+	}
+	return 0
+}
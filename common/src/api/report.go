@@ -0,0 +1,235 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"analytics"
+	"api/config"
+	"events"
+	"reports"
+	"settings"
+	"traffic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// reportTimeout is how many times longer than a request a report may take
+// to gather its events.
+const reportTimeout = 10
+
+// period is a range a traffic report covers, named by its kind and start.
+type period struct {
+	name     string
+	from, to time.Time
+}
+
+// trafficPeriods returns the traffic reports due on today, a midnight: the
+// day before, the week before on Mondays and the month before on the 1st.
+func trafficPeriods(today time.Time, kinds []string) []period {
+	var due []period
+	for _, kind := range kinds {
+		switch {
+		case kind == "day":
+			from := today.AddDate(0, 0, -1)
+			due = append(due, period{"traffic-day-" + from.Format("2006-01-02"), from, today})
+		case kind == "week" && today.Weekday() == time.Monday:
+			from := today.AddDate(0, 0, -7)
+			due = append(due, period{"traffic-week-" + from.Format("2006-01-02"), from, today})
+		case kind == "month" && today.Day() == 1:
+			from := today.AddDate(0, -1, 0)
+			due = append(due, period{"traffic-month-" + from.Format("2006-01"), from, today})
+		}
+	}
+	return due
+}
+
+// reportSinks returns where the configured reports are written.
+func reportSinks(opts config.Options) []reports.Sink {
+	var sinks []reports.Sink
+	if opts.ReportDir != "" {
+		sinks = append(sinks, reports.Dir(opts.ReportDir))
+	}
+	if opts.ReportS3Bucket != "" {
+		uploader := s3manager.NewUploader(session.New(&aws.Config{Region: aws.String(opts.ReportS3Region)}))
+		sinks = append(sinks, reports.S3{Uploader: uploader, Bucket: opts.ReportS3Bucket, Prefix: opts.ReportS3Prefix})
+	}
+	return sinks
+}
+
+// report writes the reports due at due, the previous day's visits and the
+// traffic reports ending at midnight, to each sink.
+func (s *Server) report(ctx context.Context, sinks []reports.Sink, due time.Time) {
+	opts := config.Snapshot()
+	now := due.In(opts.Location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, opts.Location)
+	yesterday := today.AddDate(0, 0, -1)
+
+	files := make(map[string][]byte)
+	var buf bytes.Buffer
+	if err := s.writeVisits(ctx, opts, &buf, yesterday, today); err != nil {
+		logger.Error("Visits report", "day", yesterday.Format("2006-01-02"), "err", err)
+	} else {
+		files["visits-"+yesterday.Format("2006-01-02")+".csv"] = buf.Bytes()
+	}
+	for _, p := range trafficPeriods(today, opts.TrafficReports) {
+		for _, format := range []string{"csv", "json"} {
+			var buf bytes.Buffer
+			if err := s.writeTraffic(ctx, opts, &buf, p.from, p.to, format); err != nil {
+				logger.Error("Traffic report", "report", p.name, "format", format, "err", err)
+				continue
+			}
+			files[p.name+"."+format] = buf.Bytes()
+		}
+	}
+
+	for name, body := range files {
+		for _, sink := range sinks {
+			where, err := sink.Put(ctx, name, body)
+			if err != nil {
+				logger.Error("Report", "name", name, "err", err)
+				continue
+			}
+			logger.Info("Wrote report", "name", name, "to", where)
+		}
+	}
+}
+
+// writeVisits writes the visits starting within [from, to) as CSV.
+func (s *Server) writeVisits(ctx context.Context, opts config.Options, w io.Writer, from, to time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout*opts.QueryTimeout)
+	defer cancel()
+	visits, err := s.visitsIn(ctx, opts, "", "", from, to)
+	if err != nil {
+		return err
+	}
+	return analytics.WriteCSV(w, visits)
+}
+
+// writeTraffic writes the traffic over [from, to) as CSV or JSON.
+func (s *Server) writeTraffic(ctx context.Context, opts config.Options, w io.Writer, from, to time.Time, format string) error {
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout*opts.QueryTimeout)
+	defer cancel()
+	rows, err := s.store.PlateHours(ctx, from, to, opts.Location)
+	if err != nil {
+		return err
+	}
+	report := traffic.Build(rows, from, to, opts.Location)
+	if format == "json" {
+		return report.WriteJSON(w)
+	}
+	return report.WriteCSV(w)
+}
+
+// ReportOptions are for generating a report by hand. They are read from the
+// "report" section of the config file, and the database and timezone from
+// the "api" section.
+type ReportOptions struct {
+	settings.Common
+
+	Kind   string `long:"kind" default:"traffic" choice:"traffic" choice:"visits" description:"Traffic counts, or the visits starting in the range"`
+	From   string `long:"from" required:"true" description:"Start of the range, as a date in the API's timezone or an RFC 3339 time"`
+	To     string `long:"to" description:"End of the range, exclusive, the same way; now if not given"`
+	Format string `long:"format" default:"csv" choice:"csv" choice:"json" description:"Visits are only written as CSV"`
+	Output string `long:"output" description:"File to write, instead of stdout"`
+}
+
+// Validate checks the options.
+func (o *ReportOptions) Validate() error {
+	if o.Kind == "visits" && o.Format != "csv" {
+		return errors.New("visits are only written as CSV")
+	}
+	return o.Common.Validate()
+}
+
+// parseTime reads a date, as midnight in loc, or an RFC 3339 time.
+func parseTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("%s is neither a date nor an RFC 3339 time", value)
+	}
+	return t, nil
+}
+
+// ReportMain writes a traffic or visits report over the range given.
+func ReportMain(args []string) int {
+	var opts ReportOptions
+	if err := settings.Parse("report", &opts, args); err != nil {
+		log.Println(err)
+		return 1
+	}
+	// The API only takes the config file, its settings being in its section
+	// and the env.
+	var apiArgs []string
+	if opts.ConfigFile != "" {
+		apiArgs = []string{"--config", opts.ConfigFile}
+	}
+	config.Init(apiArgs)
+	if err := opts.SetupLogging("report"); err != nil {
+		log.Println(err)
+		return 1
+	}
+	apiOpts := config.Snapshot()
+	from, err := parseTime(opts.From, apiOpts.Location)
+	if err != nil {
+		log.Println("from:", err)
+		return 1
+	}
+	to := time.Now()
+	if opts.To != "" {
+		if to, err = parseTime(opts.To, apiOpts.Location); err != nil {
+			log.Println("to:", err)
+			return 1
+		}
+	}
+	if !from.Before(to) {
+		log.Println("from must be before to")
+		return 1
+	}
+
+	store, err := events.Open(config.ConnectString())
+	if err != nil {
+		logger.Error("DB", "err", err)
+		return 1
+	}
+	if err := ensureSchema(store, false); err != nil {
+		store.Close()
+		logger.Error("DB", "err", err)
+		return 1
+	}
+	s := NewWith(store)
+	defer s.Close()
+
+	var out bytes.Buffer
+	if opts.Kind == "visits" {
+		err = s.writeVisits(context.Background(), apiOpts, &out, from, to)
+	} else {
+		err = s.writeTraffic(context.Background(), apiOpts, &out, from, to, opts.Format)
+	}
+	if err != nil {
+		logger.Error("Report", "kind", opts.Kind, "err", err)
+		return 1
+	}
+	if opts.Output == "" {
+		_, err = os.Stdout.Write(out.Bytes())
+	} else {
+		_, err = reports.Dir(filepath.Dir(opts.Output)).Put(context.Background(), filepath.Base(opts.Output), out.Bytes())
+	}
+	if err != nil {
+		logger.Error("Output", "err", err)
+		return 1
+	}
+	return 0
+}
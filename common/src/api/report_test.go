@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"api/config"
+	"reports"
+	"traffic"
+)
+
+func TestTrafficPeriods(t *testing.T) {
+	kinds := []string{"day", "week", "month"}
+	names := func(periods []period) []string {
+		var list []string
+		for _, p := range periods {
+			list = append(list, p.name)
+		}
+		return list
+	}
+	tuesday := time.Date(2016, 9, 20, 0, 0, 0, 0, time.UTC)
+	if got := names(trafficPeriods(tuesday, kinds)); !reflect.DeepEqual(got, []string{"traffic-day-2016-09-19"}) {
+		t.Errorf("Unexpected reports on a Tuesday %q", got)
+	}
+	monday := time.Date(2016, 9, 19, 0, 0, 0, 0, time.UTC)
+	if got := names(trafficPeriods(monday, kinds)); !reflect.DeepEqual(got, []string{"traffic-day-2016-09-18", "traffic-week-2016-09-12"}) {
+		t.Errorf("Unexpected reports on a Monday %q", got)
+	}
+	first := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+	periods := trafficPeriods(first, []string{"month"})
+	if len(periods) != 1 || periods[0].name != "traffic-month-2016-09" || !periods[0].from.Equal(first.AddDate(0, -1, 0)) {
+		t.Errorf("Unexpected reports on the 1st %+v", periods)
+	}
+}
+
+func TestReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newTestServer(&fakeStore{})
+	config.Opts.TrafficReports = []string{"day", "week"}
+	s := NewWith(&fakeStore{events: visitEvents()})
+	// Due at 1am on Wednesday the 21st, for the Tuesday.
+	s.report(context.Background(), []reports.Sink{reports.Dir(dir)}, visitDay.Add(25*time.Hour))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	sort.Strings(files)
+	expected := []string{"traffic-day-2016-09-20.csv", "traffic-day-2016-09-20.json", "visits-2016-09-20.csv"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("Expected %q, got %q", expected, files)
+	}
+	visits, _ := ioutil.ReadFile(filepath.Join(dir, "visits-2016-09-20.csv"))
+	if lines := strings.Count(string(visits), "\n"); lines != 3 {
+		t.Errorf("Expected a header and two visits, got:\n%s", visits)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "traffic-day-2016-09-20.json"))
+	var report traffic.Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	// The depot, then its gate-in, gate-out and yard cameras.
+	if len(report.Summaries) != 4 || report.Summaries[0].Events != 3 || report.Summaries[0].Plates != 2 {
+		t.Errorf("Unexpected report %s", data)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	if got, err := parseTime("2016-09-20", london); err != nil || !got.Equal(time.Date(2016, 9, 19, 23, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected midnight in London, got %s %v", got, err)
+	}
+	if got, err := parseTime("2016-09-20T13:54:26Z", london); err != nil || !got.Equal(time.Date(2016, 9, 20, 13, 54, 26, 0, time.UTC)) {
+		t.Errorf("Unexpected time %s %v", got, err)
+	}
+	if _, err := parseTime("yesterday", london); err == nil {
+		t.Error("Expected an error")
+	}
+}
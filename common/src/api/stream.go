@@ -0,0 +1,282 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"api/config"
+	"events"
+	"metrics"
+)
+
+// keepalive is how often an idle stream is sent a comment, so proxies don't
+// time it out and clients notice a dead connection.
+const keepalive = 15 * time.Second
+
+// Read is an event as streamed, with the watchlists its plate is on.
+type Read struct {
+	events.Event
+	Watchlists []string `json:"watchlists"`
+}
+
+// streamFilter is what a stream client asked for.
+type streamFilter struct {
+	camera    string
+	site      string
+	watchlist string
+}
+
+func (f streamFilter) matches(read Read) bool {
+	switch {
+	case f.camera != "" && read.Camera != f.camera:
+		return false
+	case f.site != "" && read.Site != f.site:
+		return false
+	case f.watchlist == "any":
+		return len(read.Watchlists) > 0
+	case f.watchlist != "":
+		return contains(read.Watchlists, f.watchlist)
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// hub fans new events out to the stream clients. A client that falls too
+// far behind is dropped, and can resume from the last event it had.
+type hub struct {
+	mu      sync.Mutex
+	clients map[chan Read]streamFilter
+	lastID  int64
+}
+
+func newHub() *hub {
+	return &hub{clients: make(map[chan Read]streamFilter)}
+}
+
+// subscribe returns a channel receiving the reads matching filter, closed if
+// the client falls behind.
+func (h *hub) subscribe(filter streamFilter) chan Read {
+	c := make(chan Read, 100)
+	h.mu.Lock()
+	h.clients[c] = filter
+	h.mu.Unlock()
+	metrics.StreamClients.Inc()
+	return c
+}
+
+func (h *hub) unsubscribe(c chan Read) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c)
+	}
+	metrics.StreamClients.Dec()
+}
+
+func (h *hub) publish(read Read) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if read.ID > h.lastID {
+		h.lastID = read.ID
+	}
+	for c, filter := range h.clients {
+		if !filter.matches(read) {
+			continue
+		}
+		select {
+		case c <- read:
+		default:
+			delete(h.clients, c)
+			close(c)
+			metrics.StreamDropped.Inc()
+		}
+	}
+}
+
+// last is the id of the newest event published.
+func (h *hub) last() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastID
+}
+
+// Feed tells the server of events as they are recorded. Next returns 0 when
+// events may have been missed.
+type Feed interface {
+	Next(ctx context.Context) (int64, error)
+}
+
+// follow publishes the events the feed announces until ctx is cancelled,
+// catching up from the last one published when the feed has missed some.
+func (s *Server) follow(ctx context.Context, feed Feed) {
+	backoff := config.Opts.Backoff(time.Minute)
+	for {
+		id, err := feed.Next(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = s.announce(ctx, id)
+		}
+		if err != nil {
+			wait := backoff.Duration()
+			logger.Error("Stream", "sleeping", wait, "err", err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		backoff.Reset()
+	}
+}
+
+// announce publishes the event with the id, or every event since the last
+// published if id is 0.
+func (s *Server) announce(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, config.Snapshot().QueryTimeout)
+	defer cancel()
+	if id != 0 {
+		event, err := s.store.Get(ctx, id)
+		if err != nil {
+			return fmt.Errorf("event %d: %s", id, err)
+		}
+		s.publish(event)
+		return nil
+	}
+	last := s.hub.last()
+	if last == 0 {
+		return nil
+	}
+	missed, err := s.store.Since(ctx, last, config.Snapshot().StreamBacklog)
+	if err != nil {
+		return fmt.Errorf("catching up: %s", err)
+	}
+	logger.Info("Stream caught up", "after_id", last, "events", len(missed))
+	for _, event := range missed {
+		s.publish(event)
+	}
+	return nil
+}
+
+// publish sends the event to the stream clients.
+func (s *Server) publish(event events.Event) {
+	opts := config.Snapshot()
+	s.hub.publish(Read{Event: event, Watchlists: opts.Watchlisted(event.Plate)})
+}
+
+// stream serves GET /v1/stream as server-sent events, one "read" for each
+// event recorded from when it connects. camera, site and watchlist (a list's
+// name, or "any") filter them. A client resuming with Last-Event-ID, or
+// after, is first sent the events it missed, up to the stream backlog.
+func (s *Server) stream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	values := req.URL.Query()
+	filter := streamFilter{camera: values.Get("camera"), site: values.Get("site"), watchlist: values.Get("watchlist")}
+	after := req.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = values.Get("after")
+	}
+	var afterID int64
+	if after != "" {
+		var err error
+		if afterID, err = strconv.ParseInt(after, 10, 64); err != nil || afterID < 0 {
+			writeError(w, http.StatusBadRequest, "after must be an event id")
+			return
+		}
+	}
+
+	// Subscribe before catching up, so nothing recorded meanwhile is missed.
+	c := s.hub.subscribe(filter)
+	defer s.hub.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	sent := make(map[int64]bool)
+	if afterID > 0 {
+		opts := config.Snapshot()
+		ctx, cancel := context.WithTimeout(req.Context(), opts.QueryTimeout)
+		missed, err := s.store.Since(ctx, afterID, opts.StreamBacklog+1)
+		cancel()
+		if err != nil {
+			logger.Error("Stream", "after_id", afterID, "err", err)
+			return
+		}
+		if len(missed) > opts.StreamBacklog {
+			// Too far behind to catch up here, so say where the gap starts
+			// and let the client search for the rest.
+			missed = missed[:opts.StreamBacklog]
+			sentThrough := afterID
+			if len(missed) > 0 {
+				sentThrough = missed[len(missed)-1].ID
+			}
+			writeStreamEvent(w, "truncated", "", map[string]int64{"after": afterID, "sent_through": sentThrough})
+		}
+		for _, event := range missed {
+			read := Read{Event: event, Watchlists: opts.Watchlisted(event.Plate)}
+			if filter.matches(read) {
+				writeStreamEvent(w, "read", strconv.FormatInt(read.ID, 10), read)
+			}
+			sent[event.ID] = true
+		}
+		flusher.Flush()
+	}
+
+	ticker := time.NewTicker(keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case read, ok := <-c:
+			if !ok {
+				logger.Warn("Stream client fell behind", "client", client(req))
+				return
+			}
+			// Ids are in commit order, so anything at or below afterID was
+			// committed before the client's last event and it has it.
+			if read.ID <= afterID || sent[read.ID] {
+				continue
+			}
+			writeStreamEvent(w, "read", strconv.FormatInt(read.ID, 10), read)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-req.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeStreamEvent writes a server-sent event with a JSON body.
+func writeStreamEvent(w http.ResponseWriter, name string, id string, body interface{}) {
+	data, _ := json.Marshal(body)
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"api/config"
+	"events"
+)
+
+// streamClient reads server-sent events off a stream.
+type streamClient struct {
+	lines *bufio.Scanner
+	body  interface{ Close() error }
+}
+
+func connect(t *testing.T, url string, headers ...string) *streamClient {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-API-Key", key)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected a stream, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	return &streamClient{lines: bufio.NewScanner(res.Body), body: res.Body}
+}
+
+// next returns the next event's fields, skipping comments and the retry.
+func (c *streamClient) next(t *testing.T) map[string]string {
+	fields := make(map[string]string)
+	for c.lines.Scan() {
+		line := c.lines.Text()
+		if line == "" {
+			if fields["event"] != "" {
+				return fields
+			}
+			fields = make(map[string]string)
+			continue
+		}
+		if parts := strings.SplitN(line, ": ", 2); len(parts) == 2 && parts[0] != "" {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	t.Fatal("Stream ended:", c.lines.Err())
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	at := time.Date(2016, 9, 20, 13, 54, 26, 0, time.UTC)
+	store := &fakeStore{events: []events.Event{
+		{ID: 1, Time: at, Camera: "gate", Site: "depot", Plate: "CA982063"},
+		{ID: 2, Time: at, Camera: "exit", Site: "depot", Plate: "AB12CDE"},
+		{ID: 3, Time: at, Camera: "gate", Site: "depot", Plate: "XY34ZZZ", Confidence: 91.5},
+	}}
+	newTestServer(store)
+	config.Opts.Watchlists = []string{"stolen=XY34*", "fleet=XY34ZZZ", "fleet=AB12CDE"}
+	config.Opts.StreamBacklog = 1000
+	s := NewWith(store)
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+	defer close(s.stopping)
+
+	// Resuming after 1 sends what was missed at the gate, then new reads.
+	gate := connect(t, server.URL+"/v1/stream?camera=gate", "Last-Event-ID", "1")
+	defer gate.body.Close()
+	read := gate.next(t)
+	expected := map[string]string{
+		"id":    "3",
+		"event": "read",
+		"data":  `{"id":3,"time":"2016-09-20T13:54:26Z","camera":"gate","site":"depot","plate":"XY34ZZZ","confidence":91.5,"plate_image":"","frame_image":"","corrected":false,"watchlists":["fleet","stolen"]}`,
+	}
+	if !reflect.DeepEqual(read, expected) {
+		t.Errorf("Expected %q, got %q", expected, read)
+	}
+
+	stolen := connect(t, server.URL+"/v1/stream?watchlist=stolen")
+	defer stolen.body.Close()
+	// The stream already had 3, and the others aren't at the gate.
+	for _, event := range append(store.events, events.Event{ID: 4, Camera: "gate", Plate: "XY34ABC"}) {
+		s.publish(event)
+	}
+	if read := gate.next(t); read["id"] != "4" {
+		t.Errorf("Expected 4 next at the gate, got %q", read)
+	}
+	for _, id := range []string{"3", "4"} {
+		if read := stolen.next(t); read["id"] != id {
+			t.Errorf("Expected stolen %s, got %q", id, read)
+		}
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	store := &fakeStore{}
+	for id := int64(1); id <= 5; id++ {
+		store.events = append(store.events, events.Event{ID: id})
+	}
+	newTestServer(store)
+	config.Opts.StreamBacklog = 2
+	s := NewWith(store)
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+	defer close(s.stopping)
+
+	c := connect(t, server.URL+"/v1/stream?after=1")
+	defer c.body.Close()
+	if gap := c.next(t); gap["event"] != "truncated" || gap["data"] != `{"after":1,"sent_through":3}` {
+		t.Errorf("Expected the gap reported, got %q", gap)
+	}
+	for _, id := range []string{"2", "3"} {
+		if read := c.next(t); read["id"] != id {
+			t.Errorf("Expected %s, got %q", id, read)
+		}
+	}
+
+	// Validate refuses a backlog of 0, but a stream with one still only
+	// reports the gap.
+	config.Opts.StreamBacklog = 0
+	empty := connect(t, server.URL+"/v1/stream?after=1")
+	defer empty.body.Close()
+	if gap := empty.next(t); gap["event"] != "truncated" || gap["data"] != `{"after":1,"sent_through":1}` {
+		t.Errorf("Expected the gap reported, got %q", gap)
+	}
+}
+
+func TestHubDropsSlowClients(t *testing.T) {
+	h := newHub()
+	c := h.subscribe(streamFilter{})
+	for id := int64(1); id <= 101; id++ {
+		h.publish(Read{Event: events.Event{ID: id}})
+	}
+	n := 0
+	for range c {
+		n++
+	}
+	if n != 100 || h.last() != 101 {
+		t.Errorf("Expected 100 reads before the drop and 101 last, got %d and %d", n, h.last())
+	}
+	h.unsubscribe(c)
+}
+
+// fakeFeed announces the ids sent on it.
+type fakeFeed chan int64
+
+func (f fakeFeed) Next(ctx context.Context) (int64, error) {
+	select {
+	case id := <-f:
+		return id, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func TestFollow(t *testing.T) {
+	store := &fakeStore{events: []events.Event{{ID: 1}, {ID: 2}, {ID: 3}}}
+	newTestServer(store)
+	config.Opts.StreamBacklog = 1000
+	s := NewWith(store)
+	c := s.hub.subscribe(streamFilter{})
+	defer s.hub.unsubscribe(c)
+	feed := make(fakeFeed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.follow(ctx, feed)
+
+	// After a reconnect, whatever came after the last one announced.
+	feed <- 1
+	feed <- 0
+	for _, expected := range []int64{1, 2, 3} {
+		select {
+		case read := <-c:
+			if read.ID != expected {
+				t.Errorf("Expected %d, got %d", expected, read.ID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %d", expected)
+		}
+	}
+}
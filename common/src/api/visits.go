@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"analytics"
+	"api/config"
+	"events"
+	"pseudonym"
+)
+
+// visitsIn works out the visits, of one plate or to one site if given, that
+// start within [from, to). Sightings from the rules' margin either side are
+// read too, so visits crossing the edges are whole.
+func (s *Server) visitsIn(ctx context.Context, opts config.Options, plate, site string, from, to time.Time) ([]analytics.Visit, error) {
+	margin := opts.Rules.Margin()
+	sightings, err := s.store.Sightings(ctx, plate, site, from.Add(-margin), to.Add(margin), opts.AnalyticsMax)
+	if err != nil {
+		return nil, err
+	}
+	return analytics.Starting(analytics.Visits(sightings, opts.Rules), from, to), nil
+}
+
+// visitRange reads from and to, defaulting to the day up to now.
+func visitRange(values url.Values, now time.Time) (time.Time, time.Time, error) {
+	from, to := now.Add(-24*time.Hour), now
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := values.Get(name); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return from, to, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+		}
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// visits serves GET /v1/visits, the visits starting between from and to,
+// optionally of one plate or to one site. format=csv returns them as CSV.
+func (s *Server) visits(w http.ResponseWriter, req *http.Request) {
+	values := req.URL.Query()
+	from, to, err := visitRange(values, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts := config.Snapshot()
+	ctx, cancel := context.WithTimeout(req.Context(), opts.QueryTimeout)
+	defer cancel()
+	plate := events.NormalizePlate(values.Get("plate"))
+	visits, err := s.visitsIn(ctx, opts, plate, values.Get("site"), from, to)
+	if err != nil {
+		s.visitsError(ctx, w, err)
+		return
+	}
+	if values.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		analytics.WriteCSV(w, visits)
+		return
+	}
+	writeJSON(w, http.StatusOK, visits)
+}
+
+// visitSummary serves GET /v1/visits/summary, how often each plate visited
+// each site between from and to, most frequent first.
+func (s *Server) visitSummary(w http.ResponseWriter, req *http.Request) {
+	values := req.URL.Query()
+	from, to, err := visitRange(values, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts := config.Snapshot()
+	ctx, cancel := context.WithTimeout(req.Context(), opts.QueryTimeout)
+	defer cancel()
+	plate := events.NormalizePlate(values.Get("plate"))
+	visits, err := s.visitsIn(ctx, opts, plate, values.Get("site"), from, to)
+	if err != nil {
+		s.visitsError(ctx, w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, analytics.Summarize(visits, opts.Location))
+}
+
+func (s *Server) visitsError(ctx context.Context, w http.ResponseWriter, err error) {
+	if err == events.ErrTooMany {
+		writeError(w, http.StatusBadRequest, "too many sightings to work out visits, narrow the range or give a plate or site")
+		return
+	}
+	s.storeError(ctx, w, err)
+}
+
+// plate serves GET /v1/plates/{plate}, when the plate was first and last
+// seen at each site. A hashed plate is given as its pseudonym.
+func (s *Server) plate(w http.ResponseWriter, req *http.Request) {
+	plate := events.NormalizePlate(strings.TrimPrefix(req.URL.Path, "/v1/plates/"))
+	if events.ValidPlate(plate) != nil && !pseudonym.Is(plate) {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), config.Snapshot().QueryTimeout)
+	defer cancel()
+	sites, err := s.store.PlateHistory(ctx, plate)
+	if err != nil {
+		s.storeError(ctx, w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"plate": plate, "sites": sites})
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"analytics"
+	"api/config"
+	"events"
+)
+
+var visitDay = time.Date(2016, 9, 20, 0, 0, 0, 0, time.UTC)
+
+func visitEvents() []events.Event {
+	at := func(hours float64) time.Time { return visitDay.Add(time.Duration(hours * float64(time.Hour))) }
+	return []events.Event{
+		{ID: 1, Plate: "AB12CDE", Camera: "gate-in", Site: "depot", Time: at(8)},
+		{ID: 2, Plate: "AB12CDE", Camera: "gate-out", Site: "depot", Time: at(17)},
+		{ID: 3, Plate: "AB12CDE", Camera: "gate-in", Site: "depot", Time: at(32)},
+		{ID: 4, Plate: "AB12CDE", Camera: "gate-out", Site: "depot", Time: at(33)},
+		{ID: 5, Plate: "XY34ZZZ", Camera: "yard", Site: "depot", Time: at(23.75)},
+		{ID: 6, Plate: "XY34ZZZ", Camera: "yard", Site: "depot", Time: at(24.25)},
+	}
+}
+
+func TestVisits(t *testing.T) {
+	h := newTestServer(&fakeStore{events: visitEvents()})
+	w := get(h, "/v1/visits?from=2016-09-20T00:00:00Z&to=2016-09-21T00:00:00Z", "X-API-Key", key)
+	var visits []analytics.Visit
+	if err := json.Unmarshal(w.Body.Bytes(), &visits); err != nil {
+		t.Fatalf("%d: %s", w.Code, w.Body)
+	}
+	// The second visit runs past midnight but starts within the day.
+	if len(visits) != 2 || !visits[0].Complete || visits[0].DwellSeconds != 9*3600 ||
+		visits[1].Plate != "XY34ZZZ" || visits[1].Sightings != 2 {
+		t.Errorf("Unexpected visits %s", w.Body)
+	}
+
+	w = get(h, "/v1/visits?from=2016-09-20T00:00:00Z&to=2016-09-22T00:00:00Z&plate=ab12+cde&format=csv", "X-API-Key", key)
+	if w.Header().Get("Content-Type") != "text/csv; charset=utf-8" || strings.Count(w.Body.String(), "\n") != 3 {
+		t.Errorf("Expected a header and two visits, got %s", w.Body)
+	}
+
+	for _, url := range []string{
+		"/v1/visits?from=yesterday",
+		"/v1/visits?from=2016-09-21T00:00:00Z&to=2016-09-20T00:00:00Z",
+	} {
+		if w := get(h, url, "X-API-Key", key); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", url, http.StatusBadRequest, w.Code)
+		}
+	}
+	config.Opts.AnalyticsMax = 2
+	if w := get(h, "/v1/visits?from=2016-09-20T00:00:00Z&to=2016-09-21T00:00:00Z", "X-API-Key", key); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected too many sightings refused, got %d", w.Code)
+	}
+}
+
+func TestVisitSummary(t *testing.T) {
+	h := newTestServer(&fakeStore{events: visitEvents()})
+	w := get(h, "/v1/visits/summary?from=2016-09-20T00:00:00Z&to=2016-09-22T00:00:00Z", "X-API-Key", key)
+	var summaries []analytics.PlateSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summaries); err != nil {
+		t.Fatalf("%d: %s", w.Code, w.Body)
+	}
+	if len(summaries) != 2 || summaries[0].Plate != "AB12CDE" || summaries[0].Visits != 2 || summaries[0].DaysSeen != 2 ||
+		summaries[1].DaysSeen != 2 {
+		t.Errorf("Unexpected summaries %s", w.Body)
+	}
+}
+
+func TestPlate(t *testing.T) {
+	h := newTestServer(&fakeStore{events: visitEvents()})
+	w := get(h, "/v1/plates/ab12cde", "X-API-Key", key)
+	var body struct {
+		Plate string
+		Sites []events.PlateSite
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%d: %s", w.Code, w.Body)
+	}
+	if body.Plate != "AB12CDE" || len(body.Sites) != 1 || body.Sites[0].Events != 4 ||
+		!body.Sites[0].LastSeen.Equal(visitDay.Add(33*time.Hour)) {
+		t.Errorf("Unexpected history %s", w.Body)
+	}
+	if w := get(h, "/v1/plates/AB%25", "X-API-Key", key); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an invalid plate not found, got %d", w.Code)
+	}
+}
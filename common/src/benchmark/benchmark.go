@@ -0,0 +1,466 @@
+package benchmark
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"detector"
+	detectorconfig "detector/config"
+	"jobs"
+	"logging"
+	"queue"
+	"settings"
+	"shutdown"
+
+	"github.com/openalpr/openalpr"
+)
+
+var logger = logging.With("service", "benchmark")
+
+// Options for a benchmark run. They are read from the "benchmark" section of
+// the config file, and the detector settings being measured from its own.
+type Options struct {
+	settings.Common
+
+	Truth string `long:"truth" env:"BENCHMARK_TRUTH" required:"true" description:"CSV of image,plate rows with image paths relative to the dir, an empty plate meaning none"`
+	JSON  bool   `long:"json" description:"Print the results as JSON, for comparing runs"`
+	Args  struct {
+		Dir string `positional-arg-name:"dir" required:"1"`
+	} `positional-args:"yes"`
+}
+
+// Truth is the plates really in each image, by its path relative to the
+// benchmark directory.
+type Truth map[string][]string
+
+// ReadTruth reads image,plate rows. An image with several plates has a row
+// for each, and one with none a row with an empty plate. A header row
+// starting "image" is skipped.
+func ReadTruth(r io.Reader) (Truth, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	truth := make(Truth)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(record[0], "image") {
+			continue
+		}
+		if len(record) > 2 || record[0] == "" {
+			return nil, fmt.Errorf("line %d: expected image,plate", line)
+		}
+		image := filepath.Clean(record[0])
+		plates := truth[image]
+		if len(record) == 2 {
+			if plate := Normalize(record[1]); plate != "" {
+				plates = append(plates, plate)
+			}
+		}
+		truth[image] = plates
+	}
+	if len(truth) == 0 {
+		return nil, errors.New("no images")
+	}
+	return truth, nil
+}
+
+// Normalize uppercases a plate and drops anything but letters and digits, as
+// plates are written with spaces and dashes that ALPR doesn't read.
+func Normalize(plate string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, plate)
+}
+
+// Reading is what the detector made of one image.
+type Reading struct {
+	Plates     []string
+	Candidates []string
+	Latency    time.Duration
+	Err        error
+}
+
+// reading turns recognition results into a reading.
+func reading(results openalpr.AlprResults, latency time.Duration, err error) Reading {
+	r := Reading{Latency: latency, Err: err}
+	for _, plate := range results.Plates {
+		r.Plates = append(r.Plates, Normalize(plate.BestPlate))
+		for _, candidate := range plate.TopNPlates {
+			r.Candidates = append(r.Candidates, Normalize(candidate.Characters))
+		}
+	}
+	return r
+}
+
+// Distance is the Levenshtein distance between two plates.
+func Distance(a string, b string) int {
+	s, t := []rune(a), []rune(b)
+	prev := make([]int, len(t)+1)
+	curr := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		curr[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(t)]
+}
+
+// Latency summarises the per-image recognition times, in milliseconds.
+type Latency struct {
+	Mean float64 `json:"mean_ms"`
+	P50  float64 `json:"p50_ms"`
+	P90  float64 `json:"p90_ms"`
+	P99  float64 `json:"p99_ms"`
+	Max  float64 `json:"max_ms"`
+}
+
+// ImageResult is how one image was read.
+type ImageResult struct {
+	Image     string   `json:"image"`
+	Truth     []string `json:"truth"`
+	Read      []string `json:"read"`
+	Missed    []string `json:"missed,omitempty"`
+	Extra     []string `json:"extra,omitempty"`
+	LatencyMs float64  `json:"latency_ms"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Result is a benchmark run's scores, along with what it ran with so runs
+// can be compared.
+type Result struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Arch    string    `json:"arch"`
+	CPUs    int       `json:"cpus"`
+	Version string    `json:"alpr_version"`
+	Region  string    `json:"region"`
+	TopN    int       `json:"topn"`
+	Images  int       `json:"images"`
+	Plates  int       `json:"plates"`
+	Failed  int       `json:"failed"`
+	Elapsed float64   `json:"elapsed_seconds"`
+
+	// Accuracy is the share of true plates read exactly, and TopNAccuracy
+	// the share among the candidates.
+	ExactMatches  int     `json:"exact_matches"`
+	Accuracy      float64 `json:"accuracy"`
+	TopNMatches   int     `json:"topn_matches"`
+	TopNAccuracy  float64 `json:"topn_accuracy"`
+	ImageAccuracy float64 `json:"image_accuracy"`
+
+	// CharacterErrorRate is the edits from each true plate to the closest
+	// plate read, over all the true plates' characters. A plate not read at
+	// all counts every character.
+	CharacterErrorRate float64 `json:"character_error_rate"`
+	FalsePositives     int     `json:"false_positives"`
+	FalseNegatives     int     `json:"false_negatives"`
+	Latency            Latency `json:"latency"`
+	Throughput         float64 `json:"images_per_second"`
+
+	PerImage []ImageResult `json:"per_image"`
+}
+
+// Score compares the readings against the truth. Images with no reading
+// count as failed.
+func Score(truth Truth, readings map[string]Reading, elapsed time.Duration) *Result {
+	result := &Result{Images: len(truth), Elapsed: elapsed.Seconds()}
+	var images []string
+	for image := range truth {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	var latencies []time.Duration
+	var total time.Duration
+	edits, characters, exactImages := 0, 0, 0
+	for _, image := range images {
+		plates := truth[image]
+		r, ok := readings[image]
+		if !ok {
+			r.Err = errors.New("not read")
+		}
+		scored := ImageResult{Image: image, Truth: plates, Read: r.Plates, LatencyMs: ms(r.Latency)}
+		result.Plates += len(plates)
+		if r.Err != nil {
+			scored.Error = r.Err.Error()
+			result.Failed++
+		} else {
+			latencies = append(latencies, r.Latency)
+			total += r.Latency
+		}
+
+		read := make(map[string]bool)
+		for _, plate := range r.Plates {
+			read[plate] = true
+		}
+		candidates := make(map[string]bool)
+		for _, plate := range r.Candidates {
+			candidates[plate] = true
+		}
+		wanted := make(map[string]bool)
+		for _, plate := range plates {
+			wanted[plate] = true
+			characters += len([]rune(plate))
+			if read[plate] {
+				result.ExactMatches++
+			} else {
+				scored.Missed = append(scored.Missed, plate)
+			}
+			if read[plate] || candidates[plate] {
+				result.TopNMatches++
+			}
+			closest := len([]rune(plate))
+			for _, got := range r.Plates {
+				if d := Distance(plate, got); d < closest {
+					closest = d
+				}
+			}
+			edits += closest
+		}
+		for _, plate := range r.Plates {
+			if !wanted[plate] {
+				scored.Extra = append(scored.Extra, plate)
+			}
+		}
+		result.FalseNegatives += len(scored.Missed)
+		result.FalsePositives += len(scored.Extra)
+		if r.Err == nil && len(scored.Missed) == 0 && len(scored.Extra) == 0 {
+			exactImages++
+		}
+		result.PerImage = append(result.PerImage, scored)
+	}
+
+	result.Accuracy = ratio(result.ExactMatches, result.Plates)
+	result.TopNAccuracy = ratio(result.TopNMatches, result.Plates)
+	result.ImageAccuracy = ratio(exactImages, result.Images)
+	result.CharacterErrorRate = ratio(edits, characters)
+	if n := len(latencies); n > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		result.Latency = Latency{
+			Mean: ms(total / time.Duration(n)),
+			P50:  ms(percentile(latencies, 50)),
+			P90:  ms(percentile(latencies, 90)),
+			P99:  ms(percentile(latencies, 99)),
+			Max:  ms(latencies[n-1]),
+		}
+	}
+	if elapsed > 0 {
+		result.Throughput = float64(result.Images-result.Failed) / elapsed.Seconds()
+	}
+	return result
+}
+
+// percentile returns the nearest rank percentile of the sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func ratio(n int, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Print writes the scores, and the images that weren't read exactly right.
+func (r *Result) Print(w io.Writer) {
+	fmt.Fprintf(w, "Images:      %d with %d plates, %d failed; region %s, topn %d, on %s/%s with %d CPUs\n",
+		r.Images, r.Plates, r.Failed, r.Region, r.TopN, r.Host, r.Arch, r.CPUs)
+	fmt.Fprintf(w, "Accuracy:    %.1f%% of plates read exactly (%d/%d), %.1f%% in the top %d\n",
+		100*r.Accuracy, r.ExactMatches, r.Plates, 100*r.TopNAccuracy, r.TopN)
+	fmt.Fprintf(w, "Per image:   %.1f%% read exactly right\n", 100*r.ImageAccuracy)
+	fmt.Fprintf(w, "CER:         %.1f%%\n", 100*r.CharacterErrorRate)
+	fmt.Fprintf(w, "Errors:      %d false positives, %d false negatives\n", r.FalsePositives, r.FalseNegatives)
+	fmt.Fprintf(w, "Latency:     mean %.0fms, p50 %.0fms, p90 %.0fms, p99 %.0fms, max %.0fms\n",
+		r.Latency.Mean, r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+	fmt.Fprintf(w, "Throughput:  %.2f images/s over %.1fs\n", r.Throughput, r.Elapsed)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	header := false
+	for _, image := range r.PerImage {
+		if len(image.Missed) == 0 && len(image.Extra) == 0 && image.Error == "" {
+			continue
+		}
+		if !header {
+			fmt.Fprintln(tw, "\nIMAGE\tTRUTH\tREAD\tERROR")
+			header = true
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", image.Image, strings.Join(image.Truth, " "), strings.Join(image.Read, " "), image.Error)
+	}
+	tw.Flush()
+}
+
+// timer records the detector's reading of each image.
+type timer struct {
+	detector.Recognizer
+	dir      string
+	mu       sync.Mutex
+	readings map[string]Reading
+}
+
+func (t *timer) RecognizeByFilePath(filePath string) (openalpr.AlprResults, error) {
+	started := time.Now()
+	results, err := t.Recognizer.RecognizeByFilePath(filePath)
+	latency := time.Since(started)
+	image, _ := filepath.Rel(t.dir, filePath)
+	t.mu.Lock()
+	t.readings[image] = reading(results, latency, err)
+	t.mu.Unlock()
+	return results, err
+}
+
+// Main runs a benchmark and returns its exit code.
+func Main(args []string) int {
+	var opts Options
+	if err := settings.Parse("benchmark", &opts, args); err != nil {
+		log.Println(err)
+		return 1
+	}
+	// The detector only takes the config file, its settings being in its
+	// section and the env.
+	var stageArgs []string
+	if opts.ConfigFile != "" {
+		stageArgs = []string{"--config", opts.ConfigFile}
+	}
+	detectorconfig.Init(stageArgs)
+	if err := opts.SetupLogging("benchmark"); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	// Keep off the live services' port, ledger and dead letters. An image
+	// that fails is scored as failed rather than retried.
+	detectorconfig.Opts.HTTPAddr = ""
+	detectorconfig.Opts.LedgerDir = ""
+	detectorconfig.Opts.DeadLetterDir = ""
+	detectorconfig.Opts.MaxRetries = 0
+
+	f, err := os.Open(opts.Truth)
+	if err != nil {
+		logger.Error("Truth", "err", err)
+		return 1
+	}
+	truth, err := ReadTruth(f)
+	f.Close()
+	if err != nil {
+		logger.Error("Truth", "file", opts.Truth, "err", err)
+		return 1
+	}
+	dir, err := filepath.Abs(opts.Args.Dir)
+	if err != nil {
+		logger.Error("Dir", "err", err)
+		return 1
+	}
+	var images []string
+	for image := range truth {
+		if _, err := os.Stat(filepath.Join(dir, image)); err != nil {
+			logger.Error("Image", "err", err)
+			return 1
+		}
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	alpr, err := detector.LoadAlpr()
+	if err != nil {
+		logger.Error("Startup", "err", err)
+		return 1
+	}
+	defer alpr.Unload()
+	t := &timer{Recognizer: alpr, dir: dir, readings: make(map[string]Reading)}
+	d, err := detector.NewWith(t)
+	if err != nil {
+		logger.Error("Startup", "err", err)
+		return 1
+	}
+	d.KeepFrames = true
+
+	// The images go through the detector one at a time, as they would live.
+	// SIGINT stops the run early, scoring the rest as failed.
+	ctx := shutdown.OnSignal(opts.ShutdownTimeout())
+	motion := queue.NewMemory(opts.MotionTube, 1)
+	detections := queue.NewMemory(opts.DetectionTube, len(images))
+	logger.Info("Benchmarking", "images", len(images), "region", detectorconfig.Opts.Region, "top_n", detectorconfig.Opts.TopN)
+	started := time.Now()
+	go func() {
+		defer motion.Close()
+		for _, image := range images {
+			body, _ := json.Marshal(jobs.MotionEvent{CorrelationID: jobs.NewCorrelationID(), Filename: filepath.Join(dir, image)})
+			if ctx.Err() != nil {
+				return
+			}
+			motion.Put(body)
+		}
+	}()
+	if err := d.Run(context.Background(), motion, detections); err != nil {
+		logger.Error("Detector", "err", err)
+		return 1
+	}
+	elapsed := time.Since(started)
+
+	result := Score(truth, t.readings, elapsed)
+	result.Time = started.UTC()
+	result.Host, _ = os.Hostname()
+	result.Arch = runtime.GOARCH
+	result.CPUs = runtime.NumCPU()
+	result.Version = openalpr.GetVersion()
+	result.Region = detectorconfig.Opts.Region
+	result.TopN = detectorconfig.Opts.TopN
+	if opts.JSON {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		if err := out.Encode(result); err != nil {
+			logger.Error("JSON", "err", err)
+			return 1
+		}
+		return 0
+	}
+	result.Print(os.Stdout)
+	return 0
+}
@@ -0,0 +1,102 @@
+package benchmark
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTruth(t *testing.T) {
+	truth, err := ReadTruth(strings.NewReader(`image,plate
+# Two cars at the gate.
+gate/01.jpg,CA98 2063
+gate/01.jpg, ab12-cde
+./gate/02.jpg,
+exit/01.jpg,XY34ZZZ
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Truth{
+		"gate/01.jpg": {"CA982063", "AB12CDE"},
+		"gate/02.jpg": nil,
+		"exit/01.jpg": {"XY34ZZZ"},
+	}
+	if !reflect.DeepEqual(truth, expected) {
+		t.Errorf("Expected %v, got %v", expected, truth)
+	}
+
+	if _, err := ReadTruth(strings.NewReader("gate/01.jpg,CA982063,extra\n")); err == nil {
+		t.Error("Expected an error for a row with too many fields")
+	}
+	if _, err := ReadTruth(strings.NewReader("image,plate\n")); err == nil {
+		t.Error("Expected an error for no images")
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"CA982063", "CA982063", 0},
+		{"CA982063", "CA982O63", 1},
+		{"CA982063", "A982063", 1},
+		{"CA982063", "", 8},
+		{"AB12CDE", "BA12CED", 4},
+	}
+	for _, test := range tests {
+		if d := Distance(test.a, test.b); d != test.expected {
+			t.Errorf("%s to %s: expected %d, got %d", test.a, test.b, test.expected, d)
+		}
+	}
+}
+
+func TestScore(t *testing.T) {
+	truth := Truth{
+		"01.jpg": {"CA982063"},
+		"02.jpg": {"AB12CDE", "XY34ZZZ"},
+		"03.jpg": nil,
+		"04.jpg": {"GH56JKL"},
+		"05.jpg": {"MN78PQR"},
+	}
+	readings := map[string]Reading{
+		"01.jpg": {Plates: []string{"CA982063"}, Latency: 100 * time.Millisecond},
+		// One plate right, the other with an O for a zero but right among
+		// the candidates.
+		"02.jpg": {Plates: []string{"AB12CDE", "XY34ZZ2"}, Candidates: []string{"AB12CDE", "XY34ZZ2", "XY34ZZZ"}, Latency: 300 * time.Millisecond},
+		"03.jpg": {Plates: []string{"LAMPPOST"}, Latency: 200 * time.Millisecond},
+		"04.jpg": {Latency: 400 * time.Millisecond},
+		"05.jpg": {Err: errors.New("ALPR failed")},
+	}
+	r := Score(truth, readings, 2*time.Second)
+
+	if r.Images != 5 || r.Plates != 5 || r.Failed != 1 {
+		t.Errorf("Expected 5 images, 5 plates and 1 failure, got %d, %d and %d", r.Images, r.Plates, r.Failed)
+	}
+	if r.ExactMatches != 2 || r.Accuracy != 0.4 || r.TopNMatches != 3 || r.TopNAccuracy != 0.6 {
+		t.Errorf("Unexpected accuracy %+v", r)
+	}
+	if r.ImageAccuracy != 0.2 {
+		t.Errorf("Expected only 01.jpg exactly right, got %f", r.ImageAccuracy)
+	}
+	// One edit for XY34ZZ2, and every character of GH56JKL and MN78PQR, out
+	// of 36.
+	if r.CharacterErrorRate != 15.0/36 {
+		t.Errorf("Expected a character error rate of 15/36, got %f", r.CharacterErrorRate)
+	}
+	if r.FalsePositives != 2 || r.FalseNegatives != 3 {
+		t.Errorf("Expected 2 false positives and 3 false negatives, got %d and %d", r.FalsePositives, r.FalseNegatives)
+	}
+	if r.Latency != (Latency{Mean: 250, P50: 200, P90: 400, P99: 400, Max: 400}) {
+		t.Errorf("Unexpected latency %+v", r.Latency)
+	}
+	if r.Throughput != 2 {
+		t.Errorf("Expected 2 images a second, got %f", r.Throughput)
+	}
+	if image := r.PerImage[1]; image.Image != "02.jpg" || !reflect.DeepEqual(image.Missed, []string{"XY34ZZZ"}) || !reflect.DeepEqual(image.Extra, []string{"XY34ZZ2"}) {
+		t.Errorf("Unexpected result for 02.jpg: %+v", image)
+	}
+}
@@ -0,0 +1,202 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"logging"
+	"queue"
+)
+
+// permanentError is a failure that retrying won't fix.
+type permanentError struct {
+	error
+}
+
+// Permanent marks err as one that retrying won't fix, such as a payload that
+// can't be decoded or a frame that no longer exists, so the job is buried
+// straight away.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// IsPermanent reports whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// Outcomes of Policy.Fail.
+const (
+	Released = "released"
+	Buried   = "buried"
+)
+
+// Policy decides what happens to a job that failed: transient failures are
+// released to be retried after a growing delay, and jobs that fail for good
+// or run out of retries are buried.
+type Policy struct {
+	MaxRetries int
+	Delay      time.Duration
+	MaxDelay   time.Duration
+}
+
+// RetryDelay is how long to wait before retrying a job that has already been
+// released the given number of times, doubling each time up to MaxDelay.
+func (p Policy) RetryDelay(releases int) time.Duration {
+	delay := p.Delay
+	for i := 0; i < releases && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Fail hands a reserved job that couldn't be processed back to its tube.
+// The retry count is the number of times the tube has seen it released.
+// Buried jobs have their reason recorded in store for the dlq tool, which is
+// skipped when store is nil. It returns Released or Buried. A job whose
+// retry count can't be read is buried, rather than risk retrying it for
+// ever.
+func (p Policy) Fail(tube queue.Tube, id uint64, cause error, store *Store) (string, error) {
+	releases, countErr := tube.Releases(id)
+	if countErr != nil {
+		logging.Error("Retry count", "tube", tube.Name(), "job_id", id, "err", countErr)
+	} else if !IsPermanent(cause) && releases < p.MaxRetries {
+		return Released, tube.Release(id, p.RetryDelay(releases))
+	}
+
+	reason := cause.Error()
+	switch {
+	case IsPermanent(cause):
+	case countErr != nil:
+		reason = fmt.Sprintf("gave up, retry count unknown (%s): %s", countErr, reason)
+	default:
+		reason = fmt.Sprintf("gave up after %d retries: %s", releases, reason)
+	}
+	entry := Entry{Tube: tube.Name(), ID: id, Reason: reason, Releases: releases, BuriedAt: time.Now().UTC()}
+	if err := store.Record(entry); err != nil {
+		logging.Error("Dead letter", "tube", tube.Name(), "job_id", id, "err", err)
+	}
+	return Buried, tube.Bury(id)
+}
+
+// Entry records why a job was buried.
+type Entry struct {
+	Tube     string    `json:"tube"`
+	ID       uint64    `json:"id"`
+	Reason   string    `json:"reason"`
+	Releases int       `json:"releases"`
+	BuriedAt time.Time `json:"buried_at"`
+}
+
+// Store keeps the reasons jobs were buried, as beanstalkd has nowhere to put
+// them. Each entry is a file in a directory per tube, shared by the services
+// and the dlq tool on one Pi.
+//
+// A nil *Store is valid and records nothing.
+type Store struct {
+	dir string
+}
+
+// Open returns a store kept in dir, creating it if need be. An empty dir
+// disables the store and returns nil.
+func Open(dir string) (*Store, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// tubeDir escapes the tube name, which may contain a slash.
+func (s *Store) tubeDir(tube string) string {
+	return filepath.Join(s.dir, url.PathEscape(tube))
+}
+
+func (s *Store) file(tube string, id uint64) string {
+	return filepath.Join(s.tubeDir(tube), strconv.FormatUint(id, 10)+".json")
+}
+
+// Record saves the entry, replacing any for the same job.
+func (s *Store) Record(entry Entry) error {
+	if s == nil {
+		return nil
+	}
+	if err := os.MkdirAll(s.tubeDir(entry.Tube), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.file(entry.Tube, entry.ID), data, 0644)
+}
+
+// Get returns the entry for a job, if there is one.
+func (s *Store) Get(tube string, id uint64) (Entry, bool, error) {
+	var entry Entry
+	if s == nil {
+		return entry, false, nil
+	}
+	data, err := ioutil.ReadFile(s.file(tube, id))
+	if os.IsNotExist(err) {
+		return entry, false, nil
+	} else if err != nil {
+		return entry, false, err
+	}
+	return entry, true, json.Unmarshal(data, &entry)
+}
+
+// Remove forgets the entry for a job once it has been kicked or deleted.
+func (s *Store) Remove(tube string, id uint64) error {
+	if s == nil {
+		return nil
+	}
+	err := os.Remove(s.file(tube, id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns the entries for a tube, oldest job first.
+func (s *Store) List(tube string) ([]Entry, error) {
+	if s == nil {
+		return nil, nil
+	}
+	infos, err := ioutil.ReadDir(s.tubeDir(tube))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, info := range infos {
+		id, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		entry, ok, err := s.Get(tube, id)
+		if err != nil {
+			return entries, err
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
@@ -0,0 +1,162 @@
+package deadletter
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"queue"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := Policy{Delay: 10 * time.Second, MaxDelay: time.Minute}
+	tests := map[int]time.Duration{
+		0:  10 * time.Second,
+		1:  20 * time.Second,
+		2:  40 * time.Second,
+		3:  time.Minute,
+		50: time.Minute,
+	}
+	for releases, expected := range tests {
+		if delay := p.RetryDelay(releases); delay != expected {
+			t.Errorf("Releases %d: expected %s, got %s", releases, expected, delay)
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	err := errors.New("bad payload")
+	if IsPermanent(err) || !IsPermanent(Permanent(err)) {
+		t.Error("Expected only the marked error to be permanent")
+	}
+	if Permanent(err).Error() != "bad payload" {
+		t.Error("Expected the message kept:", Permanent(err))
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []uint64{12, 3} {
+		if err := store.Record(Entry{Tube: "motion/events", ID: id, Reason: "frame missing"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := store.List("motion/events")
+	if err != nil || len(entries) != 2 || entries[0].ID != 3 || entries[1].Reason != "frame missing" {
+		t.Fatalf("Unexpected entries: %+v %v", entries, err)
+	}
+	if entries, _ := store.List("detection_events"); len(entries) != 0 {
+		t.Error("Expected no entries for another tube:", entries)
+	}
+
+	store.Remove("motion/events", 3)
+	if _, ok, _ := store.Get("motion/events", 3); ok {
+		t.Error("Expected entry removed")
+	}
+
+	var none *Store
+	if err := none.Record(Entry{}); err != nil {
+		t.Error("Expected a nil store to record nothing:", err)
+	}
+}
+
+func TestFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := Open(dir)
+	p := Policy{MaxRetries: 1, Delay: 0, MaxDelay: time.Minute}
+	tube := queue.NewMemory("motion_events", 10)
+	tube.Put([]byte("a"))
+
+	tests := []struct {
+		cause   error
+		outcome string
+	}{
+		{errors.New("db down"), Released},
+		{errors.New("db down"), Buried},
+	}
+	for _, test := range tests {
+		id, _, err := tube.Reserve(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outcome, err := p.Fail(tube, id, test.cause, store)
+		if err != nil || outcome != test.outcome {
+			t.Errorf("%v: expected %s, got %s %v", test.cause, test.outcome, outcome, err)
+		}
+	}
+	entries, _ := store.List("motion_events")
+	if len(entries) != 1 || entries[0].Reason != "gave up after 1 retries: db down" {
+		t.Errorf("Expected the reason recorded: %+v", entries)
+	}
+
+	tube.Put([]byte("b"))
+	id, _, _ := tube.Reserve(time.Second)
+	if outcome, _ := p.Fail(tube, id, Permanent(errors.New("bad payload")), store); outcome != Buried {
+		t.Error("Expected a permanent failure buried straight away, got", outcome)
+	}
+	if entry, ok, _ := store.Get("motion_events", id); !ok || entry.Reason != "bad payload" {
+		t.Errorf("Expected the reason recorded: %+v", entry)
+	}
+}
+
+// uncountedTube can't say how often a job was released.
+type uncountedTube struct {
+	*queue.Memory
+}
+
+func (uncountedTube) Releases(id uint64) (int, error) {
+	return 0, errors.New("stats-job: connection reset")
+}
+
+func TestFailUncounted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, _ := Open(dir)
+	tube := uncountedTube{queue.NewMemory("motion_events", 10)}
+	tube.Put([]byte("a"))
+	id, _, _ := tube.Reserve(time.Second)
+
+	// Without the count it might be retried for ever, so it is buried.
+	p := Policy{MaxRetries: 5, MaxDelay: time.Minute}
+	if outcome, err := p.Fail(tube, id, errors.New("db down"), store); err != nil || outcome != Buried {
+		t.Errorf("Expected the job buried, got %s %v", outcome, err)
+	}
+	if entry, ok, _ := store.Get("motion_events", id); !ok || entry.Reason != "gave up, retry count unknown (stats-job: connection reset): db down" {
+		t.Errorf("Expected the reason recorded: %+v", entry)
+	}
+}
+
+func TestFailCountsEveryRelease(t *testing.T) {
+	tube := queue.NewMemory("motion_events", 10)
+	tube.Put([]byte("a"))
+	id, _, _ := tube.Reserve(time.Second)
+
+	// Retries are counted from the tube's releases, whatever released the
+	// job, such as a failure to queue its result.
+	p := Policy{MaxRetries: 1, MaxDelay: time.Minute}
+	if outcome, _ := p.Fail(tube, id, errors.New("queue detection: connection refused"), nil); outcome != Released {
+		t.Fatal("Expected the first failure released, got", outcome)
+	}
+	id, _, _ = tube.Reserve(time.Second)
+	if outcome, _ := p.Fail(tube, id, errors.New("queue detection: connection refused"), nil); outcome != Buried {
+		t.Error("Expected the job buried once its retries are used up, got", outcome)
+	}
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"errors"
+	"log"
+	"os"
+	"settings"
+	"sync"
+)
+
+// Options describes all the CLI flags that can be passed. Those tagged
+// reload:"true" are re-read from the config file on SIGHUP.
+type Options struct {
+	settings.Common
+
+	Region         string `long:"region" env:"DETECTOR_REGION" default:"eu" short:"a"`
+	LedgerDir      string `long:"ledger-dir" env:"DETECTOR_LEDGER_DIR" short:"l" description:"Shared dir recording files with pending jobs"`
+	AlprConfig     string `long:"alpr-config" env:"DETECTOR_ALPR_CONFIG" description:"openalpr.conf, empty for the default"`
+	AlprRuntimeDir string `long:"alpr-runtime-dir" env:"DETECTOR_ALPR_RUNTIME_DIR" default:"/usr/local/share/openalpr/runtime_data/"`
+	TopN           int    `long:"topn" env:"DETECTOR_TOPN" default:"3" reload:"true"`
+	BackoffMaxSecs int    `long:"backoff-max" env:"DETECTOR_BACKOFF_MAX" default:"15"`
+	HTTPAddr       string `long:"http-addr" env:"DETECTOR_HTTP_ADDR" default:":9102" description:"Serves /metrics, /healthz and /readyz, empty to disable"`
+}
+
+// Validate checks the options make sense together.
+func (o *Options) Validate() error {
+	switch {
+	case o.Region == "":
+		return errors.New("region must be set")
+	case o.TopN <= 0:
+		return errors.New("topn must be positive")
+	case o.BackoffMaxSecs <= 0:
+		return errors.New("backoff-max must be positive")
+	}
+	return o.Common.Validate()
+}
+
+// Opts is the application config struct that we allow external access too.
+// Reloadable settings must be read through Snapshot.
+var Opts Options
+
+var (
+	mu   sync.RWMutex
+	args []string
+)
+
+// Init parses the options from the config file, env vars and args.
+func Init(cliArgs []string) {
+	args = cliArgs
+	err := settings.Parse("detector", &Opts, args)
+	if err != nil {
+		log.Println(err)
+		log.Println("Missing ENV vars containing configuration, try `. lpr.env`")
+		os.Exit(1)
+	}
+	Opts.SetupLogging("detector")
+}
+
+// Reload re-reads the configuration and applies the reloadable settings,
+// returning the names of those that changed.
+func Reload() ([]string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	changed, err := settings.Reload("detector", &Opts, args)
+	if err != nil {
+		return nil, err
+	}
+	Opts.ReloadLogging()
+	return changed, nil
+}
+
+// Snapshot returns a copy of the options that is safe to read during a reload.
+func Snapshot() Options {
+	mu.RLock()
+	defer mu.RUnlock()
+	return Opts
+}
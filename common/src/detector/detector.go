@@ -0,0 +1,312 @@
+package detector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"deadletter"
+	"detector/config"
+	"health"
+	"jobs"
+	"ledger"
+	"logging"
+	"metrics"
+	"queue"
+	"settings"
+	"shutdown"
+
+	"github.com/openalpr/openalpr"
+)
+
+var logger = logging.With("service", "detector")
+
+// Recognizer finds the plates in a frame. OpenALPR is the real one.
+type Recognizer interface {
+	RecognizeByFilePath(filePath string) (openalpr.AlprResults, error)
+	SetTopN(topN int)
+}
+
+// Detector runs ALPR over the frame in each motion event, and puts a
+// detection event on a tube for frames with plates in them.
+type Detector struct {
+	alpr        *openalpr.Alpr
+	recognizer  Recognizer
+	topN        int
+	pending     *ledger.Ledger
+	deadLetters *deadletter.Store
+	status      *health.Registry
+	host        string
+
+	// KeepFrames stops frames without plates being deleted, for replays.
+	KeepFrames bool
+}
+
+// New loads ALPR and sets up the detector from config.Opts, which config.Init
+// must have filled in. Close unloads ALPR.
+func New() (*Detector, error) {
+	logger.Info("Plate detector startup")
+
+	alpr, err := LoadAlpr()
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewWith(alpr)
+	if err != nil {
+		alpr.Unload()
+		return nil, err
+	}
+	d.alpr = alpr
+	d.status.Check("alpr", func(ctx context.Context) error {
+		if !alpr.IsLoaded() {
+			return errors.New("OpenAlpr not loaded")
+		}
+		return nil
+	})
+	return d, nil
+}
+
+// LoadAlpr loads OpenALPR for the configured region. The caller unloads it.
+func LoadAlpr() (*openalpr.Alpr, error) {
+	alpr := openalpr.NewAlpr(config.Opts.Region, config.Opts.AlprConfig, config.Opts.AlprRuntimeDir)
+	if !alpr.IsLoaded() {
+		alpr.Unload()
+		return nil, errors.New("OpenAlpr failed to load")
+	}
+	logger.Info("ALPR loaded", "region", config.Opts.Region, "top_n", config.Opts.TopN, "version", openalpr.GetVersion())
+	return alpr, nil
+}
+
+// NewWith sets up the detector from config.Opts to find plates with the
+// given recognizer.
+func NewWith(recognizer Recognizer) (*Detector, error) {
+	topN := config.Opts.TopN
+	recognizer.SetTopN(topN)
+
+	// Files pinned by the watcher are released here when no plate is found,
+	// otherwise the uploader releases them.
+	pending, err := ledger.Open(config.Opts.LedgerDir)
+	if err != nil {
+		return nil, fmt.Errorf("ledger: %s", err)
+	}
+
+	// Jobs that keep failing are buried, with the reason kept for dlq.
+	deadLetters, err := deadletter.Open(config.Opts.DeadLetterDir)
+	if err != nil {
+		return nil, fmt.Errorf("dead letter: %s", err)
+	}
+
+	// The loop comes round at least every reserve timeout, unless a single
+	// recognition outlasts the job's time-to-run.
+	status := health.New(config.Opts.ReserveTimeout() + 2*config.Opts.JobTTR())
+	status.Expect("queue")
+
+	// Events say which Pi read them.
+	host, _ := os.Hostname()
+
+	return &Detector{recognizer: recognizer, topN: topN, pending: pending, deadLetters: deadLetters, status: status, host: host}, nil
+}
+
+// Status is the detector's health.
+func (d *Detector) Status() *health.Registry {
+	return d.status
+}
+
+// Close unloads ALPR, if New loaded it.
+func (d *Detector) Close() {
+	if d.alpr != nil {
+		d.alpr.Unload()
+	}
+}
+
+// Run reserves motion events from in and puts detection events on out until
+// ctx is cancelled, finishing the frame in hand, or in is closed and drained.
+func (d *Detector) Run(ctx context.Context, in queue.Tube, out queue.Tube) error {
+	// TopN can be changed without a restart, and is applied between jobs.
+	settings.OnSighup(func() {
+		changed, err := config.Reload()
+		if err != nil {
+			logger.Error("Reload", "err", err)
+			return
+		}
+		logger.Info("Reloaded configuration", "changed", changed)
+	})
+
+	// Metrics and health are served over HTTP for Prometheus and monitoring.
+	server := &http.Server{Addr: config.Opts.HTTPAddr}
+	if server.Addr != "" {
+		mux := http.NewServeMux()
+		d.status.Handle(mux)
+		mux.Handle("/metrics", metrics.Handler(append(metrics.Detector(), metrics.Tubes(in, out)...)...))
+		server.Handler = mux
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Error("HTTP", "err", err)
+			}
+		}()
+	}
+	defer server.Close()
+
+	reserveTimeout := config.Opts.ReserveTimeout()
+	backoff := config.Opts.Backoff(time.Duration(config.Opts.BackoffMaxSecs) * time.Second)
+	logger.Info("Reserving", "motion_tube", in.Name(), "detection_tube", out.Name(), "reserve_timeout", reserveTimeout)
+
+	// Once shutdown starts no more jobs are reserved, which takes at most the
+	// reserve timeout to notice.
+	for ctx.Err() == nil {
+		id, body, err := in.Reserve(reserveTimeout)
+		d.status.Beat()
+		switch {
+		case err == queue.ErrClosed:
+			logger.Info("Plate detector stopped", "reason", "input closed")
+			return nil
+		case err != nil && err != queue.ErrTimeout:
+			// The tube reconnects on the next reserve.
+			backoffTime := backoff.Duration()
+			logger.Error("Reserve", "sleeping", backoffTime, "err", err)
+			d.status.Set("queue", err)
+			shutdown.Sleep(ctx, backoffTime)
+			continue
+		}
+		backoff.Reset()
+		d.status.Set("queue", nil)
+		d.status.NotifyReady()
+		if err == nil {
+			d.process(in, out, id, body)
+		}
+	}
+	logger.Info("Plate detector stopped")
+	return nil
+}
+
+// process recognises the plates in one motion event's frame.
+func (d *Detector) process(in queue.Tube, out queue.Tube, id uint64, body []byte) {
+	jobLog := logger.With("job_id", id)
+	fail := func(cause error) {
+		outcome, err := config.Opts.RetryPolicy().Fail(in, id, cause, d.deadLetters)
+		if err != nil {
+			jobLog.Error("Queue", "err", err)
+			return
+		}
+		jobLog.Error("Job failed", "outcome", outcome, "err", cause)
+		metrics.JobFailures.WithLabelValues(in.Name(), outcome).Inc()
+	}
+
+	motionEvent, err := jobs.DecodeMotionEvent(body)
+	if err != nil {
+		metrics.DetectorErrors.WithLabelValues("payload").Inc()
+		fail(deadletter.Permanent(fmt.Errorf("payload: %s", err)))
+		return
+	}
+	filename := motionEvent.Filename
+	jobLog = jobLog.With("correlation_id", motionEvent.CorrelationID, "file", filename, "camera", motionEvent.Camera)
+
+	// A frame that's gone won't come back, so there's no point retrying.
+	if _, err := os.Stat(filename); err != nil {
+		metrics.DetectorErrors.WithLabelValues("frame").Inc()
+		fail(deadletter.Permanent(err))
+		return
+	}
+
+	jobLog.Info("Recognising frame")
+	if n := config.Snapshot().TopN; n != d.topN {
+		logger.Info("ALPR TopN", "top_n", n)
+		d.topN = n
+		d.recognizer.SetTopN(n)
+	}
+	started := time.Now()
+	detectionResult, err := d.recognizer.RecognizeByFilePath(filename)
+	if err != nil {
+		// The frame is kept and the job retried, as a failure here says
+		// nothing about whether it has a plate in it.
+		metrics.DetectorErrors.WithLabelValues("alpr").Inc()
+		fail(fmt.Errorf("ALPR: %s", err))
+		return
+	}
+	metrics.ObserveDetection(detectionResult, time.Since(started))
+
+	if len(detectionResult.Plates) > 0 {
+		jobLog.Info("Plates found", "plates", len(detectionResult.Plates),
+			"best_plate", detectionResult.Plates[0].BestPlate, "elapsed", time.Since(started))
+		// Without the camera the uploader derives the ids from its own.
+		var eventIDs []string
+		if motionEvent.Camera != "" {
+			for _, plate := range detectionResult.Plates {
+				eventIDs = append(eventIDs, jobs.EventID(motionEvent.Camera, filename, plate.BestPlate))
+			}
+		}
+		detectionEvent, err := json.Marshal(jobs.DetectionEvent{
+			CorrelationID: motionEvent.CorrelationID,
+			Filename:      filename,
+			Camera:        motionEvent.Camera,
+			Site:          motionEvent.Site,
+			Host:          d.host,
+			AlprResults:   detectionResult,
+			EventIDs:      eventIDs,
+		})
+		if err != nil {
+			fail(deadletter.Permanent(fmt.Errorf("marshal detection event: %s", err)))
+			return
+		}
+		jobLog.Debug("Detection event", "event", string(detectionEvent))
+
+		detectionEventId, err := out.Put(detectionEvent)
+		if err != nil {
+			metrics.DetectorErrors.WithLabelValues("queue").Inc()
+			d.status.Set("queue", err)
+			// Retried like any other failure, backing off while the queue
+			// is down. The retries are counted from the job's releases, so
+			// a long enough outage buries the job, to be kicked with dlq.
+			fail(fmt.Errorf("queue detection: %s", err))
+			return
+		}
+		jobLog.Info("Queued detection", "tube", out.Name(), "detection_job_id", detectionEventId)
+	} else if d.KeepFrames {
+		jobLog.Info("No plate found", "elapsed", time.Since(started))
+	} else {
+		jobLog.Info("No plate found, deleting file", "elapsed", time.Since(started))
+		err := os.Remove(filename)
+		if err != nil {
+			jobLog.Error("Unable to delete the file", "err", err)
+		}
+		d.pending.Done(filename)
+	}
+
+	if err := in.Delete(id); err != nil {
+		// Maybe the queue connection went away, a reconnect will be
+		// attempted on the next reserve.
+		jobLog.Error("Delete job", "err", err)
+	}
+}
+
+// Main runs the detector as a process of its own, taking motion events from
+// beanstalkd and putting detection events back, and returns its exit code.
+func Main(args []string) int {
+	config.Init(args)
+
+	// SIGTERM stops new jobs being reserved, the one in hand is finished.
+	ctx := shutdown.OnSignal(config.Opts.ShutdownTimeout())
+
+	d, err := New()
+	if err != nil {
+		logger.Error("Startup", "err", err)
+		return 1
+	}
+	defer d.Close()
+	d.Status().Watchdog()
+	d.Status().NotifyStopping(ctx)
+
+	in := queue.NewBeanstalk(config.Opts.BeanstalkAddr, config.Opts.MotionTube, config.Opts.JobPriority, config.Opts.JobTTR())
+	out := queue.NewBeanstalk(config.Opts.BeanstalkAddr, config.Opts.DetectionTube, config.Opts.JobPriority, config.Opts.JobTTR())
+	defer in.Close()
+	defer out.Close()
+	if err := d.Run(ctx, in, out); err != nil {
+		logger.Error("Stopped", "err", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,647 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Event is a plate seen by a camera, as recorded in the events table.
+type Event struct {
+	ID int64 `json:"id"`
+	// UID is the id the pipeline gave the event, which stays the same
+	// however many times it is sent. Older events have none.
+	UID        string    `json:"uid,omitempty"`
+	Time       time.Time `json:"time"`
+	Camera     string    `json:"camera"`
+	Site       string    `json:"site"`
+	Plate      string    `json:"plate"`
+	Confidence float32   `json:"confidence"`
+	PlateImage string    `json:"plate_image"`
+	FrameImage string    `json:"frame_image"`
+	// Corrected is set once someone has fixed a misread plate.
+	Corrected bool `json:"corrected"`
+	// PlateSealed is the plate encrypted, for a plate recorded as its
+	// pseudonym. It is only given out opened, to those allowed.
+	PlateSealed string `json:"-"`
+	// Evidence is nil for events recorded before it was kept.
+	Evidence *Evidence `json:"evidence,omitempty"`
+}
+
+// Evidence is what OpenALPR gave for a read, kept for review and analysis.
+type Evidence struct {
+	// Candidates are the plates OpenALPR considered, most likely first.
+	Candidates []Candidate `json:"candidates"`
+	// Coordinates are the corners of the plate in the frame.
+	Coordinates      []Point `json:"coordinates"`
+	Region           string  `json:"region"`
+	RegionConfidence int     `json:"region_confidence"`
+	// MatchesTemplate is set when the plate matched the region's pattern.
+	MatchesTemplate bool    `json:"matches_template"`
+	ProcessingMs    float32 `json:"processing_ms"`
+	ImageWidth      int     `json:"image_width"`
+	ImageHeight     int     `json:"image_height"`
+	// Host is the Pi whose detector read the plate, and CorrelationID and
+	// JobID identify the frame and detection job in its logs.
+	Host          string `json:"host"`
+	CorrelationID string `json:"correlation_id"`
+	JobID         int64  `json:"job_id"`
+}
+
+// Candidate is a plate OpenALPR considered.
+type Candidate struct {
+	Plate           string  `json:"plate"`
+	Confidence      float32 `json:"confidence"`
+	MatchesTemplate bool    `json:"matches_template"`
+}
+
+// Point is a pixel in the frame.
+type Point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// Correction is a fix to an event's plate, kept as an audit trail.
+type Correction struct {
+	ID       int64     `json:"id"`
+	EventID  int64     `json:"event_id"`
+	Time     time.Time `json:"time"`
+	OldPlate string    `json:"old_plate"`
+	NewPlate string    `json:"new_plate"`
+	Editor   string    `json:"editor"`
+	Reason   string    `json:"reason"`
+}
+
+// PlateHour is how many times a camera saw a plate in an hour.
+type PlateHour struct {
+	Camera string
+	Site   string
+	Plate  string
+	Hour   time.Time
+	Events int
+}
+
+// PlateSite is when a plate has been seen at a site.
+type PlateSite struct {
+	Site      string    `json:"site"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Events    int       `json:"events"`
+}
+
+// Camera is a camera's recent activity.
+type Camera struct {
+	Camera   string    `json:"camera"`
+	Site     string    `json:"site"`
+	LastSeen time.Time `json:"last_seen"`
+	Events   int       `json:"events_24h"`
+}
+
+// How Query.Plate is matched against the recorded plates.
+const (
+	Exact    = "exact"
+	Prefix   = "prefix"
+	Wildcard = "wildcard"
+	Fuzzy    = "fuzzy"
+)
+
+// MaxDistance is the furthest a fuzzy match may be from the plate searched
+// for, beyond which nearly everything matches a short plate.
+const MaxDistance = 3
+
+// Query selects events, newest first. Empty fields match everything.
+type Query struct {
+	// Plate is matched as Match says. A wildcard plate uses * for any run of
+	// characters and ? for one, and a fuzzy one matches plates at most
+	// Distance edits away.
+	Plate    string
+	Match    string
+	Distance int
+	Camera   string
+	Site     string
+	// From is inclusive and To exclusive.
+	From time.Time
+	To   time.Time
+	// Limit is the page size, and After the cursor returned with the page
+	// before.
+	Limit int
+	After string
+	// Pseudonyms are matched as well by an exact match, being the plate as
+	// sites that hash plates record it.
+	Pseudonyms []string
+}
+
+// Page is a page of events, with the cursor for the next if there is one.
+type Page struct {
+	Events []Event `json:"events"`
+	Next   string  `json:"next,omitempty"`
+}
+
+// ErrNotFound is returned for an event that doesn't exist.
+var ErrNotFound = errors.New("event not found")
+
+// ErrTooMany is returned when more events match than may be read at once.
+var ErrTooMany = errors.New("too many events, narrow the search")
+
+// ErrUnchanged is returned for a correction to the plate already recorded.
+var ErrUnchanged = errors.New("plate is unchanged")
+
+// MaxPlate is the longest plate a correction may set.
+const MaxPlate = 12
+
+// columns are read by scan, in order.
+const columns = "id, time, camera, site, plate, confidence, plate_image, frame_image, " +
+	"EXISTS (SELECT 1 FROM event_corrections c WHERE c.event_id = events.id), " +
+	"candidates, coordinates, region, region_confidence, matches_template, processing_ms, " +
+	"image_width, image_height, host, correlation_id, job_id, uid, plate_sealed"
+
+// NormalizePlate puts a plate as typed into the form ALPR records, upper case
+// without spaces or dashes.
+func NormalizePlate(plate string) string {
+	plate = strings.ToUpper(plate)
+	return strings.NewReplacer(" ", "", "-", "").Replace(plate)
+}
+
+// ValidPlate checks a normalised plate could be on a car.
+func ValidPlate(plate string) error {
+	if plate == "" || len(plate) > MaxPlate {
+		return fmt.Errorf("plate must be 1 to %d characters", MaxPlate)
+	}
+	for _, c := range plate {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return errors.New("plate must be letters and digits")
+		}
+	}
+	return nil
+}
+
+// Validate checks the query can be run, normalising its plate.
+func (q *Query) Validate() error {
+	q.Plate = NormalizePlate(q.Plate)
+	if q.Match == "" {
+		q.Match = Exact
+	}
+	switch q.Match {
+	case Exact:
+	case Prefix, Wildcard, Fuzzy:
+		if q.Plate == "" {
+			return fmt.Errorf("a %s match needs a plate", q.Match)
+		}
+	default:
+		return errors.New("match must be exact, prefix, wildcard or fuzzy")
+	}
+	if q.Distance < 0 || q.Distance > MaxDistance {
+		return fmt.Errorf("distance must be between 0 and %d", MaxDistance)
+	}
+	if q.Match == Fuzzy && q.Distance == 0 {
+		q.Distance = 1
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return errors.New("from must be before to")
+	}
+	if q.Limit <= 0 {
+		return errors.New("limit must be positive")
+	}
+	if q.After != "" {
+		if _, _, err := decodeCursor(q.After); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeCursor makes the cursor for the page after the event.
+func encodeCursor(event Event) string {
+	key := event.Time.UTC().Format(time.RFC3339Nano) + "," + strconv.FormatInt(event.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeCursor(cursor string) (time.Time, int64, error) {
+	invalid := errors.New("invalid cursor")
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, invalid
+	}
+	parts := strings.SplitN(string(key), ",", 2)
+	if len(parts) != 2 {
+		return time.Time{}, 0, invalid
+	}
+	at, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, 0, invalid
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, invalid
+	}
+	return at, id, nil
+}
+
+// likePattern escapes the LIKE metacharacters in a plate.
+func likePattern(plate string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(plate)
+}
+
+// searchSQL builds the statement for a validated query. It fetches one more
+// row than the limit, to tell whether there is a next page.
+func searchSQL(q Query) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if q.Plate != "" {
+		switch q.Match {
+		case Exact:
+			if len(q.Pseudonyms) > 0 {
+				conds = append(conds, "plate = ANY("+arg(pq.Array(append([]string{q.Plate}, q.Pseudonyms...)))+")")
+				break
+			}
+			conds = append(conds, "plate = "+arg(q.Plate))
+		case Prefix:
+			conds = append(conds, "plate LIKE "+arg(likePattern(q.Plate)+"%"))
+		case Wildcard:
+			pattern := strings.NewReplacer("*", "%", "?", "_").Replace(likePattern(q.Plate))
+			conds = append(conds, "plate LIKE "+arg(pattern))
+		case Fuzzy:
+			conds = append(conds, "levenshtein(plate, "+arg(q.Plate)+") <= "+arg(q.Distance))
+		}
+	}
+	if q.Camera != "" {
+		conds = append(conds, "camera = "+arg(q.Camera))
+	}
+	if q.Site != "" {
+		conds = append(conds, "site = "+arg(q.Site))
+	}
+	if !q.From.IsZero() {
+		conds = append(conds, "time >= "+arg(q.From))
+	}
+	if !q.To.IsZero() {
+		conds = append(conds, "time < "+arg(q.To))
+	}
+	if q.After != "" {
+		at, id, _ := decodeCursor(q.After)
+		conds = append(conds, "(time, id) < ("+arg(at)+", "+arg(id)+")")
+	}
+
+	query := "SELECT " + columns + " FROM events"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY time DESC, id DESC LIMIT " + arg(q.Limit+1)
+	return query, args
+}
+
+// Postgres reads the events table and records corrections to it.
+type Postgres struct {
+	DB *sql.DB
+}
+
+// Open connects to the database holding the events table and checks it can.
+func Open(connectStr string) (*Postgres, error) {
+	db, err := sql.Open("postgres", connectStr)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Postgres{DB: db}, nil
+}
+
+// Search returns a page of the events matching a validated query.
+func (p *Postgres) Search(ctx context.Context, q Query) (Page, error) {
+	query, args := searchSQL(q)
+	rows, err := p.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return Page{}, err
+	}
+	defer rows.Close()
+	page := Page{Events: []Event{}}
+	for rows.Next() {
+		event, err := scan(rows)
+		if err != nil {
+			return Page{}, err
+		}
+		page.Events = append(page.Events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return Page{}, err
+	}
+	if len(page.Events) > q.Limit {
+		page.Events = page.Events[:q.Limit]
+		page.Next = encodeCursor(page.Events[q.Limit-1])
+	}
+	return page, nil
+}
+
+// Get returns the event with the id, or ErrNotFound.
+func (p *Postgres) Get(ctx context.Context, id int64) (Event, error) {
+	row := p.DB.QueryRowContext(ctx, "SELECT "+columns+" FROM events WHERE id = $1", id)
+	event, err := scan(row)
+	if err == sql.ErrNoRows {
+		return Event{}, ErrNotFound
+	}
+	return event, err
+}
+
+// Since returns up to limit events recorded after the one with afterID, in
+// the order they were recorded. Ids are drawn in commit order (schema
+// version 5), so no event committed later can have a lower id.
+func (p *Postgres) Since(ctx context.Context, afterID int64, limit int) ([]Event, error) {
+	rows, err := p.DB.QueryContext(ctx, "SELECT "+columns+" FROM events WHERE id > $1 ORDER BY id LIMIT $2", afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []Event
+	for rows.Next() {
+		event, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, event)
+	}
+	return found, rows.Err()
+}
+
+// Sightings returns the events within [from, to), optionally of one plate or
+// at one site, sorted by plate, site and time for working out visits. It
+// returns ErrTooMany rather than more than limit events.
+func (p *Postgres) Sightings(ctx context.Context, plate, site string, from, to time.Time, limit int) ([]Event, error) {
+	query, args := sightingsSQL(plate, site, from, to, limit)
+	rows, err := p.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []Event
+	for rows.Next() {
+		event, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(found) > limit {
+		return nil, ErrTooMany
+	}
+	return found, nil
+}
+
+func sightingsSQL(plate, site string, from, to time.Time, limit int) (string, []interface{}) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	query := "SELECT " + columns + " FROM events WHERE time >= " + arg(from) + " AND time < " + arg(to)
+	if plate != "" {
+		query += " AND plate = " + arg(plate)
+	}
+	if site != "" {
+		query += " AND site = " + arg(site)
+	}
+	query += " ORDER BY plate, site, time, id LIMIT " + arg(limit+1)
+	return query, args
+}
+
+// PlateHistory returns when the plate was first and last seen at each site,
+// over every event recorded.
+func (p *Postgres) PlateHistory(ctx context.Context, plate string) ([]PlateSite, error) {
+	rows, err := p.DB.QueryContext(ctx, "SELECT site, min(time), max(time), count(*) FROM events "+
+		"WHERE plate = $1 GROUP BY site ORDER BY site", plate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sites := []PlateSite{}
+	for rows.Next() {
+		var s PlateSite
+		if err := rows.Scan(&s.Site, &s.FirstSeen, &s.LastSeen, &s.Events); err != nil {
+			return nil, err
+		}
+		sites = append(sites, s)
+	}
+	return sites, rows.Err()
+}
+
+// PlateHours returns how many times each camera saw each plate in each hour
+// within [from, to), with the hours as they start in loc.
+func (p *Postgres) PlateHours(ctx context.Context, from, to time.Time, loc *time.Location) ([]PlateHour, error) {
+	rows, err := p.DB.QueryContext(ctx, "SELECT camera, site, plate, date_trunc('hour', time AT TIME ZONE $3), count(*) "+
+		"FROM events WHERE time >= $1 AND time < $2 GROUP BY 1, 2, 3, 4", from, to, loc.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hours []PlateHour
+	for rows.Next() {
+		var h PlateHour
+		var wall time.Time
+		if err := rows.Scan(&h.Camera, &h.Site, &h.Plate, &wall, &h.Events); err != nil {
+			return nil, err
+		}
+		// The hour comes back as a wall clock time without a zone.
+		h.Hour = time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), 0, 0, 0, loc)
+		hours = append(hours, h)
+	}
+	return hours, rows.Err()
+}
+
+// Cameras returns every camera that has recorded an event, with the events
+// in the last day.
+func (p *Postgres) Cameras(ctx context.Context) ([]Camera, error) {
+	rows, err := p.DB.QueryContext(ctx, "SELECT camera, site, max(time), "+
+		"count(*) FILTER (WHERE time > now() - interval '24 hours') "+
+		"FROM events GROUP BY camera, site ORDER BY site, camera")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cameras := []Camera{}
+	for rows.Next() {
+		var c Camera
+		if err := rows.Scan(&c.Camera, &c.Site, &c.LastSeen, &c.Events); err != nil {
+			return nil, err
+		}
+		cameras = append(cameras, c)
+	}
+	return cameras, rows.Err()
+}
+
+// Correct sets the event's plate and records the change, returning the
+// corrected event, or ErrNotFound or ErrUnchanged.
+func (p *Postgres) Correct(ctx context.Context, c Correction) (Event, error) {
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Event{}, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, "SELECT plate FROM events WHERE id = $1 FOR UPDATE", c.EventID).Scan(&c.OldPlate)
+	if err == sql.ErrNoRows {
+		return Event{}, ErrNotFound
+	}
+	if err != nil {
+		return Event{}, err
+	}
+	if c.OldPlate == c.NewPlate {
+		return Event{}, ErrUnchanged
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE events SET plate = $1 WHERE id = $2", c.NewPlate, c.EventID); err != nil {
+		return Event{}, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO event_corrections (event_id, time, old_plate, new_plate, editor, reason) "+
+		"VALUES ($1, now(), $2, $3, $4, $5)", c.EventID, c.OldPlate, c.NewPlate, c.Editor, c.Reason)
+	if err != nil {
+		return Event{}, err
+	}
+	event, err := scan(tx.QueryRowContext(ctx, "SELECT "+columns+" FROM events WHERE id = $1", c.EventID))
+	if err != nil {
+		return Event{}, err
+	}
+	return event, tx.Commit()
+}
+
+// Corrections returns the event's corrections, oldest first.
+func (p *Postgres) Corrections(ctx context.Context, eventID int64) ([]Correction, error) {
+	rows, err := p.DB.QueryContext(ctx, "SELECT id, event_id, time, old_plate, new_plate, editor, reason "+
+		"FROM event_corrections WHERE event_id = $1 ORDER BY time, id", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	corrections := []Correction{}
+	for rows.Next() {
+		var c Correction
+		if err := rows.Scan(&c.ID, &c.EventID, &c.Time, &c.OldPlate, &c.NewPlate, &c.Editor, &c.Reason); err != nil {
+			return nil, err
+		}
+		corrections = append(corrections, c)
+	}
+	return corrections, rows.Err()
+}
+
+// Ping checks the database is reachable.
+func (p *Postgres) Ping(ctx context.Context) error {
+	return p.DB.PingContext(ctx)
+}
+
+// Close closes the connection pool.
+func (p *Postgres) Close() error {
+	return p.DB.Close()
+}
+
+func scan(row interface {
+	Scan(dest ...interface{}) error
+}) (Event, error) {
+	var event Event
+	var plateImage, frameImage, region, host, correlationID, uid, plateSealed sql.NullString
+	var confidence, processingMs sql.NullFloat64
+	var regionConfidence, width, height, jobID sql.NullInt64
+	var matchesTemplate sql.NullBool
+	var candidates, coordinates []byte
+	err := row.Scan(&event.ID, &event.Time, &event.Camera, &event.Site, &event.Plate, &confidence, &plateImage, &frameImage, &event.Corrected,
+		&candidates, &coordinates, &region, &regionConfidence, &matchesTemplate, &processingMs,
+		&width, &height, &host, &correlationID, &jobID, &uid, &plateSealed)
+	if err != nil {
+		return event, err
+	}
+	event.Confidence = float32(confidence.Float64)
+	event.PlateImage, event.FrameImage = plateImage.String, frameImage.String
+	event.UID, event.PlateSealed = uid.String, plateSealed.String
+	// Every event the uploader has sent since the evidence was kept has a
+	// correlation id.
+	if !correlationID.Valid {
+		return event, nil
+	}
+	e := &Evidence{
+		Region:           region.String,
+		RegionConfidence: int(regionConfidence.Int64),
+		MatchesTemplate:  matchesTemplate.Bool,
+		ProcessingMs:     float32(processingMs.Float64),
+		ImageWidth:       int(width.Int64),
+		ImageHeight:      int(height.Int64),
+		Host:             host.String,
+		CorrelationID:    correlationID.String,
+		JobID:            jobID.Int64,
+	}
+	if candidates != nil {
+		if err := json.Unmarshal(candidates, &e.Candidates); err != nil {
+			return event, fmt.Errorf("event %d candidates: %s", event.ID, err)
+		}
+	}
+	if coordinates != nil {
+		if err := json.Unmarshal(coordinates, &e.Coordinates); err != nil {
+			return event, fmt.Errorf("event %d coordinates: %s", event.ID, err)
+		}
+	}
+	event.Evidence = e
+	return event, nil
+}
+
+// Channel is the Postgres notification channel the events table's trigger
+// notifies with the id of each event inserted.
+const Channel = "lpr_events"
+
+// Listener hears of events as they are inserted.
+type Listener struct {
+	listener *pq.Listener
+}
+
+// Listen connects to the database and listens on Channel, reconnecting
+// whenever the connection is lost. problem is told of connection errors.
+func Listen(connectStr string, problem func(error)) (*Listener, error) {
+	listener := pq.NewListener(connectStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			problem(err)
+		}
+	})
+	if err := listener.Listen(Channel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &Listener{listener: listener}, nil
+}
+
+// Next waits for the next event inserted and returns its id. It returns 0
+// after reconnecting, as events inserted while disconnected were missed.
+func (l *Listener) Next(ctx context.Context) (int64, error) {
+	for {
+		select {
+		case n := <-l.listener.Notify:
+			if n == nil {
+				return 0, nil
+			}
+			id, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("notification %q: %s", n.Extra, err)
+			}
+			return id, nil
+		case <-time.After(90 * time.Second):
+			// Find out about a dead connection while things are quiet.
+			go l.listener.Ping()
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// Close stops listening and disconnects.
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
@@ -0,0 +1,148 @@
+package events
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/openalpr/openalpr"
+)
+
+func TestSearchSQL(t *testing.T) {
+	from := time.Date(2016, 9, 20, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	cursor := encodeCursor(Event{ID: 42, Time: from.Add(time.Hour)})
+	tests := []struct {
+		query Query
+		where string
+		args  []interface{}
+	}{
+		{
+			Query{Limit: 50},
+			"",
+			[]interface{}{51},
+		},
+		{
+			Query{Plate: "ca98 2063", Camera: "gate", Site: "depot", Limit: 10},
+			" WHERE plate = $1 AND camera = $2 AND site = $3",
+			[]interface{}{"CA982063", "gate", "depot", 11},
+		},
+		{
+			Query{Plate: "CA982063", Pseudonyms: []string{"K2:0123", "K1:4567"}, Limit: 10},
+			" WHERE plate = ANY($1)",
+			[]interface{}{pq.Array([]string{"CA982063", "K2:0123", "K1:4567"}), 11},
+		},
+		{
+			Query{Plate: "ca98", Match: Prefix, From: from, To: to, Limit: 10},
+			" WHERE plate LIKE $1 AND time >= $2 AND time < $3",
+			[]interface{}{"CA98%", from, to, 11},
+		},
+		{
+			Query{Plate: "C?98*6_", Match: Wildcard, Limit: 10},
+			" WHERE plate LIKE $1",
+			[]interface{}{`C_98%6\_`, 11},
+		},
+		{
+			Query{Plate: "CA982O63", Match: Fuzzy, Limit: 10, After: cursor},
+			" WHERE levenshtein(plate, $1) <= $2 AND (time, id) < ($3, $4)",
+			[]interface{}{"CA982O63", 1, from.Add(time.Hour), int64(42), 11},
+		},
+	}
+	for _, test := range tests {
+		q := test.query
+		if err := q.Validate(); err != nil {
+			t.Errorf("%+v: %s", test.query, err)
+			continue
+		}
+		query, args := searchSQL(q)
+		expected := "SELECT " + columns + " FROM events" + test.where +
+			" ORDER BY time DESC, id DESC LIMIT $" + strconv.Itoa(len(test.args))
+		if query != expected {
+			t.Errorf("Expected:\n%s\ngot:\n%s", expected, query)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("Expected args %#v, got %#v", test.args, args)
+		}
+	}
+}
+
+func TestSightingsSQL(t *testing.T) {
+	from := time.Date(2016, 9, 20, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	query, args := sightingsSQL("CA982063", "depot", from, to, 100)
+	expected := "SELECT " + columns + " FROM events WHERE time >= $1 AND time < $2 AND plate = $3 AND site = $4 ORDER BY plate, site, time, id LIMIT $5"
+	if query != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, query)
+	}
+	if !reflect.DeepEqual(args, []interface{}{from, to, "CA982063", "depot", 101}) {
+		t.Errorf("Unexpected args %#v", args)
+	}
+	if query, _ := sightingsSQL("", "depot", from, to, 100); !strings.Contains(query, "time < $2 AND site = $3 ORDER") {
+		t.Errorf("Unexpected query for a site %s", query)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	from := time.Date(2016, 9, 20, 0, 0, 0, 0, time.UTC)
+	for _, q := range []Query{
+		{Match: Prefix, Limit: 10},
+		{Plate: "CA98", Match: "regex", Limit: 10},
+		{Plate: "CA98", Match: Fuzzy, Distance: MaxDistance + 1, Limit: 10},
+		{From: from, To: from, Limit: 10},
+		{Limit: 0},
+		{Limit: 10, After: "not a cursor"},
+	} {
+		if err := q.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", q)
+		}
+	}
+}
+
+func TestValidPlate(t *testing.T) {
+	for plate, valid := range map[string]bool{
+		"CA982063":      true,
+		"":              false,
+		"CA98 2063":     false,
+		"CA98%":         false,
+		"ABCDEFGHIJKLM": false,
+	} {
+		if err := ValidPlate(plate); (err == nil) != valid {
+			t.Errorf("%q: expected valid %t, got %v", plate, valid, err)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	at := time.Date(2016, 9, 20, 13, 54, 26, 123456000, time.FixedZone("CEST", 2*60*60))
+	decoded, id, err := decodeCursor(encodeCursor(Event{ID: 7, Time: at}))
+	if err != nil || !decoded.Equal(at) || id != 7 {
+		t.Errorf("Expected %s and 7, got %s and %d: %v", at, decoded, id, err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	if err := Schema.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEvidenceJSON(t *testing.T) {
+	// The uploader stores OpenALPR's own candidates and coordinates.
+	candidates, _ := json.Marshal([]openalpr.AlprPlate{{Characters: "CA982063", OverallConfidence: 91.5, MatchesTemplate: true}})
+	coordinates, _ := json.Marshal([]openalpr.AlprCoordinate{{X: 10, Y: 20}})
+	var e Evidence
+	if err := json.Unmarshal(candidates, &e.Candidates); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(coordinates, &e.Coordinates); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.Candidates, []Candidate{{Plate: "CA982063", Confidence: 91.5, MatchesTemplate: true}}) ||
+		!reflect.DeepEqual(e.Coordinates, []Point{{X: 10, Y: 20}}) {
+		t.Errorf("Unexpected evidence %+v", e)
+	}
+}
@@ -0,0 +1,99 @@
+package events
+
+import "migrate"
+
+// Schema is the events database's tables. The uploaders insert the events,
+// and the API reads them and records plate corrections.
+//
+// Migrations are only ever added: a deployed one must not change.
+var Schema = migrate.Schema{Name: "events", Migrations: []migrate.Migration{
+	// The first takes over databases made by hand from the old schema
+	// script, so it only creates what isn't there.
+	{Version: 1, Name: "baseline", SQL: `
+CREATE TABLE IF NOT EXISTS events (
+    id serial PRIMARY KEY,
+    time timestamptz NOT NULL,
+    camera text NOT NULL,
+    plate text NOT NULL,
+    plate_image text,
+    frame_image text,
+    site text NOT NULL
+);
+ALTER TABLE events ADD COLUMN IF NOT EXISTS confidence real;
+CREATE INDEX IF NOT EXISTS idx_plates ON events(plate);
+
+-- For the query API: prefix and wildcard plate searches, newest first paging,
+-- fuzzy plate matching, and visits and plate histories, which read a plate's
+-- sightings site by site.
+CREATE INDEX IF NOT EXISTS idx_plates_pattern ON events(plate text_pattern_ops);
+CREATE INDEX IF NOT EXISTS idx_events_time ON events(time DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_events_plate_site ON events(plate, site, time);
+CREATE EXTENSION IF NOT EXISTS fuzzystrmatch;
+
+-- Tells the query API's live stream of each event as it is inserted.
+CREATE OR REPLACE FUNCTION notify_event() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('lpr_events', NEW.id::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS events_notify ON events;
+CREATE TRIGGER events_notify AFTER INSERT ON events
+    FOR EACH ROW EXECUTE PROCEDURE notify_event();
+
+-- Plate corrections made on the dashboard, as an audit trail.
+CREATE TABLE IF NOT EXISTS event_corrections (
+    id serial PRIMARY KEY,
+    event_id integer NOT NULL REFERENCES events(id),
+    time timestamptz NOT NULL,
+    old_plate text NOT NULL,
+    new_plate text NOT NULL,
+    editor text NOT NULL,
+    reason text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_event_corrections_event ON event_corrections(event_id);
+`},
+	// What OpenALPR gave for each read, as evidence for review. Candidates
+	// are [{"plate", "confidence", "matches_template"}] and coordinates the
+	// plate's corners, [{"x", "y"}].
+	{Version: 2, Name: "evidence", SQL: `
+ALTER TABLE events
+    ADD COLUMN candidates jsonb,
+    ADD COLUMN coordinates jsonb,
+    ADD COLUMN region text,
+    ADD COLUMN region_confidence integer,
+    ADD COLUMN matches_template boolean,
+    ADD COLUMN processing_ms real,
+    ADD COLUMN image_width integer,
+    ADD COLUMN image_height integer,
+    ADD COLUMN host text,
+    ADD COLUMN correlation_id text,
+    ADD COLUMN job_id bigint;
+`},
+	// Events sent before it have no uid, and NULLs don't conflict.
+	{Version: 3, Name: "uid", SQL: `
+ALTER TABLE events ADD COLUMN uid text;
+-- The uploader inserts with ON CONFLICT (uid) DO NOTHING, so a retried job
+-- or replayed frame doesn't record its events twice.
+CREATE UNIQUE INDEX idx_events_uid ON events(uid);
+`},
+	// Sites recording plates as keyed hashes may keep each plate encrypted
+	// to a key only the authorised hold, as keyid:base64.
+	{Version: 4, Name: "plate_sealed", SQL: `
+ALTER TABLE events ADD COLUMN plate_sealed text;
+`},
+	// The live stream resumes from the last id a client had, so ids must be
+	// handed out in the order events are committed. Each insert takes a lock
+	// before drawing its ids and holds it until it commits, so an insert
+	// can't draw a lower id than one already committed.
+	{Version: 5, Name: "commit_order", SQL: `
+CREATE FUNCTION lock_event_ids() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('lpr_events_ids'));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER events_commit_order BEFORE INSERT ON events
+    FOR EACH STATEMENT EXECUTE PROCEDURE lock_event_ids();
+`},
+}}
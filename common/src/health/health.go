@@ -0,0 +1,200 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Registry tracks the state of a service's dependencies and whether its main
+// loop is still turning. Dependencies are either pushed by the loop as it
+// finds out, with Set, or checked on demand, with Check.
+type Registry struct {
+	// The main loop is considered stuck if it hasn't called Beat for this
+	// long. Zero disables the check.
+	MaxSilence time.Duration
+	// How long an on demand check may take.
+	CheckTimeout time.Duration
+
+	mu       sync.Mutex
+	states   map[string]error
+	checks   map[string]func(ctx context.Context) error
+	info     map[string]string
+	lastBeat time.Time
+	stopping bool
+
+	readyOnce sync.Once
+}
+
+// New returns a Registry whose loop must beat at least every maxSilence.
+func New(maxSilence time.Duration) *Registry {
+	return &Registry{
+		MaxSilence:   maxSilence,
+		CheckTimeout: 2 * time.Second,
+		states:       make(map[string]error),
+		checks:       make(map[string]func(ctx context.Context) error),
+		info:         make(map[string]string),
+		lastBeat:     time.Now(),
+	}
+}
+
+var (
+	// ErrPending is the state of a dependency that hasn't been set yet.
+	ErrPending = errors.New("not checked yet")
+	// ErrStopping is reported once the service has started shutting down.
+	ErrStopping = errors.New("stopping")
+)
+
+// Expect declares dependencies that will be pushed with Set, so the service
+// isn't ready until each has been reported healthy.
+func (r *Registry) Expect(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range names {
+		r.states[name] = ErrPending
+	}
+}
+
+// Set records the state of a dependency, nil meaning healthy.
+func (r *Registry) Set(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states[name] = err
+}
+
+// Check registers a dependency that is checked each time readiness is asked for.
+func (r *Registry) Check(name string, fn func(ctx context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks[name] = fn
+}
+
+// Info records a piece of information to show alongside the checks, such as
+// when something last succeeded.
+func (r *Registry) Info(key string, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.info[key] = value
+}
+
+// Beat tells the registry the main loop is still making progress.
+func (r *Registry) Beat() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastBeat = time.Now()
+}
+
+// Alive returns an error if the main loop has gone quiet.
+func (r *Registry) Alive(now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.MaxSilence > 0 && now.Sub(r.lastBeat) > r.MaxSilence {
+		return fmt.Errorf("main loop silent for %s", now.Sub(r.lastBeat).Round(time.Second))
+	}
+	return nil
+}
+
+// Report is the body of the health endpoints.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+	Info   map[string]string `json:"info,omitempty"`
+}
+
+// Ready runs the on demand checks and returns whether every dependency is
+// healthy, along with the state of each.
+func (r *Registry) Ready(ctx context.Context) (bool, Report) {
+	r.mu.Lock()
+	states := make(map[string]error, len(r.states)+len(r.checks))
+	for name, err := range r.states {
+		states[name] = err
+	}
+	checks := make(map[string]func(ctx context.Context) error, len(r.checks))
+	for name, fn := range r.checks {
+		checks[name] = fn
+	}
+	report := Report{Checks: make(map[string]string), Info: make(map[string]string)}
+	for key, value := range r.info {
+		report.Info[key] = value
+	}
+	if r.stopping {
+		states["shutdown"] = ErrStopping
+	}
+	r.mu.Unlock()
+
+	// Run the checks outside the lock, in parallel, so one slow database
+	// doesn't hold up the loop calling Set.
+	ctx, cancel := context.WithTimeout(ctx, r.CheckTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for name, fn := range checks {
+		wg.Add(1)
+		go func(name string, fn func(ctx context.Context) error) {
+			defer wg.Done()
+			err := fn(ctx)
+			mu.Lock()
+			states[name] = err
+			mu.Unlock()
+		}(name, fn)
+	}
+	wg.Wait()
+
+	ready := true
+	for name, err := range states {
+		if err != nil {
+			ready = false
+			report.Checks[name] = err.Error()
+		} else {
+			report.Checks[name] = "ok"
+		}
+	}
+	if ready {
+		report.Status = "ok"
+	} else {
+		report.Status = "unavailable"
+	}
+	return ready, report
+}
+
+// Handle registers /healthz, which fails when the main loop is stuck, and
+// /readyz, which fails when any dependency is unhealthy.
+func (r *Registry) Handle(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		report := Report{Status: "ok", Checks: map[string]string{"loop": "ok"}}
+		if err := r.Alive(time.Now()); err != nil {
+			report.Status = "unavailable"
+			report.Checks["loop"] = err.Error()
+		}
+		writeReport(w, report)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		_, report := r.Ready(req.Context())
+		writeReport(w, report)
+	})
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Failing returns the names of the unhealthy dependencies, sorted, for logging.
+func (report Report) Failing() []string {
+	var names []string
+	for name, state := range report.Checks {
+		if state != "ok" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
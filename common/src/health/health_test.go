@@ -0,0 +1,149 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReady(t *testing.T) {
+	r := New(time.Minute)
+	r.Expect("beanstalk")
+	r.Check("db", func(ctx context.Context) error { return nil })
+
+	ready, report := r.Ready(context.Background())
+	if ready || report.Checks["beanstalk"] != ErrPending.Error() || report.Checks["db"] != "ok" {
+		t.Errorf("Expected not ready until beanstalk is set: %+v", report)
+	}
+
+	r.Set("beanstalk", nil)
+	r.Info("last_upload", "never")
+	ready, report = r.Ready(context.Background())
+	if !ready || report.Status != "ok" || report.Info["last_upload"] != "never" {
+		t.Errorf("Expected ready: %+v", report)
+	}
+
+	r.Check("db", func(ctx context.Context) error { return errors.New("connection refused") })
+	ready, report = r.Ready(context.Background())
+	if ready || report.Checks["db"] != "connection refused" || len(report.Failing()) != 1 {
+		t.Errorf("Expected db failing: %+v", report)
+	}
+}
+
+func TestReadyTimeout(t *testing.T) {
+	r := New(time.Minute)
+	r.CheckTimeout = 10 * time.Millisecond
+	r.Check("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if ready, _ := r.Ready(context.Background()); ready {
+		t.Error("Expected a check that times out to fail")
+	}
+}
+
+func TestAlive(t *testing.T) {
+	r := New(time.Second)
+	r.Beat()
+	if err := r.Alive(time.Now()); err != nil {
+		t.Error("Expected alive:", err)
+	}
+	if err := r.Alive(time.Now().Add(2 * time.Second)); err == nil {
+		t.Error("Expected a silent loop to be reported")
+	}
+}
+
+func TestNotifyStopping(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	r := New(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	r.NotifyStopping(ctx)
+	if ready, _ := r.Ready(context.Background()); !ready {
+		t.Fatal("Expected ready before shutdown")
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if ready, report := r.Ready(context.Background()); !ready {
+			if report.Checks["shutdown"] != ErrStopping.Error() {
+				t.Errorf("Expected shutdown reported: %+v", report)
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("Expected not ready once stopping")
+}
+
+func TestHandlers(t *testing.T) {
+	r := New(time.Minute)
+	r.Expect("beanstalk")
+	mux := http.NewServeMux()
+	r.Handle(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Error("Expected healthz ok, got", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	var report Report
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if rec.Code != http.StatusServiceUnavailable || report.Status != "unavailable" {
+		t.Errorf("Expected readyz unavailable, got %d %+v", rec.Code, report)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := Notify("READY=1"); sent || err != nil {
+		t.Error("Expected nothing sent outside systemd")
+	}
+
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := Notify("READY=1"); !sent || err != nil {
+		t.Fatal("Expected notification sent:", err)
+	}
+	buf := make([]byte, 64)
+	n, _ := conn.Read(buf)
+	if string(buf[:n]) != "READY=1" {
+		t.Error("Unexpected notification:", string(buf[:n]))
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	if i := WatchdogInterval(); i != 30*time.Second {
+		t.Error("Unexpected interval:", i)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if i := WatchdogInterval(); i != 0 {
+		t.Error("Expected no watchdog for another process, got", i)
+	}
+}
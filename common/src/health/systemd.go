@@ -0,0 +1,100 @@
+package health
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"logging"
+)
+
+// Notify sends a state such as "READY=1" to systemd. It does nothing, and
+// returns false, when the service wasn't started by systemd with
+// Type=notify.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// NotifyReady tells systemd the service has finished starting up, the first
+// time it is called.
+func (r *Registry) NotifyReady() {
+	r.readyOnce.Do(func() {
+		if _, err := Notify("READY=1"); err != nil {
+			logging.Error("Notify", "state", "READY=1", "err", err)
+		}
+	})
+}
+
+// NotifyStopping waits for ctx to be cancelled, then marks the service as not
+// ready and tells systemd it is stopping.
+func (r *Registry) NotifyStopping(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		r.mu.Lock()
+		r.stopping = true
+		r.mu.Unlock()
+		if _, err := Notify("STOPPING=1"); err != nil {
+			logging.Error("Notify", "state", "STOPPING=1", "err", err)
+		}
+	}()
+}
+
+// WatchdogInterval returns how often systemd expects to hear from us, or zero
+// if WatchdogSec isn't set for this service.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog pings the systemd watchdog at half its interval for as long as the
+// main loop is alive, so a stuck service gets restarted. It returns straight
+// away if the watchdog isn't enabled.
+func (r *Registry) Watchdog() {
+	Watchdog(r)
+}
+
+// Watchdog pings the systemd watchdog for as long as every registry's main
+// loop is alive, for a process running several stages.
+func Watchdog(registries ...*Registry) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	logging.Info("Systemd watchdog", "interval", interval)
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+	Ticks:
+		for now := range ticker.C {
+			for _, r := range registries {
+				if err := r.Alive(now); err != nil {
+					logging.Error("Watchdog", "err", err)
+					continue Ticks
+				}
+			}
+			if _, err := Notify("WATCHDOG=1"); err != nil {
+				logging.Error("Notify", "state", "WATCHDOG=1", "err", err)
+			}
+		}
+	}()
+}
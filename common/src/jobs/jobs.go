@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/openalpr/openalpr"
+)
+
+// MotionEvent is the payload the watcher puts on the motion events tube, one
+// per image written by Motion.
+type MotionEvent struct {
+	CorrelationID string `json:"correlation_id"`
+	Filename      string `json:"filename"`
+	Camera        string `json:"camera"`
+	Site          string `json:"site"`
+}
+
+// DetectionEvent is the payload the plate detector puts on the detection
+// events tube when at least one plate was found in the image.
+type DetectionEvent struct {
+	CorrelationID string               `json:"correlation_id"`
+	Filename      string               `json:"filename"`
+	Camera        string               `json:"camera"`
+	Site          string               `json:"site"`
+	Host          string               `json:"host"`
+	AlprResults   openalpr.AlprResults `json:"event"`
+	// EventIDs are the event ids of the plates, in the same order. Older
+	// detectors, and detectors not told the camera, leave them out.
+	EventIDs []string `json:"event_ids,omitempty"`
+}
+
+// EventID returns the id of the event for a plate read from a frame. It
+// depends only on the camera, the frame's file name and the plate, so a job
+// retried, or a frame replayed, gives the same id every time.
+func EventID(camera, filename, plate string) string {
+	sum := sha256.Sum256([]byte(camera + "\x00" + filepath.Base(filename) + "\x00" + plate))
+	return hex.EncodeToString(sum[:16])
+}
+
+// PlateEventID returns the event id of the i'th plate, the one the detector
+// gave if it did, and otherwise derived using camera.
+func (e DetectionEvent) PlateEventID(i int, camera string) string {
+	if len(e.EventIDs) == len(e.AlprResults.Plates) {
+		return e.EventIDs[i]
+	}
+	return EventID(camera, e.Filename, e.AlprResults.Plates[i].BestPlate)
+}
+
+// NewCorrelationID returns a random id for an image, assigned by the watcher
+// and carried through every job and log line about it.
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// DecodeMotionEvent unmarshals a motion event job body. Older watchers put the
+// bare file path on the tube, so a body that isn't a JSON object is taken to be
+// the filename with no camera identity. Events without a correlation id are
+// given one.
+func DecodeMotionEvent(body []byte) (MotionEvent, error) {
+	var event MotionEvent
+	trimmed := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(trimmed, "{") {
+		event.Filename = trimmed
+	} else if err := json.Unmarshal(body, &event); err != nil {
+		return event, err
+	}
+	if event.Filename == "" {
+		return event, errors.New("motion event has no filename")
+	}
+	if event.CorrelationID == "" {
+		event.CorrelationID = NewCorrelationID()
+	}
+	return event, nil
+}
+
+// DecodeDetectionEvent unmarshals a detection event job body. Events without
+// a correlation id are given one.
+func DecodeDetectionEvent(body []byte) (DetectionEvent, error) {
+	var event DetectionEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return event, err
+	}
+	if event.Filename == "" {
+		return event, errors.New("detection event has no filename")
+	}
+	if event.CorrelationID == "" {
+		event.CorrelationID = NewCorrelationID()
+	}
+	return event, nil
+}
@@ -0,0 +1,71 @@
+package jobs
+
+import "testing"
+
+func TestDecodeMotionEvent(t *testing.T) {
+	event, err := DecodeMotionEvent([]byte(`{"correlation_id": "a1b2c3d4e5f60718", "filename": "/cam1/01-20160920135426-14.jpg", "camera": "gate", "site": "depot"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.CorrelationID != "a1b2c3d4e5f60718" || event.Filename != "/cam1/01-20160920135426-14.jpg" || event.Camera != "gate" || event.Site != "depot" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	// Legacy watchers put the bare path on the tube.
+	event, err = DecodeMotionEvent([]byte("/cam1/01-20160920135426-14.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Filename != "/cam1/01-20160920135426-14.jpg" || event.Camera != "" || len(event.CorrelationID) != 16 {
+		t.Errorf("Unexpected legacy event: %+v", event)
+	}
+
+	if _, err = DecodeMotionEvent([]byte("")); err == nil {
+		t.Error("Expected an error for an empty body")
+	}
+
+	if _, err = DecodeMotionEvent([]byte(`{"filename": `)); err == nil {
+		t.Error("Expected an error for invalid JSON")
+	}
+}
+
+func TestDecodeDetectionEvent(t *testing.T) {
+	event, err := DecodeDetectionEvent([]byte(`{"filename": "a.jpg", "camera": "gate", "event": {"results": [{"plate": "CA982063"}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Camera != "gate" || len(event.AlprResults.Plates) != 1 || event.AlprResults.Plates[0].BestPlate != "CA982063" || event.CorrelationID == "" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	if _, err = DecodeDetectionEvent([]byte(`{"event": {}}`)); err == nil {
+		t.Error("Expected an error for a missing filename")
+	}
+}
+
+func TestEventID(t *testing.T) {
+	id := EventID("gate", "/cam1/01-20160920135426-14.jpg", "CA982063")
+	if len(id) != 32 {
+		t.Errorf("Expected 32 hex digits, got %q", id)
+	}
+	if EventID("gate", "/archive/cam1/01-20160920135426-14.jpg", "CA982063") != id {
+		t.Error("Expected the same id for the frame wherever it is kept")
+	}
+	for _, other := range []string{EventID("yard", "01-20160920135426-14.jpg", "CA982063"), EventID("gate", "01-20160920135426-15.jpg", "CA982063"), EventID("gate", "01-20160920135426-14.jpg", "CA982064")} {
+		if other == id {
+			t.Error("Expected a different id for a different camera, frame or plate")
+		}
+	}
+
+	event, err := DecodeDetectionEvent([]byte(`{"filename": "a.jpg", "event": {"results": [{"plate": "CA982063"}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := event.PlateEventID(0, "gate"); got != EventID("gate", "a.jpg", "CA982063") {
+		t.Errorf("Expected the id derived from the camera given, got %q", got)
+	}
+	event.EventIDs = []string{"a1b2"}
+	if got := event.PlateEventID(0, "gate"); got != "a1b2" {
+		t.Errorf("Expected the detector's id, got %q", got)
+	}
+}
@@ -0,0 +1,93 @@
+package ledger
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Ledger records which image files still have a job in flight, so that the
+// retention sweeper never deletes a frame a detector or uploader is about to
+// read. Each pending file is a marker in a shared directory named after the
+// hash of its path, which works across the services on one Pi without them
+// talking to each other.
+//
+// A nil *Ledger is valid and records nothing.
+type Ledger struct {
+	dir string
+}
+
+// Open returns a ledger stored in dir, creating it if need be. An empty dir
+// disables the ledger and returns nil.
+func Open(dir string) (*Ledger, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Ledger{dir: dir}, nil
+}
+
+func (l *Ledger) marker(file string) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	sum := sha1.Sum([]byte(file))
+	return filepath.Join(l.dir, hex.EncodeToString(sum[:]))
+}
+
+// Add marks the file as referenced by a pending job.
+func (l *Ledger) Add(file string) error {
+	if l == nil {
+		return nil
+	}
+	return ioutil.WriteFile(l.marker(file), []byte(file), 0644)
+}
+
+// Done marks the job referencing the file as finished.
+func (l *Ledger) Done(file string) error {
+	if l == nil {
+		return nil
+	}
+	err := os.Remove(l.marker(file))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Pending reports whether the file is referenced by a pending job.
+func (l *Ledger) Pending(file string) bool {
+	if l == nil {
+		return false
+	}
+	_, err := os.Stat(l.marker(file))
+	return err == nil
+}
+
+// Expire removes markers older than maxAge, which belong to jobs that were
+// lost rather than finished, and returns how many were removed.
+func (l *Ledger) Expire(maxAge time.Duration, now time.Time) (int, error) {
+	if l == nil || maxAge <= 0 {
+		return 0, nil
+	}
+	infos, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, info := range infos {
+		if info.IsDir() || now.Sub(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(l.dir, info.Name())); err != nil && !os.IsNotExist(err) {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
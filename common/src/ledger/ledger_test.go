@@ -0,0 +1,61 @@
+package ledger
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := "/var/lib/motion/01-20160920135426-14.jpg"
+	if l.Pending(file) {
+		t.Error("Expected file not to be pending")
+	}
+	if err = l.Add(file); err != nil {
+		t.Fatal(err)
+	}
+	if !l.Pending(file) {
+		t.Error("Expected file to be pending")
+	}
+	if err = l.Done(file); err != nil {
+		t.Fatal(err)
+	}
+	if l.Pending(file) {
+		t.Error("Expected file not to be pending after Done")
+	}
+	if err = l.Done(file); err != nil {
+		t.Error("Expected Done to be idempotent:", err)
+	}
+
+	l.Add(file)
+	expired, err := l.Expire(time.Hour, time.Now())
+	if err != nil || expired != 0 || !l.Pending(file) {
+		t.Errorf("Expected fresh marker to survive, expired %d: %v", expired, err)
+	}
+	expired, err = l.Expire(time.Hour, time.Now().Add(2*time.Hour))
+	if err != nil || expired != 1 || l.Pending(file) {
+		t.Errorf("Expected old marker to expire, expired %d: %v", expired, err)
+	}
+}
+
+func TestNilLedger(t *testing.T) {
+	l, err := Open("")
+	if err != nil || l != nil {
+		t.Fatal("Expected a nil ledger for an empty dir")
+	}
+	if l.Add("a.jpg") != nil || l.Done("a.jpg") != nil || l.Pending("a.jpg") {
+		t.Error("Expected a nil ledger to record nothing")
+	}
+}
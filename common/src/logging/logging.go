@@ -0,0 +1,260 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line.
+type Level int
+
+// Levels, in increasing severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// Formats for the output.
+const (
+	JSON   = "json"
+	Logfmt = "logfmt"
+)
+
+// output is where and how every Logger writes.
+var output = struct {
+	sync.Mutex
+	w       io.Writer
+	format  string
+	level   Level
+	service string
+	now     func() time.Time
+}{w: os.Stderr, format: Logfmt, level: LevelInfo, now: time.Now}
+
+// Setup configures the output for the service and routes lines written with
+// the standard log package through it, so "[ERROR]" and "[WARN]" prefixes
+// become levels.
+func Setup(service string, format string, level string) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != JSON && format != Logfmt {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	output.Lock()
+	output.service = service
+	output.format = format
+	output.level = lvl
+	output.Unlock()
+
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(bridge{})
+	return nil
+}
+
+// SetLevel changes the minimum level written, such as on a reload.
+func SetLevel(level Level) {
+	output.Lock()
+	defer output.Unlock()
+	output.level = level
+}
+
+// SetOutput sends the lines to w instead of stderr.
+func SetOutput(w io.Writer) {
+	output.Lock()
+	defer output.Unlock()
+	output.w = w
+}
+
+// Logger writes lines carrying a fixed set of fields, such as the ids of the
+// job being worked on.
+type Logger struct {
+	fields []interface{}
+}
+
+// With returns a Logger adding the key value pairs to every line.
+func With(keyValues ...interface{}) *Logger {
+	return (&Logger{}).With(keyValues...)
+}
+
+// With returns a Logger adding the key value pairs to this one's.
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	return &Logger{fields: append(fields, keyValues...)}
+}
+
+// Debug logs at debug level, with the key value pairs as fields.
+func (l *Logger) Debug(msg string, keyValues ...interface{}) { l.write(LevelDebug, msg, keyValues) }
+
+// Info logs at info level, with the key value pairs as fields.
+func (l *Logger) Info(msg string, keyValues ...interface{}) { l.write(LevelInfo, msg, keyValues) }
+
+// Warn logs at warn level, with the key value pairs as fields.
+func (l *Logger) Warn(msg string, keyValues ...interface{}) { l.write(LevelWarn, msg, keyValues) }
+
+// Error logs at error level, with the key value pairs as fields.
+func (l *Logger) Error(msg string, keyValues ...interface{}) { l.write(LevelError, msg, keyValues) }
+
+var root = &Logger{}
+
+// Debug logs at debug level, with the key value pairs as fields.
+func Debug(msg string, keyValues ...interface{}) { root.write(LevelDebug, msg, keyValues) }
+
+// Info logs at info level, with the key value pairs as fields.
+func Info(msg string, keyValues ...interface{}) { root.write(LevelInfo, msg, keyValues) }
+
+// Warn logs at warn level, with the key value pairs as fields.
+func Warn(msg string, keyValues ...interface{}) { root.write(LevelWarn, msg, keyValues) }
+
+// Error logs at error level, with the key value pairs as fields.
+func Error(msg string, keyValues ...interface{}) { root.write(LevelError, msg, keyValues) }
+
+// hasService reports whether the logger names its own service, as each stage
+// does when they share a process.
+func (l *Logger) hasService() bool {
+	return len(l.fields) >= 2 && l.fields[0] == "service"
+}
+
+func (l *Logger) write(level Level, msg string, keyValues []interface{}) {
+	output.Lock()
+	defer output.Unlock()
+	if level < output.level {
+		return
+	}
+
+	keys := []string{"time", "level"}
+	values := []interface{}{output.now().UTC().Format("2006-01-02T15:04:05.000Z"), level.String()}
+	if output.service != "" && !l.hasService() {
+		keys = append(keys, "service")
+		values = append(values, output.service)
+	}
+	fields := l.fields
+	if l.hasService() {
+		keys = append(keys, "service")
+		values = append(values, fields[1])
+		fields = fields[2:]
+	}
+	keys = append(keys, "msg")
+	values = append(values, msg)
+	for _, kv := range [][]interface{}{fields, keyValues} {
+		for i := 0; i < len(kv); i += 2 {
+			var value interface{} = "(missing)"
+			if i+1 < len(kv) {
+				value = kv[i+1]
+			}
+			keys = append(keys, fmt.Sprint(kv[i]))
+			values = append(values, value)
+		}
+	}
+
+	var line []byte
+	if output.format == JSON {
+		line = formatJSON(keys, values)
+	} else {
+		line = formatLogfmt(keys, values)
+	}
+	output.w.Write(line)
+}
+
+// plain turns values without a useful encoding of their own into strings.
+func plain(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration, fmt.Stringer:
+		return fmt.Sprint(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return value
+}
+
+func formatJSON(keys []string, values []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(plain(values[i]))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(values[i]))
+		}
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func formatLogfmt(keys []string, values []interface{}) []byte {
+	var buf bytes.Buffer
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		s := fmt.Sprint(plain(values[i]))
+		if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// bridge turns lines from the standard log package into log lines, taking
+// their level from the "[ERROR]" or "[WARN]" prefix used across the services.
+type bridge struct{}
+
+func (bridge) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	level := LevelInfo
+	for _, prefix := range []struct {
+		text  string
+		level Level
+	}{{"[ERROR]", LevelError}, {"[WARN]", LevelWarn}, {"[DEBUG]", LevelDebug}} {
+		if strings.HasPrefix(line, prefix.text) {
+			level = prefix.level
+			line = strings.TrimLeft(strings.TrimPrefix(line, prefix.text), ": ")
+			break
+		}
+	}
+	root.write(level, line, nil)
+	return len(p), nil
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+	"time"
+)
+
+func capture(t *testing.T, format string) *bytes.Buffer {
+	if err := Setup("detector", format, "info"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	output.now = func() time.Time { return time.Date(2016, 9, 20, 13, 54, 26, 0, time.UTC) }
+	return &buf
+}
+
+func TestLogfmt(t *testing.T) {
+	buf := capture(t, Logfmt)
+	With("job_id", 12, "correlation_id", "a1b2").Info("Plate found", "plate", "CA 123-456", "elapsed", 250*time.Millisecond)
+
+	expected := `time=2016-09-20T13:54:26.000Z level=info service=detector msg="Plate found" job_id=12 correlation_id=a1b2 plate="CA 123-456" elapsed=250ms` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestService(t *testing.T) {
+	buf := capture(t, Logfmt)
+	With("service", "uploader").With("job_id", 3).Warn("Released")
+
+	expected := `time=2016-09-20T13:54:26.000Z level=warn service=uploader msg=Released job_id=3` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := capture(t, JSON)
+	Error("Upload failed", "err", errors.New("timeout"), "odd")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	expected := map[string]interface{}{
+		"level": "error", "service": "detector", "msg": "Upload failed", "err": "timeout", "odd": "(missing)",
+	}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Errorf("%s: expected %v, got %v", key, value, line[key])
+		}
+	}
+}
+
+func TestLevel(t *testing.T) {
+	buf := capture(t, Logfmt)
+	Debug("hidden")
+	SetLevel(LevelDebug)
+	Debug("shown")
+	if bytes.Contains(buf.Bytes(), []byte("hidden")) || !bytes.Contains(buf.Bytes(), []byte("shown")) {
+		t.Error("Unexpected output:", buf.String())
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("Expected an unknown level to be rejected")
+	}
+}
+
+func TestBridge(t *testing.T) {
+	tests := map[string]string{
+		"[ERROR]: Ledger: disk full":   `level=error service=detector msg="Ledger: disk full"`,
+		"[WARN] Retention without dir": `level=warn service=detector msg="Retention without dir"`,
+		"Connected":                    `level=info service=detector msg=Connected`,
+	}
+	for input, expected := range tests {
+		buf := capture(t, Logfmt)
+		log.Println(input)
+		expected = "time=2016-09-20T13:54:26.000Z " + expected + "\n"
+		if buf.String() != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"queue"
+
+	"github.com/kr/beanstalk"
+	"github.com/openalpr/openalpr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics shared by the services that consume jobs.
+var (
+	JobFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lpr_job_failures_total",
+		Help: "Jobs that failed, by tube and whether they were released to retry or buried.",
+	}, []string{"tube", "outcome"})
+)
+
+// Watcher metrics.
+var (
+	FilesEnqueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lpr_watcher_files_enqueued_total",
+		Help: "Images put on the motion events tube.",
+	}, []string{"camera"})
+	FilesIgnored = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lpr_watcher_files_ignored_total",
+		Help: "Images that matched the rules but were not queued.",
+	}, []string{"reason"})
+	EnqueueErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lpr_watcher_enqueue_errors_total",
+		Help: "Failures putting a job on the motion events tube.",
+	})
+	RetentionFiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "lpr_retention_files",
+		Help: "Files in the retention directories at the last sweep.",
+	})
+	RetentionBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "lpr_retention_bytes",
+		Help: "Bytes in the retention directories at the last sweep.",
+	})
+	RetentionPinned = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "lpr_retention_pinned_files",
+		Help: "Files due for deletion but kept for a pending job at the last sweep.",
+	})
+	RetentionDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lpr_retention_deleted_files_total",
+		Help: "Files deleted by the retention policy.",
+	})
+	RetentionDeletedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lpr_retention_deleted_bytes_total",
+		Help: "Bytes deleted by the retention policy.",
+	})
+	DiskUsed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "lpr_disk_used_percent",
+		Help: "Usage of the filesystem holding the retention directories.",
+	})
+)
+
+// Plate detector metrics.
+var (
+	FramesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lpr_detector_frames_total",
+		Help: "Frames run through ALPR, by whether a plate was found.",
+	}, []string{"result"})
+	RecognitionSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lpr_detector_recognition_seconds",
+		Help:    "Time taken by ALPR to recognise a frame.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+	PlatesPerFrame = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lpr_detector_plates_per_frame",
+		Help:    "Plates found in each frame.",
+		Buckets: []float64{0, 1, 2, 3, 5, 8},
+	})
+	PlateConfidence = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lpr_detector_plate_confidence",
+		Help:    "ALPR confidence of each plate's best candidate.",
+		Buckets: prometheus.LinearBuckets(50, 5, 10),
+	})
+	DetectorErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lpr_detector_errors_total",
+		Help: "Errors while processing motion events, by stage.",
+	}, []string{"stage"})
+)
+
+// Uploader metrics.
+var (
+	DedupHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lpr_uploader_dedup_hits_total",
+		Help: "Plates not sent because they were seen within the event interval.",
+	})
+	Uploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lpr_uploader_uploads_total",
+		Help: "Image uploads to S3, by result.",
+	}, []string{"result"})
+	Inserts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lpr_uploader_inserts_total",
+		Help: "Event inserts into the remote database, by result: success, failure, or duplicate for an event already recorded.",
+	}, []string{"result"})
+	TimestampFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lpr_uploader_timestamp_fallbacks_total",
+		Help: "Event times not read from the file name, by the fallback used.",
+	}, []string{"source"})
+	EventLagSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lpr_uploader_event_lag_seconds",
+		Help:    "Time from a frame being taken to its event being sent.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+)
+
+// Query API metrics.
+var (
+	APIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lpr_api_requests_total",
+		Help: "Query API requests, by route and status code.",
+	}, []string{"route", "code"})
+	APIRequestSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lpr_api_request_seconds",
+		Help:    "Time taken to answer query API requests, by route.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"route"})
+	StreamClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "lpr_api_stream_clients",
+		Help: "Clients connected to the live event stream.",
+	})
+	StreamDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lpr_api_stream_dropped_total",
+		Help: "Stream clients disconnected for falling behind.",
+	})
+)
+
+// Watcher returns the collectors exported by the watcher.
+func Watcher() []prometheus.Collector {
+	return []prometheus.Collector{FilesEnqueued, FilesIgnored, EnqueueErrors, RetentionFiles, RetentionBytes,
+		RetentionPinned, RetentionDeleted, RetentionDeletedBytes, DiskUsed}
+}
+
+// Detector returns the collectors exported by the plate detector.
+func Detector() []prometheus.Collector {
+	return []prometheus.Collector{FramesProcessed, RecognitionSeconds, PlatesPerFrame, PlateConfidence, DetectorErrors, JobFailures}
+}
+
+// Uploader returns the collectors exported by the uploader.
+func Uploader() []prometheus.Collector {
+	return []prometheus.Collector{DedupHits, Uploads, Inserts, TimestampFallbacks, EventLagSeconds, JobFailures}
+}
+
+// API returns the collectors exported by the query API.
+func API() []prometheus.Collector {
+	return []prometheus.Collector{APIRequests, APIRequestSeconds, StreamClients, StreamDropped}
+}
+
+// Handler returns the /metrics handler for the collectors, along with the
+// usual Go runtime and process metrics.
+func Handler(collectors ...prometheus.Collector) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	registry.MustRegister(collectors...)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// ObserveDetection records the outcome of recognising one frame.
+func ObserveDetection(results openalpr.AlprResults, elapsed time.Duration) {
+	RecognitionSeconds.Observe(elapsed.Seconds())
+	PlatesPerFrame.Observe(float64(len(results.Plates)))
+	if len(results.Plates) == 0 {
+		FramesProcessed.WithLabelValues("no_plate").Inc()
+		return
+	}
+	FramesProcessed.WithLabelValues("plate").Inc()
+	for _, plate := range results.Plates {
+		PlateConfidence.Observe(float64(BestConfidence(plate)))
+	}
+}
+
+// BestConfidence returns the confidence of the plate's best candidate.
+func BestConfidence(plate openalpr.AlprPlateResult) float32 {
+	return BestCandidate(plate).OverallConfidence
+}
+
+// BestCandidate returns the candidate OpenALPR chose as the plate, or the
+// first if none matches.
+func BestCandidate(plate openalpr.AlprPlateResult) openalpr.AlprPlate {
+	for _, candidate := range plate.TopNPlates {
+		if candidate.Characters == plate.BestPlate {
+			return candidate
+		}
+	}
+	if len(plate.TopNPlates) > 0 {
+		return plate.TopNPlates[0]
+	}
+	return openalpr.AlprPlate{}
+}
+
+// Result is the label value for an operation's outcome.
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// Tubes returns collectors for the depth of the tubes: beanstalkd tubes are
+// asked for their stats, and in-process tubes report how many jobs are
+// waiting in their buffer.
+func Tubes(tubes ...queue.Tube) []prometheus.Collector {
+	var collectors []prometheus.Collector
+	beanstalkTubes := make(map[string][]string)
+	var addrs []string
+	for _, tube := range tubes {
+		switch t := tube.(type) {
+		case *queue.Beanstalk:
+			if _, ok := beanstalkTubes[t.Addr]; !ok {
+				addrs = append(addrs, t.Addr)
+			}
+			beanstalkTubes[t.Addr] = append(beanstalkTubes[t.Addr], t.Name())
+		case *queue.Memory:
+			collectors = append(collectors, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "lpr_memory_tube_jobs",
+				Help:        "Jobs waiting in an in-process tube.",
+				ConstLabels: prometheus.Labels{"tube": t.Name()},
+			}, func() float64 { return float64(t.Len()) }))
+		}
+	}
+	for _, addr := range addrs {
+		collectors = append(collectors, NewTubeCollector(addr, beanstalkTubes[addr]...))
+	}
+	return collectors
+}
+
+// tubeCollector reports the depth of beanstalk tubes, asking beanstalkd on
+// every scrape so the numbers are never stale.
+type tubeCollector struct {
+	addr  string
+	tubes []string
+	jobs  *prometheus.Desc
+	up    *prometheus.Desc
+}
+
+// NewTubeCollector returns a collector for the number of jobs in each state
+// in the tubes.
+func NewTubeCollector(addr string, tubes ...string) prometheus.Collector {
+	return &tubeCollector{
+		addr:  addr,
+		tubes: tubes,
+		jobs: prometheus.NewDesc("lpr_beanstalk_tube_jobs",
+			"Jobs in a beanstalk tube, by state.", []string{"tube", "state"}, nil),
+		up: prometheus.NewDesc("lpr_beanstalk_up",
+			"Whether beanstalkd answered the last stats request.", nil, nil),
+	}
+}
+
+func (c *tubeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.jobs
+	ch <- c.up
+}
+
+func (c *tubeCollector) Collect(ch chan<- prometheus.Metric) {
+	netConn, err := net.DialTimeout("tcp", c.addr, 2*time.Second)
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+		return
+	}
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn := beanstalk.NewConn(netConn)
+	defer conn.Close()
+
+	up := 1.0
+	for _, name := range c.tubes {
+		tube := &beanstalk.Tube{Conn: conn, Name: name}
+		stats, err := tube.Stats()
+		if err != nil {
+			// A tube nobody has used yet doesn't exist, which isn't an error.
+			if connErr, ok := err.(beanstalk.ConnError); ok && connErr.Err == beanstalk.ErrNotFound {
+				stats = map[string]string{}
+			} else {
+				up = 0
+				break
+			}
+		}
+		for _, state := range []string{"ready", "reserved", "delayed", "buried"} {
+			n, _ := strconv.ParseFloat(stats["current-jobs-"+state], 64)
+			ch <- prometheus.MustNewConstMetric(c.jobs, prometheus.GaugeValue, n, name, state)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up)
+}
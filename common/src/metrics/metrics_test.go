@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openalpr/openalpr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBestConfidence(t *testing.T) {
+	plate := openalpr.AlprPlateResult{
+		BestPlate: "CA982063",
+		TopNPlates: []openalpr.AlprPlate{
+			{Characters: "CA98206", OverallConfidence: 92},
+			{Characters: "CA982063", OverallConfidence: 88, MatchesTemplate: true},
+		},
+	}
+	if c := BestConfidence(plate); c != 88 {
+		t.Error("Expected the best plate's confidence, got", c)
+	}
+	if c := BestCandidate(plate); !c.MatchesTemplate {
+		t.Error("Expected the best plate's candidate, got", c)
+	}
+
+	plate.BestPlate = "XX"
+	if c := BestConfidence(plate); c != 92 {
+		t.Error("Expected the first candidate's confidence, got", c)
+	}
+
+	if c := BestConfidence(openalpr.AlprPlateResult{}); c != 0 {
+		t.Error("Expected no confidence without candidates, got", c)
+	}
+}
+
+func TestObserveDetection(t *testing.T) {
+	ObserveDetection(openalpr.AlprResults{}, 100*time.Millisecond)
+	ObserveDetection(openalpr.AlprResults{Plates: []openalpr.AlprPlateResult{{BestPlate: "CA982063"}}}, time.Second)
+
+	if n := testutil.ToFloat64(FramesProcessed.WithLabelValues("no_plate")); n != 1 {
+		t.Error("Expected one frame without a plate, got", n)
+	}
+	if n := testutil.ToFloat64(FramesProcessed.WithLabelValues("plate")); n != 1 {
+		t.Error("Expected one frame with a plate, got", n)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	DedupHits.Inc()
+	// Nothing listens on port 1, so beanstalk shows as down.
+	handler := Handler(append(Uploader(), NewTubeCollector("127.0.0.1:1", "detection_events"))...)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, expected := range []string{"lpr_uploader_dedup_hits_total 1", "lpr_beanstalk_up 0", "go_goroutines"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in metrics", expected)
+		}
+	}
+	if strings.Contains(body, "lpr_watcher_files_enqueued_total") {
+		t.Error("Expected only the uploader's metrics")
+	}
+}
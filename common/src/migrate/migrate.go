@@ -0,0 +1,171 @@
+// Package migrate keeps database schemas up to date with numbered
+// migrations built into the services, and checks a database is at the
+// version a service was built for.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// Migration is one change to a schema. Versions start at 1 and count up
+// without gaps.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Schema is the migrations for one database. Its name keys its version in
+// the schema_migrations table, so schemas can share a database.
+type Schema struct {
+	Name       string
+	Migrations []Migration
+}
+
+// Latest is the version the schema's migrations bring a database to.
+func (s Schema) Latest() int {
+	return len(s.Migrations)
+}
+
+// Validate checks the migrations are numbered 1, 2, 3 and so on.
+func (s Schema) Validate() error {
+	for i, m := range s.Migrations {
+		if m.Version != i+1 {
+			return fmt.Errorf("%s migration %q is numbered %d, expected %d", s.Name, m.Name, m.Version, i+1)
+		}
+		if m.SQL == "" {
+			return fmt.Errorf("%s migration %d is empty", s.Name, m.Version)
+		}
+	}
+	return nil
+}
+
+// pending returns the migrations after version current.
+func (s Schema) pending(current int) []Migration {
+	if current >= len(s.Migrations) {
+		return nil
+	}
+	return s.Migrations[current:]
+}
+
+// compare reports what's wrong if a database at version current isn't the
+// version this build expects.
+func (s Schema) compare(current int) error {
+	switch {
+	case current < s.Latest():
+		return fmt.Errorf("%s database is at schema version %d, this build needs %d: run migrate", s.Name, current, s.Latest())
+	case current > s.Latest():
+		return fmt.Errorf("%s database is at schema version %d, newer than this build's %d: upgrade this service", s.Name, current, s.Latest())
+	}
+	return nil
+}
+
+const createTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    schema text NOT NULL,
+    version integer NOT NULL,
+    name text NOT NULL,
+    applied_at timestamptz NOT NULL,
+    PRIMARY KEY (schema, version)
+)`
+
+// Version returns the database's version of the schema, 0 if no migrations
+// have been applied.
+func (s Schema) Version(ctx context.Context, db *sql.DB) (int, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	err := db.QueryRowContext(ctx, "SELECT coalesce(max(version), 0) FROM schema_migrations WHERE schema = $1", s.Name).Scan(&version)
+	return version, err
+}
+
+// Check returns an error unless the database is at the schema's latest
+// version.
+func (s Schema) Check(ctx context.Context, db *sql.DB) error {
+	current, err := s.Version(ctx, db)
+	if err != nil {
+		return fmt.Errorf("%s schema version: %s", s.Name, err)
+	}
+	return s.compare(current)
+}
+
+// Up applies the migrations the database hasn't had, each in its own
+// transaction, and returns the versions applied. A lock keeps services
+// starting together from applying them twice. A database newer than the
+// schema is an error.
+func (s Schema) Up(ctx context.Context, db *sql.DB) ([]int, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", s.lockKey()); err != nil {
+		return nil, fmt.Errorf("lock: %s", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", s.lockKey())
+
+	if _, err := conn.ExecContext(ctx, createTable); err != nil {
+		return nil, err
+	}
+	var current int
+	err = conn.QueryRowContext(ctx, "SELECT coalesce(max(version), 0) FROM schema_migrations WHERE schema = $1", s.Name).Scan(&current)
+	if err != nil {
+		return nil, err
+	}
+	if current > s.Latest() {
+		return nil, s.compare(current)
+	}
+	var applied []int
+	for _, m := range s.pending(current) {
+		if err := s.apply(ctx, conn, m); err != nil {
+			return applied, fmt.Errorf("%s migration %d %s: %s", s.Name, m.Version, m.Name, err)
+		}
+		applied = append(applied, m.Version)
+	}
+	return applied, nil
+}
+
+// Ensure applies the migrations the database hasn't had if auto is set, and
+// otherwise checks it has had them all. It returns the versions applied.
+func (s Schema) Ensure(ctx context.Context, db *sql.DB, auto bool) ([]int, error) {
+	if auto {
+		return s.Up(ctx, db)
+	}
+	return nil, s.Check(ctx, db)
+}
+
+func (s Schema) apply(ctx context.Context, conn *sql.Conn, m Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (schema, version, name, applied_at) VALUES ($1, $2, $3, $4)",
+		s.Name, m.Version, m.Name, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockKey is the advisory lock taken while migrating the schema.
+func (s Schema) lockKey() int64 {
+	h := fnv.New64a()
+	h.Write([]byte("migrate:" + s.Name))
+	return int64(h.Sum64())
+}
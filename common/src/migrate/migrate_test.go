@@ -0,0 +1,56 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+)
+
+var schema = Schema{Name: "test", Migrations: []Migration{
+	{Version: 1, Name: "baseline", SQL: "CREATE TABLE a (id integer)"},
+	{Version: 2, Name: "b", SQL: "CREATE TABLE b (id integer)"},
+	{Version: 3, Name: "c", SQL: "CREATE TABLE c (id integer)"},
+}}
+
+func TestValidate(t *testing.T) {
+	if err := schema.Validate(); err != nil {
+		t.Error(err)
+	}
+	gap := Schema{Name: "test", Migrations: []Migration{schema.Migrations[0], schema.Migrations[2]}}
+	if err := gap.Validate(); err == nil || !strings.Contains(err.Error(), "numbered 3, expected 2") {
+		t.Errorf("Expected a gap refused, got %v", err)
+	}
+	empty := Schema{Name: "test", Migrations: []Migration{{Version: 1, Name: "empty"}}}
+	if err := empty.Validate(); err == nil {
+		t.Error("Expected an empty migration refused")
+	}
+}
+
+func TestPending(t *testing.T) {
+	for current, expected := range map[int]int{0: 3, 1: 2, 3: 0, 4: 0} {
+		if pending := schema.pending(current); len(pending) != expected {
+			t.Errorf("At %d expected %d pending, got %d", current, expected, len(pending))
+		}
+	}
+	if pending := schema.pending(1); pending[0].Version != 2 {
+		t.Errorf("Expected version 2 next, got %d", pending[0].Version)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	if err := schema.compare(3); err != nil {
+		t.Error(err)
+	}
+	if err := schema.compare(2); err == nil || !strings.Contains(err.Error(), "run migrate") {
+		t.Errorf("Expected an old database refused, got %v", err)
+	}
+	if err := schema.compare(4); err == nil || !strings.Contains(err.Error(), "upgrade this service") {
+		t.Errorf("Expected a newer database refused, got %v", err)
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	other := Schema{Name: "other"}
+	if schema.lockKey() == other.lockKey() {
+		t.Error("Expected schemas to lock separately")
+	}
+}
@@ -0,0 +1,210 @@
+// Package pgconn builds connection strings for the Postgres databases from
+// the services' settings, and checks they connect securely.
+package pgconn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Config is how to connect to a database. A DSN, a postgres:// URL or
+// key=value pairs, takes the place of the other fields, except that the
+// Password is added to a DSN without one, so it can be kept apart.
+type Config struct {
+	DSN      string
+	Host     string
+	Port     int
+	User     string
+	Password string
+	DB       string
+	// SSLMode is as lib/pq takes it. Only verify-full checks the server is
+	// the host asked for.
+	SSLMode string
+	// SSLRootCert verifies the server's certificate, and SSLCert and SSLKey
+	// are the client's, if the server asks for one.
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+}
+
+// params returns the connection's parameters.
+func (c Config) params() (map[string]string, error) {
+	var p map[string]string
+	if c.DSN != "" {
+		dsn := c.DSN
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			var err error
+			if dsn, err = pq.ParseURL(dsn); err != nil {
+				return nil, fmt.Errorf("dsn: %s", err)
+			}
+		}
+		var err error
+		if p, err = parseKeyValues(dsn); err != nil {
+			return nil, fmt.Errorf("dsn: %s", err)
+		}
+	} else {
+		p = map[string]string{
+			"host":        c.Host,
+			"user":        c.User,
+			"dbname":      c.DB,
+			"sslmode":     c.SSLMode,
+			"sslrootcert": c.SSLRootCert,
+			"sslcert":     c.SSLCert,
+			"sslkey":      c.SSLKey,
+		}
+		if c.Port != 0 {
+			p["port"] = strconv.Itoa(c.Port)
+		}
+	}
+	if p["password"] == "" {
+		p["password"] = c.Password
+	}
+	for key, value := range p {
+		if value == "" {
+			delete(p, key)
+		}
+	}
+	return p, nil
+}
+
+// ConnectString returns the connection string to give lib/pq.
+func (c Config) ConnectString() (string, error) {
+	p, err := c.params()
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(p))
+	for key := range p {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "='" + quote.Replace(p[key]) + "'"
+	}
+	return strings.Join(pairs, " "), nil
+}
+
+// Validate checks the DSN can be read and the certificates are there.
+func (c Config) Validate() error {
+	p, err := c.params()
+	if err != nil {
+		return err
+	}
+	if (p["sslcert"] == "") != (p["sslkey"] == "") {
+		return errors.New("a client certificate needs its key, and a key its certificate")
+	}
+	for _, key := range []string{"sslrootcert", "sslcert", "sslkey"} {
+		if file := p[key]; file != "" {
+			if _, err := os.Stat(file); err != nil {
+				return fmt.Errorf("%s: %s", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Insecure returns why the connection isn't safe, or nothing if it is. A
+// connection to another machine must verify the server's certificate and
+// name, or the password and events can be read, or changed, on the way.
+func (c Config) Insecure() []string {
+	p, err := c.params()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if local(p["host"]) {
+		return nil
+	}
+	// lib/pq requires TLS without verifying anything if not told otherwise.
+	mode := p["sslmode"]
+	if mode == "" {
+		mode = "require"
+	}
+	if mode != "verify-full" {
+		return []string{fmt.Sprintf("sslmode is %s, not verify-full, to %s", mode, p["host"])}
+	}
+	return nil
+}
+
+// Superuser reports whether the connection is as the postgres superuser,
+// which the services only need to migrate.
+func (c Config) Superuser() bool {
+	p, err := c.params()
+	return err == nil && p["user"] == "postgres"
+}
+
+// Check returns an error if the config is invalid, or insecure without
+// allowInsecure.
+func (c Config) Check(allowInsecure bool) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if reasons := c.Insecure(); len(reasons) > 0 && !allowInsecure {
+		return fmt.Errorf("insecure connection, %s: set allow-insecure-db to connect anyway", strings.Join(reasons, ", "))
+	}
+	return nil
+}
+
+// local reports whether host is this machine, where the connection never
+// crosses the network. No host is the Unix socket.
+func local(host string) bool {
+	switch host {
+	case "", "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return strings.HasPrefix(host, "/")
+}
+
+// parseKeyValues reads a connection string of key=value pairs, the values
+// optionally in single quotes, with backslash escapes.
+func parseKeyValues(dsn string) (map[string]string, error) {
+	p := make(map[string]string)
+	s := dsn
+	for {
+		s = strings.TrimLeft(s, " \t\n")
+		if s == "" {
+			return p, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("expected key=value at %q", s)
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t\n")
+		quoted := strings.HasPrefix(s, "'")
+		if quoted {
+			s = s[1:]
+		}
+		var value strings.Builder
+		closed := false
+		for len(s) > 0 {
+			ch := s[0]
+			s = s[1:]
+			switch {
+			case ch == '\\' && len(s) > 0:
+				value.WriteByte(s[0])
+				s = s[1:]
+				continue
+			case quoted && ch == '\'':
+				closed = true
+			case !quoted && (ch == ' ' || ch == '\t' || ch == '\n'):
+				closed = true
+			default:
+				value.WriteByte(ch)
+				continue
+			}
+			break
+		}
+		if quoted && !closed {
+			return nil, fmt.Errorf("unterminated quote in %s", key)
+		}
+		p[key] = value.String()
+	}
+}
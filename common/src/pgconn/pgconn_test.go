@@ -0,0 +1,89 @@
+package pgconn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConnectString(t *testing.T) {
+	c := Config{Host: "db.example.com", Port: 5432, User: "lpr_uploader", Password: `it's a \secret`, DB: "lpr", SSLMode: "verify-full", SSLRootCert: "/etc/lpr/ca.crt"}
+	got, err := c.ConnectString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `dbname='lpr' host='db.example.com' password='it\'s a \\secret' port='5432' sslmode='verify-full' sslrootcert='/etc/lpr/ca.crt' user='lpr_uploader'`
+	if got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+	if p, _ := parseKeyValues(got); p["password"] != c.Password {
+		t.Errorf("Expected the password back, got %q", p["password"])
+	}
+}
+
+func TestDSN(t *testing.T) {
+	tests := []struct {
+		dsn      string
+		expected map[string]string
+	}{
+		{"postgres://lpr@db.example.com:5433/events?sslmode=verify-full", map[string]string{
+			"host": "db.example.com", "port": "5433", "user": "lpr", "dbname": "events", "sslmode": "verify-full", "password": "pw"}},
+		{"host=db.example.com user=lpr password='from dsn' sslmode = require", map[string]string{
+			"host": "db.example.com", "user": "lpr", "password": "from dsn", "sslmode": "require"}},
+	}
+	for _, test := range tests {
+		// The other fields give way to the DSN, but the password fills in.
+		p, err := Config{DSN: test.dsn, Host: "ignored", SSLMode: "disable", Password: "pw"}.params()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.dsn, test.expected, p)
+		}
+	}
+	if _, err := (Config{DSN: "host='db"}).params(); err == nil {
+		t.Error("Expected an error for an unterminated quote")
+	}
+	if _, err := (Config{DSN: "host"}).params(); err == nil {
+		t.Error("Expected an error for a key without a value")
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	tests := []struct {
+		config   Config
+		insecure bool
+	}{
+		{Config{Host: "db.example.com", SSLMode: "verify-full"}, false},
+		{Config{Host: "db.example.com", SSLMode: "disable"}, true},
+		{Config{Host: "db.example.com", SSLMode: "verify-ca"}, true},
+		{Config{DSN: "host=db.example.com"}, true},
+		{Config{Host: "localhost", SSLMode: "disable"}, false},
+		{Config{Host: "/var/run/postgresql", SSLMode: "disable"}, false},
+	}
+	for _, test := range tests {
+		if insecure := len(test.config.Insecure()) > 0; insecure != test.insecure {
+			t.Errorf("%+v: expected insecure %t, got %q", test.config, test.insecure, test.config.Insecure())
+		}
+		if err := test.config.Check(false); (err != nil) != test.insecure {
+			t.Errorf("%+v: unexpected check %v", test.config, err)
+		}
+		if err := test.config.Check(true); err != nil {
+			t.Errorf("%+v: expected insecure connections allowed, got %v", test.config, err)
+		}
+	}
+	if !(Config{User: "postgres"}).Superuser() || (Config{User: "lpr"}).Superuser() {
+		t.Error("Expected only postgres to be the superuser")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (Config{Host: "db.example.com", SSLCert: "/etc/lpr/client.crt"}).Validate(); err == nil {
+		t.Error("Expected an error for a certificate without its key")
+	}
+	if err := (Config{Host: "db.example.com", SSLRootCert: "/does/not/exist.crt"}).Validate(); err == nil {
+		t.Error("Expected an error for a missing root certificate")
+	}
+	if err := (Config{Host: "db.example.com", SSLMode: "verify-full"}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
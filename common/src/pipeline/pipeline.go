@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"detector"
+	"queue"
+	"uploader"
+	"watcher"
+)
+
+// Tubes connect the stages. Each stage has its own end of a tube, which for
+// beanstalkd is its own connection, as it would be in its own process.
+type Tubes struct {
+	MotionOut    queue.Tube
+	MotionIn     queue.Tube
+	DetectionOut queue.Tube
+	DetectionIn  queue.Tube
+
+	// Drain stops the detector and uploader once the stage before them has
+	// stopped and their input is empty, rather than on shutdown.
+	Drain bool
+}
+
+// Memory connects the stages with bounded in-memory tubes holding size jobs
+// each, which are drained on shutdown.
+func Memory(motionTube string, detectionTube string, size int) Tubes {
+	motion := queue.NewMemory(motionTube, size)
+	detections := queue.NewMemory(detectionTube, size)
+	return Tubes{
+		MotionOut:    motion,
+		MotionIn:     motion,
+		DetectionOut: detections,
+		DetectionIn:  detections,
+		Drain:        true,
+	}
+}
+
+// Beanstalk connects the stages through beanstalkd.
+func Beanstalk(addr string, motionTube string, detectionTube string, priority uint32, ttr time.Duration) Tubes {
+	return Tubes{
+		MotionOut:    queue.NewBeanstalk(addr, motionTube, priority, ttr),
+		MotionIn:     queue.NewBeanstalk(addr, motionTube, priority, ttr),
+		DetectionOut: queue.NewBeanstalk(addr, detectionTube, priority, ttr),
+		DetectionIn:  queue.NewBeanstalk(addr, detectionTube, priority, ttr),
+	}
+}
+
+// Run runs the watcher, detector and uploader until ctx is cancelled, and
+// closes the tubes. When draining, closing a stage's output is what stops
+// the next stage.
+func Run(ctx context.Context, w *watcher.Watcher, d *detector.Detector, u *uploader.Uploader, tubes Tubes) error {
+	downstream := ctx
+	if tubes.Drain {
+		downstream = context.Background()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer tubes.MotionOut.Close()
+		if err := w.Run(ctx, tubes.MotionOut); err != nil {
+			errs <- fmt.Errorf("watcher: %s", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer tubes.DetectionOut.Close()
+		defer tubes.MotionIn.Close()
+		if err := d.Run(downstream, tubes.MotionIn, tubes.DetectionOut); err != nil {
+			errs <- fmt.Errorf("detector: %s", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer tubes.DetectionIn.Close()
+		if err := u.Run(downstream, tubes.DetectionIn); err != nil {
+			errs <- fmt.Errorf("uploader: %s", err)
+		}
+	}()
+	wg.Wait()
+	close(errs)
+
+	// The first stage to fail is the one to report.
+	return <-errs
+}
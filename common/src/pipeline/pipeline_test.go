@@ -0,0 +1,440 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"detector"
+	detectorconfig "detector/config"
+	"jobs"
+	"ledger"
+	"logging"
+	"pseudonym"
+	"queue"
+	"uploader"
+	uploaderconfig "uploader/config"
+	"watcher"
+	watcherconfig "watcher/config"
+
+	"github.com/openalpr/openalpr"
+)
+
+// fakeRecognizer finds the plates listed for each frame's name, and reports
+// each frame it is asked about on seen.
+type fakeRecognizer struct {
+	plates map[string][]string
+	seen   chan string
+}
+
+func (r *fakeRecognizer) RecognizeByFilePath(filePath string) (openalpr.AlprResults, error) {
+	name := filepath.Base(filePath)
+	defer func() { r.seen <- name }()
+	plates, ok := r.plates[name]
+	if !ok {
+		return openalpr.AlprResults{}, fmt.Errorf("unexpected frame %s", name)
+	}
+	var results openalpr.AlprResults
+	for i, plate := range plates {
+		results.Plates = append(results.Plates, openalpr.AlprPlateResult{
+			BestPlate:  plate,
+			PlateIndex: i,
+			TopNPlates: []openalpr.AlprPlate{{Characters: plate, OverallConfidence: 90}},
+		})
+	}
+	return results, nil
+}
+
+func (r *fakeRecognizer) SetTopN(topN int) {}
+
+// fakeImages makes "images" naming the frame they came from.
+type fakeImages struct{}
+
+func (fakeImages) Plate(filename string, points []openalpr.AlprCoordinate) (*bytes.Buffer, error) {
+	return bytes.NewBufferString("plate of " + filepath.Base(filename)), nil
+}
+
+func (fakeImages) Frame(filename string) (*bytes.Buffer, error) {
+	return bytes.NewBufferString("thumbnail of " + filepath.Base(filename)), nil
+}
+
+// fakeStore keeps the images in memory.
+type fakeStore struct {
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func (s *fakeStore) Put(ctx context.Context, name string, body *bytes.Buffer) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[name] = body.String()
+	return "https://store.test/" + name, nil
+}
+
+// fakeEvents records the events sent, failing the first failures sends.
+// The first lost sends are recorded but still fail, as when the connection
+// drops before the commit is acknowledged.
+type fakeEvents struct {
+	mu       sync.Mutex
+	events   []string
+	sent     []uploader.Event
+	ids      map[string]bool
+	attempts int
+	failures int
+	lost     int
+	// sending is called before each send.
+	sending func()
+}
+
+func (e *fakeEvents) Send(ctx context.Context, events []uploader.Event) ([]bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.attempts++
+	if e.sending != nil {
+		e.sending()
+	}
+	if e.attempts <= e.failures {
+		return nil, errors.New("connection refused")
+	}
+	recorded := make([]bool, len(events))
+	for i, event := range events {
+		for _, id := range append([]string{event.ID}, event.PriorIDs...) {
+			recorded[i] = recorded[i] || e.ids[id]
+		}
+		if recorded[i] {
+			continue
+		}
+		e.ids[event.ID] = true
+		e.sent = append(e.sent, event)
+		e.events = append(e.events, fmt.Sprintf("%s %s@%s %s %s %s", event.Time.UTC().Format(time.RFC3339),
+			event.Camera, event.Site, event.Plate, event.PlateImage, event.FrameImage))
+	}
+	if e.attempts <= e.failures+e.lost {
+		return nil, errors.New("connection reset")
+	}
+	return recorded, nil
+}
+
+// harness runs the three stages over memory tubes, with fakes for everything
+// outside the process but the watched directory. Plates are deduped in
+// memory.
+type harness struct {
+	root       string
+	dir        string
+	pending    *ledger.Ledger
+	recognizer *fakeRecognizer
+	store      *fakeStore
+	events     *fakeEvents
+	tubes      Tubes
+	cancel     context.CancelFunc
+	done       chan error
+}
+
+var initOnce sync.Once
+
+// initConfig parses every stage's config once, with the queue settled
+// quickly and failed jobs retried once straight away.
+func initConfig() {
+	initOnce.Do(func() {
+		shared := []string{"--http-addr=", "--reserve-timeout", "1", "--max-retries", "1", "--retry-delay", "0"}
+		watcherconfig.Init(append(shared, "--camera", "gate", "--site", "depot", "--min-size", "0", "--stable-ms", "50"))
+		detectorconfig.Init(shared)
+		uploaderconfig.Init(append(shared, "--s3-bucket", "test", "--s3-prefix", "events",
+			"--remote-postgres-host", "db.test", "--remote-postgres-pass", "test", "--local-postgres-pass", "test",
+			"--aws-access-key-id", "test", "--aws-secret-access-key", "test"))
+		if !testing.Verbose() {
+			logging.SetOutput(ioutil.Discard)
+		}
+	})
+}
+
+func start(t *testing.T, plates map[string][]string) *harness {
+	initConfig()
+	root, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &harness{
+		root:       root,
+		dir:        filepath.Join(root, "frames"),
+		recognizer: &fakeRecognizer{plates: plates, seen: make(chan string, 100)},
+		store:      &fakeStore{objects: make(map[string]string)},
+		events:     &fakeEvents{ids: make(map[string]bool)},
+		tubes:      Memory("motion_events", "detection_events", 2),
+		done:       make(chan error, 1),
+	}
+	if err := os.Mkdir(h.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ledgerDir := filepath.Join(root, "pending")
+	watcherconfig.Opts.WatchDir = h.dir
+	watcherconfig.Opts.LedgerDir = ledgerDir
+	detectorconfig.Opts.LedgerDir = ledgerDir
+	uploaderconfig.Opts.LedgerDir = ledgerDir
+	if h.pending, err = ledger.Open(ledgerDir); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := watcher.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := detector.NewWith(h.recognizer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := uploader.NewWith(uploader.Dependencies{
+		Images: fakeImages{},
+		Store:  h.store,
+		Events: h.events,
+		Recent: uploader.NewMemoryRecent(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctx context.Context
+	ctx, h.cancel = context.WithCancel(context.Background())
+	go func() {
+		h.done <- Run(ctx, w, d, u, h.tubes)
+	}()
+	return h
+}
+
+// write copies a fixture frame into the watched directory.
+func (h *harness) write(t *testing.T, name string) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "frames", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(h.dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// detect writes a frame and waits for it to reach the recognizer, so frames
+// are handled in the order a camera would write them.
+func (h *harness) detect(t *testing.T, name string) {
+	h.write(t, name)
+	select {
+	case seen := <-h.recognizer.seen:
+		if seen != name {
+			t.Fatalf("Expected %s recognised, got %s", name, seen)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %s to be recognised", name)
+	}
+}
+
+// stop shuts down the watcher and waits for the rest to drain.
+func (h *harness) stop(t *testing.T) {
+	h.cancel()
+	select {
+	case err := <-h.done:
+		if err != nil {
+			t.Fatal("Run:", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the pipeline to drain")
+	}
+	for _, tube := range []queue.Tube{h.tubes.MotionIn, h.tubes.DetectionIn} {
+		if buried := tube.(*queue.Memory).Buried(); len(buried) > 0 {
+			t.Errorf("Expected nothing buried in %s, got %q", tube.Name(), buried)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	h := start(t, map[string][]string{
+		"01-20160920135426-01.jpg": {"CA982063"},
+		"01-20160920135427-02.jpg": {"CA982063"},
+		"01-20160920135430-03.jpg": {},
+		"01-20160920135445-04.jpg": {"AB12CDE", "XY34ZZZ"},
+	})
+	defer os.RemoveAll(h.root)
+	// Excluded by the default filter rules, so never recognised.
+	h.write(t, "lastsnap.jpg")
+	for _, name := range []string{"01-20160920135426-01.jpg", "01-20160920135427-02.jpg", "01-20160920135430-03.jpg", "01-20160920135445-04.jpg"} {
+		h.detect(t, name)
+	}
+	h.stop(t)
+
+	// The second sighting of CA982063 is within the event interval, and the
+	// frame without a plate makes no event. Images are named after their
+	// event.
+	images := func(frame, plate string) string {
+		id := jobs.EventID("gate", frame, plate)
+		return "https://store.test/" + id + ".plate.jpg https://store.test/" + id + ".frame.jpg"
+	}
+	expected := []string{
+		"2016-09-20T13:54:26Z gate@depot CA982063 " + images("01-20160920135426-01.jpg", "CA982063"),
+		"2016-09-20T13:54:45Z gate@depot AB12CDE " + images("01-20160920135445-04.jpg", "AB12CDE"),
+		"2016-09-20T13:54:45Z gate@depot XY34ZZZ " + images("01-20160920135445-04.jpg", "XY34ZZZ"),
+	}
+	if !reflect.DeepEqual(h.events.events, expected) {
+		t.Errorf("Expected events:\n%q\ngot:\n%q", expected, h.events.events)
+	}
+	frame := jobs.EventID("gate", "01-20160920135426-01.jpg", "CA982063") + ".frame.jpg"
+	if body := h.store.objects[frame]; body != "thumbnail of 01-20160920135426-01.jpg" {
+		t.Errorf("Unexpected frame image %q", body)
+	}
+	if len(h.store.objects) != 6 {
+		t.Errorf("Expected 6 images stored, got %d", len(h.store.objects))
+	}
+
+	// Frames without plates are deleted, and nothing is left pinned.
+	for name, kept := range map[string]bool{
+		"01-20160920135426-01.jpg": true,
+		"01-20160920135430-03.jpg": false,
+		"01-20160920135445-04.jpg": true,
+	} {
+		file := filepath.Join(h.dir, name)
+		if _, err := os.Stat(file); (err == nil) != kept {
+			t.Errorf("Expected %s kept %t, got %v", name, kept, err)
+		}
+		if h.pending.Pending(file) {
+			t.Errorf("Expected %s no longer pending", name)
+		}
+	}
+}
+
+func TestPipelineRetriesEvents(t *testing.T) {
+	h := start(t, map[string][]string{
+		"01-20160920135426-01.jpg": {"CA982063"},
+	})
+	defer os.RemoveAll(h.root)
+	h.events.mu.Lock()
+	h.events.failures = 1
+	h.events.mu.Unlock()
+	h.detect(t, "01-20160920135426-01.jpg")
+	h.stop(t)
+
+	// The failed send is forgotten by the dedup, so the retry goes out.
+	if h.events.attempts != 2 || len(h.events.events) != 1 {
+		t.Errorf("Expected one event after two attempts, got %d after %d", len(h.events.events), h.events.attempts)
+	}
+}
+
+func TestPipelineRetriesRecordedEvents(t *testing.T) {
+	h := start(t, map[string][]string{
+		"01-20160920135426-01.jpg": {"CA982063"},
+	})
+	defer os.RemoveAll(h.root)
+	h.events.mu.Lock()
+	h.events.lost = 1
+	h.events.mu.Unlock()
+	h.detect(t, "01-20160920135426-01.jpg")
+	h.stop(t)
+
+	// The retry sends the event again, which is recognised by its id.
+	if h.events.attempts != 2 || len(h.events.events) != 1 {
+		t.Errorf("Expected one event after two attempts, got %d after %d", len(h.events.events), h.events.attempts)
+	}
+	if h.pending.Pending(filepath.Join(h.dir, "01-20160920135426-01.jpg")) {
+		t.Error("Expected the job finished")
+	}
+}
+
+func TestPipelineHashesPlates(t *testing.T) {
+	initConfig()
+	dir, err := ioutil.TempDir("", "plates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, pseudonym.MinKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	publicFile, privateFile := filepath.Join(dir, "plates.pub"), filepath.Join(dir, "plates.key")
+	ioutil.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644)
+	ioutil.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	keys, _ := pseudonym.ParseKeys([]string{"k1=a long enough secret"})
+	sealer, err := pseudonym.LoadSealer(publicFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaderconfig.Opts.PlateMode, uploaderconfig.Opts.Pseudonyms, uploaderconfig.Opts.Sealer = "hashed", keys, sealer
+	defer func() {
+		uploaderconfig.Opts.PlateMode, uploaderconfig.Opts.Pseudonyms, uploaderconfig.Opts.Sealer = "plain", nil, nil
+	}()
+	h := start(t, map[string][]string{
+		"01-20160920135426-01.jpg": {"CA982063"},
+		"01-20160920135427-02.jpg": {"CA982063"},
+	})
+	defer os.RemoveAll(h.root)
+	h.detect(t, "01-20160920135426-01.jpg")
+	h.detect(t, "01-20160920135427-02.jpg")
+	h.stop(t)
+
+	// The second sighting is deduped by its pseudonym.
+	if len(h.events.sent) != 1 {
+		t.Fatalf("Expected one event, got %q", h.events.events)
+	}
+	event := h.events.sent[0]
+	plate := keys.Pseudonym("CA982063")
+	id := keys.EventIDs(jobs.EventID("gate", "01-20160920135426-01.jpg", "CA982063"))[0]
+	if event.Plate != plate || event.ID != id || event.Candidates[0].Characters != plate {
+		t.Errorf("Expected plate %s and id %s, got %+v", plate, id, event)
+	}
+	// The plate crop and frame would both show the plate.
+	placeholder := uploaderconfig.Opts.PlaceholderImageURL
+	if len(h.store.objects) != 0 || event.PlateImage != placeholder || event.FrameImage != placeholder {
+		t.Errorf("Expected no images uploaded, got %v", h.store.objects)
+	}
+	opener, err := pseudonym.LoadOpener([]string{privateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := opener.Open(event.PlateSealed, event.Plate); err != nil || opened != "CA982063" {
+		t.Errorf("Expected the sealed plate to open as CA982063, got %q, %v", opened, err)
+	}
+}
+
+func TestPipelineRotatesPlateKeys(t *testing.T) {
+	initConfig()
+	old, _ := pseudonym.ParseKeys([]string{"k1=a long enough secret"})
+	keys, _ := pseudonym.ParseKeys([]string{"k2=the newest secret key", "k1=a long enough secret"})
+	uploaderconfig.Opts.PlateMode, uploaderconfig.Opts.Pseudonyms = "hashed", old
+	defer func() {
+		uploaderconfig.Opts.PlateMode, uploaderconfig.Opts.Pseudonyms = "plain", nil
+	}()
+	h := start(t, map[string][]string{
+		"01-20160920135426-01.jpg": {"CA982063"},
+	})
+	defer os.RemoveAll(h.root)
+	// The first send is recorded but reported lost, and the keys are
+	// rotated before the retry.
+	h.events.mu.Lock()
+	h.events.lost = 1
+	h.events.sending = func() {
+		uploaderconfig.Opts.Pseudonyms = keys
+	}
+	h.events.mu.Unlock()
+	h.detect(t, "01-20160920135426-01.jpg")
+	h.stop(t)
+
+	// The retry is recognised by its id under the old key.
+	if h.events.attempts != 2 || len(h.events.sent) != 1 {
+		t.Fatalf("Expected one event after two attempts, got %d after %d", len(h.events.sent), h.events.attempts)
+	}
+	if plate := old.Pseudonym("CA982063"); h.events.sent[0].Plate != plate {
+		t.Errorf("Expected the event recorded as %s, got %s", plate, h.events.sent[0].Plate)
+	}
+	if h.pending.Pending(filepath.Join(h.dir, "01-20160920135426-01.jpg")) {
+		t.Error("Expected the job finished")
+	}
+}
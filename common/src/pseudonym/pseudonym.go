@@ -0,0 +1,259 @@
+// Package pseudonym records plates as keyed hashes, for sites that may only
+// keep pseudonymous identifiers, and seals the plate text so that whoever
+// holds the private key can still read it back.
+package pseudonym
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Key is a secret plates are hashed with. Its ID is part of every pseudonym
+// made with it, so the key a pseudonym was made with can always be found.
+type Key struct {
+	ID     string
+	secret []byte
+}
+
+// Keys are the keys plates are hashed with. The first makes the pseudonyms
+// of new events, and the rest are the keys it replaced, kept so the events
+// hashed with them can still be matched.
+type Keys []Key
+
+// MinSecret is the shortest secret a key may have.
+const MinSecret = 16
+
+// ParseKeys reads keys given as id=secret, newest first. IDs are letters and
+// digits, and are upper cased, as plates are.
+func ParseKeys(entries []string) (Keys, error) {
+	var keys Keys
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, errors.New("plate keys must be given as id=secret")
+		}
+		id, secret := strings.ToUpper(entry[:i]), entry[i+1:]
+		if !alphanumeric(id) {
+			return nil, fmt.Errorf("plate key id %s must be letters and digits", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("plate key id %s is used twice", id)
+		}
+		seen[id] = true
+		if len(secret) < MinSecret {
+			return nil, fmt.Errorf("plate key %s must be at least %d characters", id, MinSecret)
+		}
+		keys = append(keys, Key{ID: id, secret: []byte(secret)})
+	}
+	return keys, nil
+}
+
+// mac is the HMAC of a value under the key. The purpose keeps a plate's
+// hash apart from an event id's.
+func (k Key) mac(purpose, value string) []byte {
+	h := hmac.New(sha256.New, k.secret)
+	h.Write([]byte(purpose + "\x00" + value))
+	return h.Sum(nil)[:16]
+}
+
+func (k Key) pseudonym(plate string) string {
+	return k.ID + ":" + strings.ToUpper(hex.EncodeToString(k.mac("plate", plate)))
+}
+
+// Pseudonym returns the plate's pseudonym under the newest key, as ID:HEX.
+// It is the same every time, so a car's events can still be grouped, but
+// can't be worked back to the plate without the key.
+func (k Keys) Pseudonym(plate string) string {
+	return k[0].pseudonym(plate)
+}
+
+// All returns the plate's pseudonym under each key, newest first.
+func (k Keys) All(plate string) []string {
+	all := make([]string, len(k))
+	for i, key := range k {
+		all[i] = key.pseudonym(plate)
+	}
+	return all
+}
+
+// Matches reports whether the pseudonym is the plate's, under whichever of
+// the keys it was made with.
+func (k Keys) Matches(pseudonym, plate string) bool {
+	i := strings.Index(pseudonym, ":")
+	if i <= 0 {
+		return false
+	}
+	for _, key := range k {
+		if key.ID == pseudonym[:i] {
+			return hmac.Equal([]byte(key.pseudonym(plate)), []byte(pseudonym))
+		}
+	}
+	return false
+}
+
+// EventIDs keys an event id under each key, newest first. Event ids are
+// hashes of the camera, frame and plate, which could otherwise be guessed
+// at until one gives the plate away.
+func (k Keys) EventIDs(id string) []string {
+	ids := make([]string, len(k))
+	for i, key := range k {
+		ids[i] = hex.EncodeToString(key.mac("event", id))
+	}
+	return ids
+}
+
+// Is reports whether s is a pseudonym rather than a plate.
+func Is(s string) bool {
+	i := strings.Index(s, ":")
+	if i <= 0 || !alphanumeric(s[:i]) || len(s)-i-1 != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s[i+1:])
+	return err == nil && strings.ToUpper(s) == s
+}
+
+func alphanumeric(s string) bool {
+	for _, c := range s {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// MinKeyBits is the smallest RSA key plates may be sealed with.
+const MinKeyBits = 2048
+
+// Sealer encrypts plates to an RSA public key, so that the Pis can seal
+// them without being able to open them again.
+type Sealer struct {
+	id  string
+	key *rsa.PublicKey
+}
+
+// LoadSealer reads the PEM public key in the file.
+func LoadSealer(file string) (*Sealer, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	var key *rsa.PublicKey
+	switch block.Type {
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("%s: not an RSA key", file)
+		}
+	case "RSA PUBLIC KEY":
+		if key, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s: expected a public key, found %s", file, block.Type)
+	}
+	if key.N.BitLen() < MinKeyBits {
+		return nil, fmt.Errorf("%s: key must be at least %d bits", file, MinKeyBits)
+	}
+	return &Sealer{id: keyID(key), key: key}, nil
+}
+
+// Seal encrypts the plate, bound to the pseudonym it is recorded under so
+// it can't be passed off as another event's, as keyid:base64. The key id
+// says which private key opens it.
+func (s *Sealer) Seal(plate, pseudonym string) (string, error) {
+	sealed, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, s.key, []byte(plate), []byte(pseudonym))
+	if err != nil {
+		return "", err
+	}
+	return s.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Opener opens sealed plates with any of its private keys, so plates sealed
+// before the Pis were given a new key can still be read.
+type Opener map[string]*rsa.PrivateKey
+
+// LoadOpener reads the PEM private keys in the files.
+func LoadOpener(files []string) (Opener, error) {
+	o := make(Opener)
+	for _, file := range files {
+		block, err := readPEM(file)
+		if err != nil {
+			return nil, err
+		}
+		var key *rsa.PrivateKey
+		switch block.Type {
+		case "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err)
+			}
+			var ok bool
+			if key, ok = parsed.(*rsa.PrivateKey); !ok {
+				return nil, fmt.Errorf("%s: not an RSA key", file)
+			}
+		case "RSA PRIVATE KEY":
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: expected a private key, found %s", file, block.Type)
+		}
+		o[keyID(&key.PublicKey)] = key
+	}
+	return o, nil
+}
+
+// Open decrypts a plate sealed under the pseudonym.
+func (o Opener) Open(sealed, pseudonym string) (string, error) {
+	i := strings.Index(sealed, ":")
+	if i <= 0 {
+		return "", errors.New("not a sealed plate")
+	}
+	key, ok := o[sealed[:i]]
+	if !ok {
+		return "", fmt.Errorf("no private key for key id %s", sealed[:i])
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed[i+1:])
+	if err != nil {
+		return "", errors.New("not a sealed plate")
+	}
+	plate, err := rsa.DecryptOAEP(sha256.New(), nil, key, data, []byte(pseudonym))
+	if err != nil {
+		return "", err
+	}
+	return string(plate), nil
+}
+
+// keyID names a public key by its fingerprint.
+func keyID(key *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(key)
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	return block, nil
+}
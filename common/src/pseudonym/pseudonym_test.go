@@ -0,0 +1,106 @@
+package pseudonym
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPseudonym(t *testing.T) {
+	old, err := ParseKeys([]string{"k1=an older secret key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ParseKeys([]string{"k2=the newest secret key", "k1=an older secret key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := keys.Pseudonym("CA982063")
+	if !Is(p) || p[:3] != "K2:" {
+		t.Errorf("Expected a pseudonym under K2, got %s", p)
+	}
+	if keys.Pseudonym("CA982063") != p || keys.Pseudonym("CA982064") == p {
+		t.Error("Expected the same pseudonym for a plate, and another for another plate")
+	}
+	// Events hashed before the key was replaced still match.
+	before := old.Pseudonym("CA982063")
+	if before == p || !keys.Matches(before, "CA982063") || !keys.Matches(p, "CA982063") {
+		t.Errorf("Expected %s and %s to match the plate", before, p)
+	}
+	if keys.Matches(p, "CA982064") || old.Matches(p, "CA982063") {
+		t.Error("Expected no match for another plate, or without the key")
+	}
+	if all := keys.All("CA982063"); len(all) != 2 || all[0] != p || all[1] != before {
+		t.Errorf("Expected [%s %s], got %v", p, before, all)
+	}
+	ids := keys.EventIDs("0123abcd")
+	if len(ids) != 2 || len(ids[0]) != 32 || ids[0] == ids[1] || ids[1] != old.EventIDs("0123abcd")[0] {
+		t.Errorf("Expected the event id keyed under each key, got %v", ids)
+	}
+	for _, plate := range []string{"CA982063", "K1:ABC", "K1:" + "0123456789abcdef0123456789abcdef"} {
+		if Is(plate) {
+			t.Errorf("Expected %s not to be taken for a pseudonym", plate)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	for _, entries := range [][]string{
+		{"secret only"},
+		{"k1=short"},
+		{"k-1=a long enough secret"},
+		{"k1=a long enough secret", "K1=another long secret"},
+	} {
+		if _, err := ParseKeys(entries); err == nil {
+			t.Errorf("Expected an error for %v", entries)
+		}
+	}
+}
+
+func TestSeal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pseudonym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, MinKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	publicFile := filepath.Join(dir, "plates.pub")
+	privateFile := filepath.Join(dir, "plates.key")
+	ioutil.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644)
+	ioutil.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+
+	sealer, err := LoadSealer(publicFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opener, err := LoadOpener([]string{privateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealer.Seal("CA982063", "K1:0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plate, err := opener.Open(sealed, "K1:0123"); err != nil || plate != "CA982063" {
+		t.Errorf("Expected CA982063, got %q, %v", plate, err)
+	}
+	// A sealed plate copied to another event doesn't open.
+	if _, err := opener.Open(sealed, "K1:4567"); err == nil {
+		t.Error("Expected an error opening under another pseudonym")
+	}
+	if _, err := (Opener{}).Open(sealed, "K1:0123"); err == nil {
+		t.Error("Expected an error without the private key")
+	}
+	if _, err := LoadSealer(privateFile); err == nil {
+		t.Error("Expected an error sealing with a private key file")
+	}
+}
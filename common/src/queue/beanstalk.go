@@ -0,0 +1,154 @@
+package queue
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// Beanstalk is a Tube on beanstalkd. It connects when first used, and again
+// after a connection error, so callers only need to back off and retry.
+type Beanstalk struct {
+	Addr     string
+	Priority uint32
+	TTR      time.Duration
+
+	name    string
+	mu      sync.Mutex
+	conn    *beanstalk.Conn
+	tube    *beanstalk.Tube
+	tubeSet *beanstalk.TubeSet
+}
+
+// NewBeanstalk returns the named tube on the beanstalkd at addr. Jobs are put
+// with the priority and time-to-run given.
+func NewBeanstalk(addr string, name string, priority uint32, ttr time.Duration) *Beanstalk {
+	return &Beanstalk{Addr: addr, Priority: priority, TTR: ttr, name: name}
+}
+
+// Name is the tube's name.
+func (b *Beanstalk) Name() string {
+	return b.name
+}
+
+// connect returns the connection, dialling if need be. Call with mu held.
+func (b *Beanstalk) connect() (*beanstalk.Conn, error) {
+	if b.conn != nil {
+		return b.conn, nil
+	}
+	conn, err := beanstalk.Dial("tcp", b.Addr)
+	if err != nil {
+		return nil, err
+	}
+	b.conn = conn
+	b.tube = &beanstalk.Tube{Conn: conn, Name: b.name}
+	b.tubeSet = beanstalk.NewTubeSet(conn, b.name)
+	return conn, nil
+}
+
+// check translates beanstalk errors, and drops the connection when it has
+// failed so the next call reconnects. Call with mu held.
+func (b *Beanstalk) check(err error) error {
+	if err == nil {
+		return nil
+	}
+	if connErr, ok := err.(beanstalk.ConnError); ok {
+		switch connErr.Err {
+		case beanstalk.ErrTimeout:
+			return ErrTimeout
+		case beanstalk.ErrNotFound:
+			return ErrNotFound
+		case beanstalk.ErrBuried, beanstalk.ErrDraining, beanstalk.ErrJobTooBig, beanstalk.ErrDeadline:
+			return err
+		}
+	}
+	b.closeConn()
+	return err
+}
+
+func (b *Beanstalk) closeConn() {
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+}
+
+// Put adds a job to the tube.
+func (b *Beanstalk) Put(body []byte) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.connect(); err != nil {
+		return 0, err
+	}
+	id, err := b.tube.Put(body, b.Priority, 0, b.TTR)
+	return id, b.check(err)
+}
+
+// Reserve takes the next job from the tube.
+func (b *Beanstalk) Reserve(timeout time.Duration) (uint64, []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.connect(); err != nil {
+		return 0, nil, err
+	}
+	id, body, err := b.tubeSet.Reserve(timeout)
+	return id, body, b.check(err)
+}
+
+// Delete finishes a reserved job.
+func (b *Beanstalk) Delete(id uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn, err := b.connect()
+	if err != nil {
+		return err
+	}
+	return b.check(conn.Delete(id))
+}
+
+// Release hands a reserved job back to be retried after delay.
+func (b *Beanstalk) Release(id uint64, delay time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn, err := b.connect()
+	if err != nil {
+		return err
+	}
+	return b.check(conn.Release(id, b.Priority, delay))
+}
+
+// Bury sets a reserved job aside, for the dlq tool.
+func (b *Beanstalk) Bury(id uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn, err := b.connect()
+	if err != nil {
+		return err
+	}
+	return b.check(conn.Bury(id, b.Priority))
+}
+
+// Releases is how many times beanstalkd has seen the job released.
+func (b *Beanstalk) Releases(id uint64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn, err := b.connect()
+	if err != nil {
+		return 0, err
+	}
+	stats, err := conn.StatsJob(id)
+	if err != nil {
+		return 0, b.check(err)
+	}
+	return strconv.Atoi(stats["releases"])
+}
+
+// Close drops the connection.
+func (b *Beanstalk) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closeConn()
+	return nil
+}
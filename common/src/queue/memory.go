@@ -0,0 +1,207 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+// memoryJob is a job in a Memory tube.
+type memoryJob struct {
+	id       uint64
+	body     []byte
+	releases int
+}
+
+// Memory is a Tube on a bounded channel, for stages running in one process.
+// Put blocks while the buffer is full, so a slow stage holds back the one
+// feeding it rather than letting work pile up in memory. Jobs don't survive
+// the process, and buried jobs are only kept for Buried.
+type Memory struct {
+	name  string
+	ready chan memoryJob
+
+	mu       sync.Mutex
+	nextID   uint64
+	reserved map[uint64]memoryJob
+	buried   []memoryJob
+	delayed  int
+	closed   bool
+	done     chan struct{}
+}
+
+// NewMemory returns a tube holding up to size jobs ready to be reserved.
+func NewMemory(name string, size int) *Memory {
+	return &Memory{
+		name:     name,
+		ready:    make(chan memoryJob, size),
+		reserved: make(map[uint64]memoryJob),
+		done:     make(chan struct{}),
+	}
+}
+
+// Name is the tube's name.
+func (m *Memory) Name() string {
+	return m.name
+}
+
+// Put adds a job, blocking while the tube is full.
+func (m *Memory) Put(body []byte) (uint64, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return 0, ErrClosed
+	}
+	m.nextID++
+	job := memoryJob{id: m.nextID, body: body}
+	m.mu.Unlock()
+
+	select {
+	case m.ready <- job:
+		return job.id, nil
+	case <-m.done:
+		return 0, ErrClosed
+	}
+}
+
+// Reserve takes the next job. Once the tube is closed, and has nothing ready
+// or waiting to be retried, it returns ErrClosed.
+func (m *Memory) Reserve(timeout time.Duration) (uint64, []byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case job := <-m.ready:
+			m.mu.Lock()
+			m.reserved[job.id] = job
+			m.mu.Unlock()
+			return job.id, job.body, nil
+		case <-timer.C:
+			return 0, nil, ErrTimeout
+		case <-m.done:
+			if m.drained() {
+				return 0, nil, ErrClosed
+			}
+			// Jobs are still on their way back from Release.
+			select {
+			case job := <-m.ready:
+				m.mu.Lock()
+				m.reserved[job.id] = job
+				m.mu.Unlock()
+				return job.id, job.body, nil
+			case <-timer.C:
+				return 0, nil, ErrTimeout
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// drained reports whether nothing more can be reserved.
+func (m *Memory) drained() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.ready) == 0 && m.delayed == 0
+}
+
+// take removes a reserved job.
+func (m *Memory) take(id uint64) (memoryJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.reserved[id]
+	if !ok {
+		return job, ErrNotFound
+	}
+	delete(m.reserved, id)
+	return job, nil
+}
+
+// Delete finishes a reserved job.
+func (m *Memory) Delete(id uint64) error {
+	_, err := m.take(id)
+	return err
+}
+
+// Release hands a reserved job back to be reserved again after delay.
+func (m *Memory) Release(id uint64, delay time.Duration) error {
+	job, err := m.take(id)
+	if err != nil {
+		return err
+	}
+	job.releases++
+	m.mu.Lock()
+	m.delayed++
+	m.mu.Unlock()
+	time.AfterFunc(delay, func() {
+		// Returning jobs skip the closed check, so a drain still retries
+		// them. Once the tube is closed, a job with no room to come back
+		// to is buried rather than waiting on a reader that may be gone.
+		buried := false
+		select {
+		case m.ready <- job:
+		case <-m.done:
+			select {
+			case m.ready <- job:
+			default:
+				buried = true
+			}
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if buried {
+			m.buried = append(m.buried, job)
+		}
+		m.delayed--
+	})
+	return nil
+}
+
+// Bury sets a reserved job aside.
+func (m *Memory) Bury(id uint64) error {
+	job, err := m.take(id)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buried = append(m.buried, job)
+	return nil
+}
+
+// Releases is how many times the job has been released.
+func (m *Memory) Releases(id uint64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.reserved[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return job.releases, nil
+}
+
+// Len is how many jobs are ready to be reserved.
+func (m *Memory) Len() int {
+	return len(m.ready)
+}
+
+// Buried returns the bodies of the buried jobs.
+func (m *Memory) Buried() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var bodies [][]byte
+	for _, job := range m.buried {
+		bodies = append(bodies, job.body)
+	}
+	return bodies
+}
+
+// Close stops the tube taking new jobs. Those already in it can still be
+// reserved, after which Reserve returns ErrClosed.
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.done)
+	}
+	return nil
+}
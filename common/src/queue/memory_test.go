@@ -0,0 +1,107 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	tube := NewMemory("motion_events", 2)
+	for _, body := range []string{"a", "b"} {
+		if _, err := tube.Put([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The buffer is full, so the next put waits for a reserve.
+	put := make(chan uint64)
+	go func() {
+		id, _ := tube.Put([]byte("c"))
+		put <- id
+	}()
+	select {
+	case <-put:
+		t.Fatal("Expected put to block on a full tube")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	id, body, err := tube.Reserve(time.Second)
+	if err != nil || string(body) != "a" {
+		t.Fatalf("Unexpected job: %d %q %v", id, body, err)
+	}
+	if id := <-put; id != 3 {
+		t.Error("Expected the blocked put to go through, got id", id)
+	}
+
+	// Released jobs come back with their count.
+	if err := tube.Release(id, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tube.Delete(id); err != ErrNotFound {
+		t.Error("Expected a released job to no longer be reserved:", err)
+	}
+	seen := map[string]uint64{}
+	for i := 0; i < 3; i++ {
+		id, body, err := tube.Reserve(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[string(body)] = id
+	}
+	if releases, _ := tube.Releases(seen["a"]); releases != 1 {
+		t.Error("Expected one release, got", releases)
+	}
+
+	tube.Bury(seen["a"])
+	tube.Delete(seen["b"])
+	tube.Delete(seen["c"])
+	if buried := tube.Buried(); len(buried) != 1 || string(buried[0]) != "a" {
+		t.Errorf("Unexpected buried jobs: %q", buried)
+	}
+
+	if _, _, err := tube.Reserve(10 * time.Millisecond); err != ErrTimeout {
+		t.Error("Expected a timeout on an empty tube:", err)
+	}
+}
+
+func TestMemoryClose(t *testing.T) {
+	tube := NewMemory("detection_events", 10)
+	tube.Put([]byte("a"))
+	tube.Close()
+
+	if _, err := tube.Put([]byte("b")); err != ErrClosed {
+		t.Error("Expected a closed tube to refuse jobs:", err)
+	}
+	id, body, err := tube.Reserve(time.Second)
+	if err != nil || string(body) != "a" {
+		t.Fatalf("Expected the job put before closing: %q %v", body, err)
+	}
+
+	// A job released during the drain is retried before the tube ends.
+	tube.Release(id, 20*time.Millisecond)
+	if _, body, err := tube.Reserve(time.Second); err != nil || string(body) != "a" {
+		t.Fatalf("Expected the released job back: %q %v", body, err)
+	}
+	if _, _, err := tube.Reserve(time.Second); err != ErrClosed {
+		t.Error("Expected the drained tube to report closed:", err)
+	}
+}
+
+func TestMemoryReleaseFullClosed(t *testing.T) {
+	tube := NewMemory("detection_events", 1)
+	tube.Put([]byte("a"))
+	id, _, _ := tube.Reserve(time.Second)
+	tube.Put([]byte("b"))
+	tube.Close()
+
+	// With no room to come back to and nobody reserving, the released job
+	// is buried rather than left waiting.
+	tube.Release(id, 0)
+	deadline := time.Now().Add(time.Second)
+	for len(tube.Buried()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if buried := tube.Buried(); len(buried) != 1 || string(buried[0]) != "a" {
+		t.Errorf("Expected the released job to be buried, got %q", buried)
+	}
+}
@@ -0,0 +1,36 @@
+package queue
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrTimeout is returned by Reserve when no job arrived in time.
+	ErrTimeout = errors.New("queue: timeout")
+	// ErrClosed is returned once a closed tube has no jobs left.
+	ErrClosed = errors.New("queue: closed")
+	// ErrNotFound is returned for a job the tube doesn't have reserved.
+	ErrNotFound = errors.New("queue: job not found")
+)
+
+// Tube is a queue of jobs between two stages: a beanstalkd tube when they run
+// as separate processes, or a channel when they run in one.
+type Tube interface {
+	// Name is the tube's name, for logs and metrics.
+	Name() string
+	// Put adds a job, returning its id.
+	Put(body []byte) (uint64, error)
+	// Reserve takes the next job, waiting up to timeout for one.
+	Reserve(timeout time.Duration) (id uint64, body []byte, err error)
+	// Delete finishes a reserved job.
+	Delete(id uint64) error
+	// Release hands a reserved job back to be retried after delay.
+	Release(id uint64, delay time.Duration) error
+	// Bury sets a reserved job aside until someone looks at it.
+	Bury(id uint64) error
+	// Releases is how many times the job has been released.
+	Releases(id uint64) (int, error)
+	// Close releases the tube's resources.
+	Close() error
+}
@@ -0,0 +1,488 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"detector"
+	detectorconfig "detector/config"
+	"jobs"
+	"logging"
+	"queue"
+	"settings"
+	"shutdown"
+	"uploader"
+	uploaderconfig "uploader/config"
+	"uploader/timestamp"
+	"watcher/camera"
+	watcherconfig "watcher/config"
+	"watcher/filter"
+
+	"github.com/openalpr/openalpr"
+)
+
+var logger = logging.With("service", "replay")
+
+// Options for replaying archived frames. They are read from the "replay"
+// section of the config file, and the stages read their own sections.
+type Options struct {
+	settings.Common
+
+	From             string  `long:"from" env:"REPLAY_FROM" description:"Earliest frame to replay, as 2006-01-02 or RFC 3339"`
+	To               string  `long:"to" env:"REPLAY_TO" description:"Latest frame to replay, a date includes the whole day"`
+	Rate             float64 `long:"rate" env:"REPLAY_RATE" default:"0" description:"Frames per second at most, 0 for as fast as ALPR goes"`
+	Upload           bool    `long:"upload" description:"Send events for the plates found through the uploader"`
+	DryRun           bool    `long:"dry-run" description:"With --upload, make the images and events but don't store or send them"`
+	FilenameTemplate string  `long:"filename-template" env:"REPLAY_FILENAME_TEMPLATE" default:"%v-%Y%m%d%H%M%S-%q" description:"Motion picture_filename or Go time layout"`
+	CameraTimezone   string  `long:"camera-timezone" env:"REPLAY_CAMERA_TIMEZONE" default:"UTC"`
+	Args             struct {
+		Dirs []string `positional-arg-name:"dir" required:"1" description:"dir=camera@site, camera and site default to the watcher's"`
+	} `positional-args:"yes"`
+
+	from time.Time
+	to   time.Time
+}
+
+// Validate checks the options make sense together.
+func (o *Options) Validate() error {
+	loc, err := time.LoadLocation(o.CameraTimezone)
+	if err != nil {
+		return err
+	}
+	if o.from, err = parseBound(o.From, loc, false); err != nil {
+		return fmt.Errorf("from: %s", err)
+	}
+	if o.to, err = parseBound(o.To, loc, true); err != nil {
+		return fmt.Errorf("to: %s", err)
+	}
+	switch {
+	case !o.from.IsZero() && !o.to.IsZero() && !o.from.Before(o.to):
+		return errors.New("from must be before to")
+	case o.Rate < 0:
+		return errors.New("rate must not be negative")
+	case o.DryRun && !o.Upload:
+		return errors.New("dry-run only applies with upload, without it nothing is sent anyway")
+	}
+	return o.Common.Validate()
+}
+
+// parseBound parses a date or time. The end of a range given as a date is
+// the start of the next day.
+func parseBound(value string, loc *time.Location, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Frame is an archived image to replay.
+type Frame struct {
+	Path   string
+	Time   time.Time
+	Source camera.Source
+}
+
+// Find walks the sources' directories for frames the rules match taken in
+// [from, to), oldest first. A zero from or to leaves that end open.
+func Find(sources camera.Sources, rules *filter.Rules, parser *timestamp.Parser, from time.Time, to time.Time) ([]Frame, error) {
+	var frames []Frame
+	seen := make(map[string]bool)
+	for _, source := range sources {
+		err := filepath.Walk(source.Dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || seen[path] || !rules.MatchName(path) {
+				return nil
+			}
+			seen[path] = true
+			t, using, err := parser.Parse(path)
+			if t.IsZero() {
+				logger.Warn("No time for frame, skipping", "file", path, "err", err)
+				return nil
+			} else if err != nil {
+				logger.Debug("Frame time", "file", path, "using", using, "err", err)
+			}
+			if (!from.IsZero() && t.Before(from)) || (!to.IsZero() && !t.Before(to)) {
+				return nil
+			}
+			// A nested camera directory claims its own frames.
+			frame := Frame{Path: path, Time: t, Source: source}
+			if s, ok := sources.Lookup(path); ok {
+				frame.Source = s
+			}
+			frames = append(frames, frame)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(frames, func(i, j int) bool {
+		if !frames[i].Time.Equal(frames[j].Time) {
+			return frames[i].Time.Before(frames[j].Time)
+		}
+		return frames[i].Path < frames[j].Path
+	})
+	return frames, nil
+}
+
+// PlateSummary is what a replay found for one plate.
+type PlateSummary struct {
+	Plate      string
+	Sightings  int
+	Cameras    map[string]bool
+	First      time.Time
+	Last       time.Time
+	Confidence float32
+}
+
+// Report tallies what a replay found. It is safe to use from the stages'
+// goroutines.
+type Report struct {
+	mu         sync.Mutex
+	Frames     int
+	Fed        int
+	WithPlates int
+	Failed     int
+	Events     int
+	Recorded   int
+	Buried     int
+	Plates     map[string]*PlateSummary
+}
+
+// NewReport returns an empty report for the frames.
+func NewReport(frames int) *Report {
+	return &Report{Frames: frames, Plates: make(map[string]*PlateSummary)}
+}
+
+// Recognised adds a frame's recognition results, or its error.
+func (r *Report) Recognised(frame Frame, results openalpr.AlprResults, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.Failed++
+		return
+	}
+	if len(results.Plates) > 0 {
+		r.WithPlates++
+	}
+	for _, plate := range results.Plates {
+		summary, ok := r.Plates[plate.BestPlate]
+		if !ok {
+			summary = &PlateSummary{Plate: plate.BestPlate, Cameras: make(map[string]bool), First: frame.Time}
+			r.Plates[plate.BestPlate] = summary
+		}
+		summary.Sightings++
+		summary.Cameras[frame.Source.Camera] = true
+		if frame.Time.Before(summary.First) {
+			summary.First = frame.Time
+		}
+		if frame.Time.After(summary.Last) {
+			summary.Last = frame.Time
+		}
+		for _, candidate := range plate.TopNPlates {
+			if candidate.Characters == plate.BestPlate && candidate.OverallConfidence > summary.Confidence {
+				summary.Confidence = candidate.OverallConfidence
+			}
+		}
+	}
+}
+
+// Sent counts an event sent, or that would have been.
+func (r *Report) Sent() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Events++
+}
+
+// AlreadyRecorded counts an event sent before, by the live uploader or an
+// earlier replay.
+func (r *Report) AlreadyRecorded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Recorded++
+}
+
+// Print writes the summary and a line per plate, most seen first.
+func (r *Report) Print(w io.Writer, upload bool, dryRun bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sightings := 0
+	var plates []*PlateSummary
+	for _, summary := range r.Plates {
+		sightings += summary.Sightings
+		plates = append(plates, summary)
+	}
+	sort.Slice(plates, func(i, j int) bool {
+		if plates[i].Sightings != plates[j].Sightings {
+			return plates[i].Sightings > plates[j].Sightings
+		}
+		return plates[i].Plate < plates[j].Plate
+	})
+
+	fmt.Fprintf(w, "Frames:  %d replayed of %d, %d with plates, %d failed\n", r.Fed, r.Frames, r.WithPlates, r.Failed)
+	fmt.Fprintf(w, "Plates:  %d sightings of %d plates\n", sightings, len(plates))
+	if upload {
+		mode := "sent"
+		if dryRun {
+			mode = "would have been sent"
+		}
+		recorded := ""
+		if r.Recorded > 0 {
+			recorded = fmt.Sprintf(", %d already recorded", r.Recorded)
+		}
+		fmt.Fprintf(w, "Events:  %d %s%s, %d detections failed\n", r.Events, mode, recorded, r.Buried)
+	}
+	if len(plates) == 0 {
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nPLATE\tSIGHTINGS\tCAMERAS\tFIRST\tLAST\tCONFIDENCE")
+	for _, summary := range plates {
+		var cameras []string
+		for name := range summary.Cameras {
+			cameras = append(cameras, name)
+		}
+		sort.Strings(cameras)
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%.1f\n", summary.Plate, summary.Sightings, strings.Join(cameras, ","),
+			summary.First.Format("2006-01-02 15:04:05"), summary.Last.Format("2006-01-02 15:04:05"), summary.Confidence)
+	}
+	tw.Flush()
+}
+
+// recorder adds every recognition to the report.
+type recorder struct {
+	detector.Recognizer
+	frames map[string]Frame
+	report *Report
+}
+
+func (r recorder) RecognizeByFilePath(filePath string) (openalpr.AlprResults, error) {
+	results, err := r.Recognizer.RecognizeByFilePath(filePath)
+	r.report.Recognised(r.frames[filePath], results, err)
+	return results, err
+}
+
+// counter counts the events sent into the report.
+type counter struct {
+	uploader.EventSink
+	report *Report
+}
+
+func (c counter) Send(ctx context.Context, events []uploader.Event) ([]bool, error) {
+	recorded, err := c.EventSink.Send(ctx, events)
+	if err != nil {
+		return nil, err
+	}
+	for _, already := range recorded {
+		if already {
+			c.report.AlreadyRecorded()
+		} else {
+			c.report.Sent()
+		}
+	}
+	return recorded, nil
+}
+
+// dryRun stands in for the object store and event sink, logging what would
+// have been stored and sent.
+type dryRun struct{}
+
+func (dryRun) Put(ctx context.Context, name string, body *bytes.Buffer) (string, error) {
+	logger.Debug("Would store image", "name", name, "bytes", body.Len())
+	return "dry-run:" + name, nil
+}
+
+func (dryRun) Send(ctx context.Context, events []uploader.Event) ([]bool, error) {
+	for _, event := range events {
+		logger.Info("Would send event", "plate", event.Plate, "camera", event.Camera, "site", event.Site, "time", event.Time)
+	}
+	return make([]bool, len(events)), nil
+}
+
+// feed puts a motion event for each frame on out, at most rate a second,
+// until ctx is cancelled. It returns how many were put.
+func feed(ctx context.Context, frames []Frame, out queue.Tube, rate float64) int {
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for i, frame := range frames {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return i
+		}
+		body, _ := json.Marshal(jobs.MotionEvent{
+			CorrelationID: jobs.NewCorrelationID(),
+			Filename:      frame.Path,
+			Camera:        frame.Source.Camera,
+			Site:          frame.Source.Site,
+		})
+		if _, err := out.Put(body); err != nil {
+			logger.Error("Queue put", "err", err)
+			return i
+		}
+	}
+	return len(frames)
+}
+
+// discard deletes the detection events when nothing is being uploaded.
+func discard(in queue.Tube) {
+	for {
+		id, _, err := in.Reserve(time.Second)
+		if err == queue.ErrClosed {
+			return
+		}
+		if err == nil {
+			in.Delete(id)
+		}
+	}
+}
+
+// Main runs a replay and returns its exit code.
+func Main(args []string) int {
+	var opts Options
+	if err := settings.Parse("replay", &opts, args); err != nil {
+		log.Println(err)
+		return 1
+	}
+	// The stages only take the config file, their settings being in its
+	// sections and the env.
+	var stageArgs []string
+	if opts.ConfigFile != "" {
+		stageArgs = []string{"--config", opts.ConfigFile}
+	}
+	watcherconfig.Init(stageArgs)
+	detectorconfig.Init(stageArgs)
+	if opts.Upload {
+		uploaderconfig.Init(stageArgs)
+	}
+	if err := opts.SetupLogging("replay"); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	// A replay runs alongside the live services, so it keeps off their
+	// ports, ledger and dead letters. Failures are reported, not retried.
+	detectorconfig.Opts.HTTPAddr = ""
+	detectorconfig.Opts.LedgerDir = ""
+	detectorconfig.Opts.DeadLetterDir = ""
+	detectorconfig.Opts.MaxRetries = 0
+	uploaderconfig.Opts.HTTPAddr = ""
+	uploaderconfig.Opts.LedgerDir = ""
+	uploaderconfig.Opts.DeadLetterDir = ""
+	uploaderconfig.Opts.MaxRetries = 0
+
+	sources, err := camera.ParseSources(opts.Args.Dirs, watcherconfig.Opts.Camera, watcherconfig.Opts.Site)
+	if err != nil {
+		logger.Error("Dirs", "err", err)
+		return 1
+	}
+	rules, err := filter.NewRules(watcherconfig.Opts.Include, watcherconfig.Opts.Exclude)
+	if err != nil {
+		logger.Error("Filter rules", "err", err)
+		return 1
+	}
+	parser, err := timestamp.NewParser(opts.FilenameTemplate, opts.CameraTimezone, []string{timestamp.FromExif, timestamp.FromMtime})
+	if err != nil {
+		logger.Error("Timestamp", "err", err)
+		return 1
+	}
+	frames, err := Find(sources, rules, parser, opts.from, opts.to)
+	if err != nil {
+		logger.Error("Find frames", "err", err)
+		return 1
+	}
+	logger.Info("Replaying", "frames", len(frames), "from", opts.From, "to", opts.To, "rate", opts.Rate,
+		"upload", opts.Upload, "dry_run", opts.DryRun)
+	report := NewReport(len(frames))
+	byPath := make(map[string]Frame, len(frames))
+	for _, frame := range frames {
+		byPath[frame.Path] = frame
+	}
+
+	alpr, err := detector.LoadAlpr()
+	if err != nil {
+		logger.Error("Startup", "err", err)
+		return 1
+	}
+	defer alpr.Unload()
+	d, err := detector.NewWith(recorder{Recognizer: alpr, frames: byPath, report: report})
+	if err != nil {
+		logger.Error("Startup", "err", err)
+		return 1
+	}
+	d.KeepFrames = true
+
+	var u *uploader.Uploader
+	if opts.Upload {
+		deps := uploader.Dependencies{Images: uploader.Magick{}, Store: dryRun{}, Events: dryRun{}}
+		if !opts.DryRun {
+			if deps, err = uploader.Connect(); err != nil {
+				logger.Error("Startup", "err", err)
+				return 1
+			}
+			// Old frames would overwrite the live last seen markers.
+			deps.Recent.(io.Closer).Close()
+		}
+		defer deps.Close()
+		deps.Recent = uploader.NewMemoryRecent()
+		deps.Events = counter{EventSink: deps.Events, report: report}
+		if u, err = uploader.NewWith(deps); err != nil {
+			logger.Error("Startup", "err", err)
+			return 1
+		}
+	}
+
+	// SIGINT stops feeding frames, and those already queued are finished.
+	ctx := shutdown.OnSignal(opts.ShutdownTimeout())
+	motion := queue.NewMemory(opts.MotionTube, 10)
+	detections := queue.NewMemory(opts.DetectionTube, 10)
+	go func() {
+		defer motion.Close()
+		fed := feed(ctx, frames, motion, opts.Rate)
+		report.mu.Lock()
+		report.Fed = fed
+		report.mu.Unlock()
+	}()
+	go func() {
+		defer detections.Close()
+		d.Run(context.Background(), motion, detections)
+	}()
+	if u != nil {
+		u.Run(context.Background(), detections)
+	} else {
+		discard(detections)
+	}
+	report.Buried = len(detections.Buried())
+
+	report.Print(os.Stdout, opts.Upload, opts.DryRun)
+	return 0
+}
@@ -0,0 +1,142 @@
+package replay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"uploader/timestamp"
+	"watcher/camera"
+	"watcher/filter"
+
+	"github.com/openalpr/openalpr"
+)
+
+func TestFind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"gate/01-20160920135445-04.jpg",
+		"gate/01-20160920135426-01.jpg",
+		"gate/lastsnap.jpg",
+		"gate/notes.txt",
+		"gate/01-20160919235959-01.jpg",
+		"gate/exit/02-20160920101500-01.jpg",
+		"gate/01-20160921000000-01.jpg",
+	} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte("jpeg"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sources, err := camera.ParseSources([]string{filepath.Join(dir, "gate") + "=gate@depot", filepath.Join(dir, "gate/exit") + "=exit"}, "lpr-camera", "lpr-site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := filter.NewRules([]string{"*.jpg"}, []string{"lastsnap.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, err := timestamp.NewParser("%v-%Y%m%d%H%M%S-%q", "UTC", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := time.UTC
+	from, _ := parseBound("2016-09-20", loc, false)
+	to, _ := parseBound("2016-09-20", loc, true)
+	frames, err := Find(sources, rules, parser, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Just the 20th, oldest first, with the nested directory's frame found
+	// once under its own camera.
+	expected := []string{
+		"gate/exit/02-20160920101500-01.jpg exit@lpr-site",
+		"gate/01-20160920135426-01.jpg gate@depot",
+		"gate/01-20160920135445-04.jpg gate@depot",
+	}
+	var found []string
+	for _, frame := range frames {
+		rel, _ := filepath.Rel(dir, frame.Path)
+		found = append(found, rel+" "+frame.Source.Camera+"@"+frame.Source.Site)
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected frames:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+}
+
+func TestParseBound(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		value    string
+		end      bool
+		expected string
+	}{
+		{"2016-09-20", false, "2016-09-19T23:00:00Z"},
+		{"2016-09-20", true, "2016-09-20T23:00:00Z"},
+		{"2016-09-20T13:54:26Z", true, "2016-09-20T13:54:26Z"},
+	}
+	for _, test := range tests {
+		bound, err := parseBound(test.value, london, test.end)
+		if err != nil || bound.UTC().Format(time.RFC3339) != test.expected {
+			t.Errorf("%s: expected %s, got %s %v", test.value, test.expected, bound.UTC().Format(time.RFC3339), err)
+		}
+	}
+	if _, err := parseBound("yesterday", london, false); err == nil {
+		t.Error("Expected an error for an unparseable bound")
+	}
+}
+
+func TestReport(t *testing.T) {
+	report := NewReport(4)
+	report.Fed = 4
+	at := func(s string) time.Time {
+		t, _ := time.Parse(time.RFC3339, s)
+		return t
+	}
+	plate := func(best string, confidence float32) openalpr.AlprPlateResult {
+		return openalpr.AlprPlateResult{BestPlate: best, TopNPlates: []openalpr.AlprPlate{{Characters: best, OverallConfidence: confidence}}}
+	}
+	gate := camera.Source{Camera: "gate"}
+	report.Recognised(Frame{Time: at("2016-09-20T13:54:45Z"), Source: gate},
+		openalpr.AlprResults{Plates: []openalpr.AlprPlateResult{plate("CA982063", 91.5), plate("AB12CDE", 80)}}, nil)
+	report.Recognised(Frame{Time: at("2016-09-20T13:54:26Z"), Source: camera.Source{Camera: "exit"}},
+		openalpr.AlprResults{Plates: []openalpr.AlprPlateResult{plate("CA982063", 88)}}, nil)
+	report.Recognised(Frame{Time: at("2016-09-20T13:55:00Z"), Source: gate}, openalpr.AlprResults{}, nil)
+	report.Recognised(Frame{Source: gate}, openalpr.AlprResults{}, os.ErrNotExist)
+	report.Sent()
+
+	var out bytes.Buffer
+	report.Print(&out, true, true)
+	expected := `Frames:  4 replayed of 4, 2 with plates, 1 failed
+Plates:  3 sightings of 2 plates
+Events:  1 would have been sent, 0 detections failed
+
+PLATE     SIGHTINGS  CAMERAS    FIRST                LAST                 CONFIDENCE
+CA982063  2          exit,gate  2016-09-20 13:54:26  2016-09-20 13:54:45  91.5
+AB12CDE   1          gate       2016-09-20 13:54:45  2016-09-20 13:54:45  80.0
+`
+	if out.String() != expected {
+		t.Errorf("Expected report:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	report.AlreadyRecorded()
+	out.Reset()
+	report.Print(&out, true, false)
+	if !strings.Contains(out.String(), "Events:  1 sent, 1 already recorded, 0 detections failed\n") {
+		t.Errorf("Expected the events already recorded counted, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,101 @@
+// Package reports runs jobs once a day and writes the files they produce to
+// a local directory or an S3 bucket.
+package reports
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Next is when a job run daily at the time of day at, as HH:MM in loc, is
+// next due after now.
+func Next(now time.Time, at string, loc *time.Location) time.Time {
+	clock, _ := time.Parse("15:04", at)
+	now = now.In(loc)
+	due := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, loc)
+	if !due.After(now) {
+		due = time.Date(now.Year(), now.Month(), now.Day()+1, clock.Hour(), clock.Minute(), 0, 0, loc)
+	}
+	return due
+}
+
+// Daily runs job each day at the time schedule gives, until ctx is
+// cancelled. The schedule is asked again after each run, so it may change
+// on a reload.
+func Daily(ctx context.Context, schedule func() (string, *time.Location), job func(ctx context.Context, due time.Time)) {
+	for {
+		at, loc := schedule()
+		due := Next(time.Now(), at, loc)
+		select {
+		case <-time.After(time.Until(due)):
+		case <-ctx.Done():
+			return
+		}
+		job(ctx, due)
+	}
+}
+
+// Sink is where reports are written. Put returns where the report can be
+// found.
+type Sink interface {
+	Put(ctx context.Context, name string, body []byte) (string, error)
+}
+
+// Dir writes reports to a local directory. A report only appears once it is
+// complete.
+type Dir string
+
+// Put writes the report to name in the directory.
+func (d Dir) Put(ctx context.Context, name string, body []byte) (string, error) {
+	f, err := ioutil.TempFile(string(d), ".report-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return "", err
+	}
+	target := filepath.Join(string(d), name)
+	return target, os.Rename(f.Name(), target)
+}
+
+// S3 uploads reports to a bucket, under the prefix.
+type S3 struct {
+	Uploader *s3manager.Uploader
+	Bucket   string
+	Prefix   string
+}
+
+// Put uploads the report as prefix/name.
+func (s S3) Put(ctx context.Context, name string, body []byte) (string, error) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	res, err := s.Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(path.Join(s.Prefix, name)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", err
+	}
+	return res.Location, nil
+}
@@ -0,0 +1,72 @@
+package reports
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		now, expected time.Time
+	}{
+		{time.Date(2016, 9, 20, 0, 30, 0, 0, london), time.Date(2016, 9, 20, 1, 0, 0, 0, london)},
+		{time.Date(2016, 9, 20, 1, 0, 0, 0, london), time.Date(2016, 9, 21, 1, 0, 0, 0, london)},
+		{time.Date(2016, 9, 20, 23, 0, 0, 0, time.UTC), time.Date(2016, 9, 21, 1, 0, 0, 0, london)},
+		// The clocks go back on the 30th.
+		{time.Date(2016, 10, 29, 12, 0, 0, 0, london), time.Date(2016, 10, 30, 1, 0, 0, 0, london)},
+	}
+	for _, test := range tests {
+		if due := Next(test.now, "01:00", london); !due.Equal(test.expected) {
+			t.Errorf("%s: expected %s, got %s", test.now, test.expected, due)
+		}
+	}
+}
+
+func TestDaily(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Daily(ctx, func() (string, *time.Location) { return "01:00", time.UTC }, func(context.Context, time.Time) {
+			t.Error("Expected no run before it is due")
+		})
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Daily to stop when cancelled")
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	where, err := Dir(dir).Put(context.Background(), "traffic.csv", []byte("site\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if where != filepath.Join(dir, "traffic.csv") {
+		t.Errorf("Unexpected path %s", where)
+	}
+	if data, _ := ioutil.ReadFile(where); string(data) != "site\n" {
+		t.Errorf("Unexpected report %q", data)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 || files[0].Mode().Perm() != 0644 {
+		t.Errorf("Expected only the report left, readable, got %v", files)
+	}
+	if _, err := Dir(filepath.Join(dir, "missing")).Put(context.Background(), "traffic.csv", nil); err == nil {
+		t.Error("Expected an error for a missing dir")
+	}
+}
@@ -0,0 +1,377 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"deadletter"
+	"logging"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/jpillora/backoff"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Common holds the settings every service shares. Services embed it in their
+// Options so the same keys and env vars configure all of them.
+type Common struct {
+	ConfigFile          string `long:"config" env:"LPR_CONFIG" description:"YAML config file shared by all services"`
+	BeanstalkAddr       string `long:"beanstalk-addr" env:"LPR_BEANSTALK_ADDR" default:"127.0.0.1:11300"`
+	MotionTube          string `long:"motion-tube" env:"LPR_MOTION_TUBE" default:"motion_events"`
+	DetectionTube       string `long:"detection-tube" env:"LPR_DETECTION_TUBE" default:"detection_events"`
+	JobPriority         uint32 `long:"job-priority" env:"LPR_JOB_PRIORITY" default:"1"`
+	JobTTRSecs          int    `long:"job-ttr" env:"LPR_JOB_TTR" default:"30"`
+	ReserveTimeoutSecs  int    `long:"reserve-timeout" env:"LPR_RESERVE_TIMEOUT" default:"5"`
+	BackoffMinMs        int    `long:"backoff-min" env:"LPR_BACKOFF_MIN_MS" default:"100"`
+	ShutdownTimeoutSecs int    `long:"shutdown-timeout" env:"LPR_SHUTDOWN_TIMEOUT" default:"20" description:"Seconds to stop cleanly in after SIGTERM"`
+	MaxRetries          int    `long:"max-retries" env:"LPR_MAX_RETRIES" default:"5" description:"Times a failing job is retried before it is buried"`
+	RetryDelaySecs      int    `long:"retry-delay" env:"LPR_RETRY_DELAY" default:"10"`
+	RetryDelayMaxSecs   int    `long:"retry-delay-max" env:"LPR_RETRY_DELAY_MAX" default:"600"`
+	DeadLetterDir       string `long:"dead-letter-dir" env:"LPR_DEAD_LETTER_DIR" description:"Shared dir recording why jobs were buried"`
+	LogFormat           string `long:"log-format" env:"LPR_LOG_FORMAT" default:"logfmt" description:"logfmt or json"`
+	LogLevel            string `long:"log-level" env:"LPR_LOG_LEVEL" default:"info" description:"debug, info, warn or error" reload:"true"`
+}
+
+// Validate checks the shared settings.
+func (c *Common) Validate() error {
+	switch {
+	case c.BeanstalkAddr == "":
+		return errors.New("beanstalk-addr must be set")
+	case c.MotionTube == "" || c.DetectionTube == "":
+		return errors.New("motion-tube and detection-tube must be set")
+	case c.JobTTRSecs <= 0:
+		return errors.New("job-ttr must be positive")
+	case c.ReserveTimeoutSecs <= 0:
+		return errors.New("reserve-timeout must be positive")
+	case c.BackoffMinMs <= 0:
+		return errors.New("backoff-min must be positive")
+	case c.ShutdownTimeoutSecs <= 0:
+		return errors.New("shutdown-timeout must be positive")
+	case c.MaxRetries < 0:
+		return errors.New("max-retries must not be negative")
+	case c.RetryDelaySecs < 0 || c.RetryDelayMaxSecs < c.RetryDelaySecs:
+		return errors.New("retry-delay must not be negative or over retry-delay-max")
+	case c.LogFormat != logging.Logfmt && c.LogFormat != logging.JSON:
+		return errors.New("log-format must be logfmt or json")
+	}
+	_, err := logging.ParseLevel(c.LogLevel)
+	return err
+}
+
+// JobTTR is the time-to-run given to jobs put on the tubes.
+func (c *Common) JobTTR() time.Duration {
+	return time.Duration(c.JobTTRSecs) * time.Second
+}
+
+// ReserveTimeout is how long a reserve waits for a job.
+func (c *Common) ReserveTimeout() time.Duration {
+	return time.Duration(c.ReserveTimeoutSecs) * time.Second
+}
+
+// ShutdownTimeout is how long a service has to stop once asked to.
+func (c *Common) ShutdownTimeout() time.Duration {
+	return time.Duration(c.ShutdownTimeoutSecs) * time.Second
+}
+
+// ShutdownGrace is how long an in-flight job may keep running once shutdown
+// starts, leaving the rest of the timeout to release it and close connections.
+func (c *Common) ShutdownGrace() time.Duration {
+	return c.ShutdownTimeout() * 3 / 4
+}
+
+// SetupLogging starts logging in the configured format, as the service.
+func (c *Common) SetupLogging(service string) error {
+	return logging.Setup(service, c.LogFormat, c.LogLevel)
+}
+
+// ReloadLogging applies a changed log level.
+func (c *Common) ReloadLogging() {
+	level, _ := logging.ParseLevel(c.LogLevel)
+	logging.SetLevel(level)
+}
+
+// RetryPolicy is what happens to jobs that fail.
+func (c *Common) RetryPolicy() deadletter.Policy {
+	return deadletter.Policy{
+		MaxRetries: c.MaxRetries,
+		Delay:      time.Duration(c.RetryDelaySecs) * time.Second,
+		MaxDelay:   time.Duration(c.RetryDelayMaxSecs) * time.Second,
+	}
+}
+
+// Backoff returns the reconnection backoff, capped at max.
+func (c *Common) Backoff(max time.Duration) *backoff.Backoff {
+	return &backoff.Backoff{
+		Min:    time.Duration(c.BackoffMinMs) * time.Millisecond,
+		Max:    max,
+		Factor: 2,
+		Jitter: false,
+	}
+}
+
+// Validator is implemented by Options that check their values once parsed.
+type Validator interface {
+	Validate() error
+}
+
+// Parse fills opts, a pointer to a go-flags options struct, from the struct's
+// defaults, then the config file, then env vars, then args, each overriding
+// the one before. Keys in the config file are the options' long names: those
+// at the top level are shared by all services, and those in the section named
+// after the service override them.
+//
+//	beanstalk-addr: 10.0.0.2:11300
+//	uploader:
+//	  site: depot
+//
+// Options tagged secret:"true" may also be read from files, as described at
+// readSecrets, taking precedence over the config file.
+func Parse(service string, opts interface{}, args []string) error {
+	parser := flags.NewParser(opts, flags.Default)
+
+	if file := configFile(args); file != "" {
+		values, err := readFile(file, service)
+		if err == nil {
+			err = applyDefaults(parser, service, values)
+		}
+		if err != nil {
+			return fmt.Errorf("Config file %s: %s", file, err)
+		}
+	}
+	if err := readSecrets(parser); err != nil {
+		return err
+	}
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		return err
+	}
+	if v, ok := opts.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("Invalid configuration: %s", err)
+		}
+	}
+	return nil
+}
+
+// Reload parses the configuration again into a fresh copy of live, then
+// copies across only the fields tagged reload:"true", returning the names of
+// those that changed. Nothing is copied if the configuration is invalid.
+func Reload(service string, live interface{}, args []string) ([]string, error) {
+	fresh := reflect.New(reflect.TypeOf(live).Elem())
+	if err := Parse(service, fresh.Interface(), args); err != nil {
+		return nil, err
+	}
+	var changed []string
+	copyReloadable(reflect.ValueOf(live).Elem(), fresh.Elem(), &changed)
+	return changed, nil
+}
+
+// OnSighup calls fn every time the process receives SIGHUP.
+func OnSighup(fn func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			fn()
+		}
+	}()
+}
+
+func copyReloadable(dst reflect.Value, src reflect.Value, changed *[]string) {
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			copyReloadable(dst.Field(i), src.Field(i), changed)
+			continue
+		}
+		if field.Tag.Get("reload") != "true" {
+			continue
+		}
+		if !reflect.DeepEqual(dst.Field(i).Interface(), src.Field(i).Interface()) {
+			dst.Field(i).Set(src.Field(i))
+			*changed = append(*changed, field.Name)
+		}
+	}
+}
+
+// configFile finds the config file from the args or the environment, before
+// the args have been parsed.
+func configFile(args []string) string {
+	for i, arg := range args {
+		if arg == "--config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "--config=") {
+			return strings.TrimPrefix(arg, "--config=")
+		}
+	}
+	return os.Getenv("LPR_CONFIG")
+}
+
+// sections are the services that have a section in the config file.
+var sections = map[string]bool{
+	"watcher": true, "detector": true, "uploader": true, "alpr-raspi": true,
+	"api": true, "report": true, "pseudonym": true, "replay": true, "benchmark": true,
+}
+
+type fileValues struct {
+	shared  map[string][]string
+	section map[string][]string
+}
+
+func readFile(file string, service string) (*fileValues, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	values := &fileValues{
+		shared:  make(map[string][]string),
+		section: make(map[string][]string),
+	}
+	for key, value := range doc {
+		if section, ok := value.(map[interface{}]interface{}); ok {
+			if !sections[key] && key != service {
+				return nil, fmt.Errorf("Unknown section %q", key)
+			}
+			// Other services' sections are none of our business.
+			if key != service {
+				continue
+			}
+			for k, v := range section {
+				name := fmt.Sprint(k)
+				values.section[name], err = toStrings(name, v)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		values.shared[key], err = toStrings(key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func toStrings(key string, value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if _, ok := item.(map[interface{}]interface{}); ok {
+				return nil, fmt.Errorf("%s: expected a list of values", key)
+			}
+			list = append(list, fmt.Sprint(item))
+		}
+		return list, nil
+	case map[interface{}]interface{}:
+		return nil, fmt.Errorf("%s: expected a value, not a section", key)
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// longOptions returns the parser's options by their long names.
+func longOptions(parser *flags.Parser) map[string]*flags.Option {
+	options := make(map[string]*flags.Option)
+	var walk func(g *flags.Group)
+	walk = func(g *flags.Group) {
+		for _, option := range g.Options() {
+			if option.LongName != "" {
+				options[option.LongName] = option
+			}
+		}
+		for _, sub := range g.Groups() {
+			walk(sub)
+		}
+	}
+	walk(parser.Command.Group)
+	return options
+}
+
+// applyDefaults makes the config file values the options' defaults, which go-flags
+// then overrides with env vars and args.
+func applyDefaults(parser *flags.Parser, service string, values *fileValues) error {
+	options := longOptions(parser)
+
+	// Keys at the top level are shared by every service, so they must be
+	// Common settings, and keys in our own section must mean something to
+	// us.
+	common := longOptions(flags.NewParser(&Common{}, flags.None))
+	for key, value := range values.shared {
+		if common[key] == nil {
+			return fmt.Errorf("Unknown shared setting %q, which belongs in a service's section", key)
+		}
+		options[key].Default = value
+	}
+	for key, value := range values.section {
+		option, ok := options[key]
+		if !ok {
+			return fmt.Errorf("Unknown setting %q in %s section", key, service)
+		}
+		option.Default = value
+	}
+	return nil
+}
+
+// readSecrets makes the contents of files the defaults of the options tagged
+// secret:"true", so passwords and keys needn't be kept in the config file or
+// the environment. The file is the one named by the option's env var with
+// _FILE appended, as Docker secrets are given, or else the one named after
+// the option in $CREDENTIALS_DIRECTORY, where systemd puts credentials. A
+// trailing newline is dropped, and list options take a value per line, blank
+// lines skipped.
+func readSecrets(parser *flags.Parser) error {
+	credentials := os.Getenv("CREDENTIALS_DIRECTORY")
+	for name, option := range longOptions(parser) {
+		if option.Field().Tag.Get("secret") != "true" {
+			continue
+		}
+		file := ""
+		if option.EnvDefaultKey != "" {
+			file = os.Getenv(option.EnvDefaultKey + "_FILE")
+		}
+		if file == "" && credentials != "" {
+			candidate := filepath.Join(credentials, name)
+			if _, err := os.Stat(candidate); err == nil {
+				file = candidate
+			}
+		}
+		if file == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("Secret %s: %s", name, err)
+		}
+		value := strings.TrimRight(string(data), "\r\n")
+		if option.Field().Type.Kind() != reflect.Slice {
+			option.Default = []string{value}
+			continue
+		}
+		option.Default = nil
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				option.Default = append(option.Default, line)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package settings
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testOptions struct {
+	Common
+	Camera    string   `long:"camera" env:"TEST_CAMERA" default:"lpr-camera"`
+	Site      string   `long:"site" env:"TEST_SITE" default:"lpr-site"`
+	Threshold int      `long:"threshold" env:"TEST_THRESHOLD" default:"10" reload:"true"`
+	Plates    []string `long:"plates" env:"TEST_PLATES" env-delim:"," reload:"true"`
+	Password  string   `long:"password" env:"TEST_PASSWORD" secret:"true"`
+	Keys      []string `long:"keys" env:"TEST_KEYS" env-delim:"," secret:"true"`
+}
+
+func (o *testOptions) Validate() error {
+	if o.Threshold < 0 {
+		return errors.New("threshold must not be negative")
+	}
+	return o.Common.Validate()
+}
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestParseDefaults(t *testing.T) {
+	var opts testOptions
+	if err := Parse("test", &opts, []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if opts.BeanstalkAddr != "127.0.0.1:11300" || opts.Camera != "lpr-camera" || opts.Threshold != 10 {
+		t.Errorf("Unexpected defaults: %+v", opts)
+	}
+	if opts.JobTTR().Seconds() != 30 || opts.Backoff(opts.ReserveTimeout()).Min.Nanoseconds() != 100e6 {
+		t.Errorf("Unexpected durations: %s", opts.JobTTR())
+	}
+}
+
+func TestParsePrecedence(t *testing.T) {
+	file := writeConfig(t, `
+beanstalk-addr: 10.0.0.2:11300
+log-level: warn
+test:
+  camera: gate
+  site: file-site
+  log-level: debug
+  plates: [CA982063, CA982064]
+uploader:
+  nonsense: ignored
+`)
+	defer os.Remove(file)
+
+	os.Setenv("TEST_SITE", "env-site")
+	defer os.Unsetenv("TEST_SITE")
+
+	var opts testOptions
+	if err := Parse("test", &opts, []string{"--config", file, "--threshold", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	if opts.BeanstalkAddr != "10.0.0.2:11300" {
+		t.Error("Expected shared value from file:", opts.BeanstalkAddr)
+	}
+	if opts.Camera != "gate" || opts.LogLevel != "debug" {
+		t.Error("Expected section values, overriding shared ones:", opts.Camera, opts.LogLevel)
+	}
+	if opts.Site != "env-site" {
+		t.Error("Expected env to override file:", opts.Site)
+	}
+	if opts.Threshold != 5 {
+		t.Error("Expected args to override default:", opts.Threshold)
+	}
+	if len(opts.Plates) != 2 || opts.Plates[1] != "CA982064" {
+		t.Error("Expected list from file:", opts.Plates)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"unknown key":     "test:\n  camra: gate\n",
+		"bad value":       "test:\n  threshold: lots\n",
+		"invalid":         "test:\n  threshold: -1\n",
+		"nested":          "test:\n  camera:\n    name: gate\n",
+		"not yaml":        "test: [",
+		"common checks":   "job-ttr: 0\n",
+		"unknown shared":  "camera: gate\n",
+		"shared typo":     "beanstalk-adr: 10.0.0.2:11300\n",
+		"unknown section": "detecter:\n  workers: 2\n",
+	}
+	for name, content := range cases {
+		file := writeConfig(t, content)
+		var opts testOptions
+		if err := Parse("test", &opts, []string{"--config=" + file}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		os.Remove(file)
+	}
+
+	var opts testOptions
+	if err := Parse("test", &opts, []string{"--config", "/does/not/exist.yml"}); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestParseSecrets(t *testing.T) {
+	password := writeConfig(t, "s3cret\n")
+	defer os.Remove(password)
+	credentials, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(credentials)
+	ioutil.WriteFile(filepath.Join(credentials, "keys"), []byte("gate=0123456789abcdef\n\nyard=fedcba9876543210\n"), 0600)
+	ioutil.WriteFile(filepath.Join(credentials, "password"), []byte("ignored"), 0600)
+	os.Setenv("TEST_PASSWORD_FILE", password)
+	os.Setenv("CREDENTIALS_DIRECTORY", credentials)
+	defer os.Unsetenv("TEST_PASSWORD_FILE")
+	defer os.Unsetenv("CREDENTIALS_DIRECTORY")
+
+	file := writeConfig(t, "test:\n  password: from-config\n")
+	defer os.Remove(file)
+	var opts testOptions
+	if err := Parse("test", &opts, []string{"--config", file}); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Password != "s3cret" || !reflect.DeepEqual(opts.Keys, []string{"gate=0123456789abcdef", "yard=fedcba9876543210"}) {
+		t.Errorf("Expected the secrets from their files, got %q and %q", opts.Password, opts.Keys)
+	}
+
+	os.Setenv("TEST_PASSWORD", "from-env")
+	defer os.Unsetenv("TEST_PASSWORD")
+	opts = testOptions{}
+	if err := Parse("test", &opts, nil); err != nil || opts.Password != "from-env" {
+		t.Errorf("Expected the env to override the file, got %q %v", opts.Password, err)
+	}
+
+	os.Setenv("TEST_PASSWORD_FILE", "/does/not/exist")
+	if err := Parse("test", &testOptions{}, nil); err == nil {
+		t.Error("Expected an error for a missing secret file")
+	}
+}
+
+func TestReload(t *testing.T) {
+	file := writeConfig(t, "test:\n  camera: gate\n  threshold: 20\n")
+	defer os.Remove(file)
+	args := []string{"--config", file}
+
+	var opts testOptions
+	if err := Parse("test", &opts, args); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(file, []byte("test:\n  camera: exit\n  threshold: 30\n  plates: [CA982063]\n"), 0644)
+	changed, err := Reload("test", &opts, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 2 || changed[0] != "Threshold" || changed[1] != "Plates" {
+		t.Error("Unexpected changes:", changed)
+	}
+	if opts.Threshold != 30 || len(opts.Plates) != 1 {
+		t.Errorf("Expected reloadable settings applied: %+v", opts)
+	}
+	if opts.Camera != "gate" {
+		t.Error("Expected camera to need a restart:", opts.Camera)
+	}
+
+	// An invalid file leaves everything as it was.
+	ioutil.WriteFile(file, []byte("test:\n  threshold: -1\n"), 0644)
+	if _, err = Reload("test", &opts, args); err == nil {
+		t.Error("Expected an error reloading an invalid file")
+	}
+	if opts.Threshold != 30 {
+		t.Error("Expected threshold unchanged:", opts.Threshold)
+	}
+}
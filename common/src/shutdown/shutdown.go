@@ -0,0 +1,65 @@
+package shutdown
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"logging"
+)
+
+// OnSignal returns a context that is cancelled when the process receives
+// SIGINT or SIGTERM. Services then have timeout to stop cleanly, after which,
+// or on a second signal, the process exits regardless.
+func OnSignal(timeout time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		logging.Info("Shutting down", "signal", sig, "deadline", timeout)
+		cancel()
+		select {
+		case sig = <-c:
+			logging.Warn("Signalled again, exiting now", "signal", sig)
+		case <-time.After(timeout):
+			logging.Error("Shutdown deadline exceeded, exiting now", "deadline", timeout)
+		}
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+// Grace returns a context for in-flight work that is cancelled timeout after
+// ctx is, so a job already started when shutdown begins gets the chance to
+// finish but not to hold things up forever. Call the CancelFunc when done.
+func Grace(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	grace, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-grace.Done():
+			return
+		}
+		select {
+		case <-time.After(timeout):
+			cancel()
+		case <-grace.Done():
+		}
+	}()
+	return grace, cancel
+}
+
+// Sleep waits for d, returning false early if ctx is cancelled first.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
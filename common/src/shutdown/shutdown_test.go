@@ -0,0 +1,45 @@
+package shutdown
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	grace, done := Grace(ctx, 50*time.Millisecond)
+	defer done()
+
+	select {
+	case <-grace.Done():
+		t.Fatal("Expected grace to outlive a running service")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-grace.Done():
+		t.Fatal("Expected grace to last beyond the shutdown")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	select {
+	case <-grace.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected grace to end after the timeout")
+	}
+}
+
+func TestSleep(t *testing.T) {
+	if !Sleep(context.Background(), time.Millisecond) {
+		t.Error("Expected a full sleep")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	started := time.Now()
+	if Sleep(ctx, time.Minute) || time.Since(started) > time.Second {
+		t.Error("Expected sleep cut short by cancellation")
+	}
+}
@@ -0,0 +1,184 @@
+// Package traffic counts the vehicles each camera and site saw, by hour, day
+// and weekday, for the clients' traffic reports.
+package traffic
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"events"
+)
+
+// Count is the events and distinct plates in a period.
+type Count struct {
+	Start  time.Time `json:"start"`
+	Events int       `json:"events"`
+	Plates int       `json:"unique_plates"`
+}
+
+// Summary is the traffic seen by a camera, or by every camera at a site
+// when Camera is empty.
+type Summary struct {
+	Site   string `json:"site"`
+	Camera string `json:"camera,omitempty"`
+	Events int    `json:"events"`
+	Plates int    `json:"unique_plates"`
+	// Peak is the busiest hour, and PeakHour the busiest hour of the day
+	// over the whole range.
+	Peak     Count `json:"peak"`
+	PeakHour int   `json:"peak_hour_of_day"`
+	// HourOfDay and Weekday count events by the hour they were in, 0 to 23,
+	// and by weekday, Sunday first.
+	HourOfDay [24]int `json:"events_by_hour_of_day"`
+	Weekday   [7]int  `json:"events_by_weekday"`
+	// Hourly and Daily cover every hour and day of the range, quiet ones too.
+	Hourly []Count `json:"hourly"`
+	Daily  []Count `json:"daily"`
+}
+
+// Report is the traffic over [From, To), with hours and days in Timezone.
+type Report struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Timezone  string    `json:"timezone"`
+	Summaries []Summary `json:"summaries"`
+}
+
+// tally gathers the plates seen in each period of a summary.
+type tally struct {
+	summary *Summary
+	plates  map[string]bool
+	hours   map[int64]map[string]bool
+	days    map[int64]map[string]bool
+	events  map[int64]int
+	daily   map[int64]int
+}
+
+func (t *tally) add(row events.PlateHour, hour, day time.Time) {
+	s := t.summary
+	s.Events += row.Events
+	s.HourOfDay[hour.Hour()] += row.Events
+	s.Weekday[hour.Weekday()] += row.Events
+	t.plates[row.Plate] = true
+	for _, period := range []struct {
+		plates map[int64]map[string]bool
+		events map[int64]int
+		start  int64
+	}{{t.hours, t.events, hour.Unix()}, {t.days, t.daily, day.Unix()}} {
+		if period.plates[period.start] == nil {
+			period.plates[period.start] = make(map[string]bool)
+		}
+		period.plates[period.start][row.Plate] = true
+		period.events[period.start] += row.Events
+	}
+}
+
+// Build sums up the plates each camera saw each hour over [from, to), as
+// read by events.PlateHours, with days and hours in loc.
+func Build(rows []events.PlateHour, from, to time.Time, loc *time.Location) Report {
+	type key struct{ site, camera string }
+	tallies := make(map[key]*tally)
+	get := func(k key) *tally {
+		t, ok := tallies[k]
+		if !ok {
+			t = &tally{
+				summary: &Summary{Site: k.site, Camera: k.camera},
+				plates:  make(map[string]bool),
+				hours:   make(map[int64]map[string]bool),
+				days:    make(map[int64]map[string]bool),
+				events:  make(map[int64]int),
+				daily:   make(map[int64]int),
+			}
+			tallies[k] = t
+		}
+		return t
+	}
+	for _, row := range rows {
+		hour := row.Hour.In(loc)
+		day := time.Date(hour.Year(), hour.Month(), hour.Day(), 0, 0, 0, 0, loc)
+		get(key{row.Site, row.Camera}).add(row, hour, day)
+		get(key{row.Site, ""}).add(row, hour, day)
+	}
+
+	report := Report{From: from, To: to, Timezone: loc.String(), Summaries: []Summary{}}
+	hours, days := periods(from, to, loc)
+	for _, t := range tallies {
+		s := t.summary
+		s.Plates = len(t.plates)
+		s.Hourly = counts(hours, t.events, t.hours)
+		s.Daily = counts(days, t.daily, t.days)
+		for _, c := range s.Hourly {
+			if c.Events > s.Peak.Events {
+				s.Peak = c
+			}
+		}
+		for hour, n := range s.HourOfDay {
+			if n > s.HourOfDay[s.PeakHour] {
+				s.PeakHour = hour
+			}
+		}
+		report.Summaries = append(report.Summaries, *s)
+	}
+	// Each site's totals come before its cameras.
+	sort.Slice(report.Summaries, func(i, j int) bool {
+		a, b := report.Summaries[i], report.Summaries[j]
+		if a.Site != b.Site {
+			return a.Site < b.Site
+		}
+		return a.Camera < b.Camera
+	})
+	return report
+}
+
+// periods returns the start of every hour and day in loc that overlaps
+// [from, to).
+func periods(from, to time.Time, loc *time.Location) ([]time.Time, []time.Time) {
+	var hours, days []time.Time
+	start := from.In(loc)
+	// Hours are stepped in absolute time, so a clock change still gives
+	// each hour once.
+	first := time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), 0, 0, 0, loc)
+	for hour := first; hour.Before(to); hour = hour.Add(time.Hour) {
+		hours = append(hours, hour.In(loc))
+	}
+	for day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	return hours, days
+}
+
+func counts(starts []time.Time, events map[int64]int, plates map[int64]map[string]bool) []Count {
+	list := make([]Count, 0, len(starts))
+	for _, start := range starts {
+		list = append(list, Count{Start: start, Events: events[start.Unix()], Plates: len(plates[start.Unix()])})
+	}
+	return list
+}
+
+// WriteJSON writes the report as JSON.
+func (r Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteCSV writes a row for each hour of each summary, with a header row.
+// Rows without a camera are the totals for the site.
+func (r Report) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"site", "camera", "hour", "weekday", "hour_of_day", "events", "unique_plates"})
+	for _, s := range r.Summaries {
+		for _, c := range s.Hourly {
+			out.Write([]string{
+				s.Site, s.Camera, c.Start.Format(time.RFC3339), c.Start.Weekday().String(),
+				strconv.Itoa(c.Start.Hour()), strconv.Itoa(c.Events), strconv.Itoa(c.Plates),
+			})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,102 @@
+package traffic
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"events"
+)
+
+var day = time.Date(2016, 9, 20, 0, 0, 0, 0, time.UTC)
+
+func rows() []events.PlateHour {
+	at := func(hour int) time.Time { return day.Add(time.Duration(hour) * time.Hour) }
+	return []events.PlateHour{
+		{Camera: "gate", Site: "depot", Plate: "AB12", Hour: at(8), Events: 2},
+		{Camera: "gate", Site: "depot", Plate: "CD34", Hour: at(8), Events: 1},
+		{Camera: "yard", Site: "depot", Plate: "AB12", Hour: at(9), Events: 1},
+		{Camera: "gate", Site: "depot", Plate: "AB12", Hour: at(17), Events: 1},
+		{Camera: "gate", Site: "depot", Plate: "EF56", Hour: at(32), Events: 1},
+		{Camera: "door", Site: "office", Plate: "AB12", Hour: at(12), Events: 1},
+	}
+}
+
+func TestBuild(t *testing.T) {
+	report := Build(rows(), day, day.AddDate(0, 0, 2), time.UTC)
+	if len(report.Summaries) != 5 {
+		t.Fatalf("Expected the depot, its 2 cameras, the office and its camera, got %d", len(report.Summaries))
+	}
+	depot := report.Summaries[0]
+	if depot.Site != "depot" || depot.Camera != "" || depot.Events != 6 || depot.Plates != 3 {
+		t.Errorf("Unexpected depot totals %+v", depot)
+	}
+	if !depot.Peak.Start.Equal(day.Add(8*time.Hour)) || depot.Peak.Events != 3 || depot.Peak.Plates != 2 || depot.PeakHour != 8 {
+		t.Errorf("Unexpected peak %+v at %d", depot.Peak, depot.PeakHour)
+	}
+	if len(depot.Hourly) != 48 || len(depot.Daily) != 2 {
+		t.Errorf("Expected every hour and day, got %d and %d", len(depot.Hourly), len(depot.Daily))
+	}
+	if depot.Daily[0].Events != 5 || depot.Daily[0].Plates != 2 || depot.Daily[1].Events != 1 {
+		t.Errorf("Unexpected days %+v", depot.Daily)
+	}
+	if depot.Weekday[time.Tuesday] != 5 || depot.Weekday[time.Wednesday] != 1 || depot.HourOfDay[8] != 4 {
+		t.Errorf("Unexpected weekdays %v and hours %v", depot.Weekday, depot.HourOfDay)
+	}
+	if gate := report.Summaries[1]; gate.Camera != "gate" || gate.Events != 5 || gate.Plates != 3 {
+		t.Errorf("Unexpected gate summary %+v", gate)
+	}
+	if office := report.Summaries[3]; office.Site != "office" || office.Camera != "" || office.Events != 1 {
+		t.Errorf("Unexpected office summary %+v", office)
+	}
+}
+
+func TestBuildTimezone(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	from := time.Date(2016, 9, 20, 0, 0, 0, 0, london)
+	hour := time.Date(2016, 9, 20, 0, 0, 0, 0, london)
+	report := Build([]events.PlateHour{{Camera: "gate", Site: "depot", Plate: "AB12", Hour: hour, Events: 1}}, from, from.AddDate(0, 0, 1), london)
+	depot := report.Summaries[0]
+	if report.Timezone != "Europe/London" || depot.HourOfDay[0] != 1 || depot.Weekday[time.Tuesday] != 1 || depot.Hourly[0].Events != 1 {
+		t.Errorf("Expected the read at midnight on Tuesday in London, got %+v", depot)
+	}
+
+	// The day the clocks go back has 25 hours.
+	back := time.Date(2016, 10, 30, 0, 0, 0, 0, london)
+	report = Build([]events.PlateHour{{Camera: "gate", Site: "depot", Plate: "AB12", Hour: back, Events: 1}}, back, back.AddDate(0, 0, 1), london)
+	if hours := len(report.Summaries[0].Hourly); hours != 25 {
+		t.Errorf("Expected 25 hours, got %d", hours)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	report := Build(rows(), day, day.AddDate(0, 0, 1), time.UTC)
+	var out bytes.Buffer
+	if err := report.WriteCSV(&out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1+5*24 {
+		t.Fatalf("Expected a header and 24 hours for each summary, got %d lines", len(lines))
+	}
+	if lines[0] != "site,camera,hour,weekday,hour_of_day,events,unique_plates" || lines[9] != "depot,,2016-09-20T08:00:00Z,Tuesday,8,3,2" {
+		t.Errorf("Unexpected rows:\n%s\n%s", lines[0], lines[9])
+	}
+
+	out.Reset()
+	if err := report.WriteJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Summaries) != 5 || decoded.Summaries[0].Peak.Events != 3 {
+		t.Errorf("Unexpected JSON %s", out.String())
+	}
+}
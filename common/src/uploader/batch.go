@@ -0,0 +1,182 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"logging"
+	"metrics"
+	"queue"
+	"uploader/config"
+)
+
+// job is a detection event in hand, from being reserved until its events
+// are sent and it is deleted, or it fails.
+type job struct {
+	id       uint64
+	filename string
+	log      *logging.Logger
+	// ctx outlives shutdown by the grace, and done releases it.
+	ctx    context.Context
+	done   context.CancelFunc
+	events []Event
+	// images is waited on before the events are sent, as they carry the
+	// images' URLs.
+	images sync.WaitGroup
+}
+
+// upload puts an image in the object store through the pool of upload
+// workers, setting url once it is there. A failed upload leaves url as it
+// was.
+func (u *Uploader) upload(j *job, log *logging.Logger, name string, body *bytes.Buffer, url *string) {
+	j.images.Add(1)
+	go func() {
+		defer j.images.Done()
+		select {
+		case u.workers <- struct{}{}:
+		case <-j.ctx.Done():
+			return
+		}
+		defer func() { <-u.workers }()
+		location, err := u.deps.Store.Put(j.ctx, name, body)
+		metrics.Uploads.WithLabelValues(metrics.Result(err)).Inc()
+		recordUpload(u.status, err)
+		if err != nil {
+			log.Error("UploadFile", "name", name, "err", err)
+			return
+		}
+		*url = location
+		log.Info("Uploaded image", "url", location)
+	}()
+}
+
+// batch is the jobs whose events are waiting to be sent together.
+type batch struct {
+	jobs   []*job
+	events int
+	due    time.Time
+}
+
+// add adds a job to the batch, which is due wait after its first job.
+func (b *batch) add(j *job, wait time.Duration) {
+	if len(b.jobs) == 0 {
+		b.due = time.Now().Add(wait)
+	}
+	b.jobs = append(b.jobs, j)
+	b.events += len(j.events)
+}
+
+// timeout is how long to wait for another job before the batch is due, at
+// most max, or 0 if it is due now.
+func (b *batch) timeout(max time.Duration) time.Duration {
+	if len(b.jobs) == 0 {
+		return max
+	}
+	wait := time.Until(b.due)
+	if wait <= 0 {
+		return 0
+	}
+	// beanstalkd waits in whole seconds, and would return at once.
+	if wait = wait.Round(time.Second); wait < time.Second {
+		wait = time.Second
+	}
+	if wait > max {
+		return max
+	}
+	return wait
+}
+
+// flush sends the events of the jobs in the batch in one go, once their
+// images are uploaded, and deletes the jobs, or fails them all if the
+// events can't be sent. The batch is left empty.
+func (u *Uploader) flush(in queue.Tube, b *batch) {
+	jobs := b.jobs
+	*b = batch{}
+	if len(jobs) == 0 {
+		return
+	}
+	var events []Event
+	for _, j := range jobs {
+		j.images.Wait()
+		events = append(events, j.events...)
+	}
+	var recorded []bool
+	var err error
+	if len(events) > 0 {
+		// Every job's grace ends at the same time, shutdown plus the grace.
+		recorded, err = u.deps.Events.Send(jobs[0].ctx, events)
+	}
+
+	for _, j := range jobs {
+		var already []bool
+		if err == nil {
+			already, recorded = recorded[:len(j.events)], recorded[len(j.events):]
+		}
+		if err != nil {
+			for _, event := range j.events {
+				metrics.Inserts.WithLabelValues(metrics.Result(err)).Inc()
+				// So the retry doesn't take the plate for a duplicate.
+				if err := u.deps.Recent.Forget(context.Background(), event.Plate); err != nil {
+					j.log.Error("LocalDB", "plate", event.Plate, "err", err)
+				}
+			}
+			j.log.Error("SendEvent RemoteDB", "batch", len(events), "err", err)
+		}
+		// Cut short by shutdown, so hand the job straight back rather than
+		// leave it to time out.
+		if j.ctx.Err() != nil {
+			j.done()
+			j.log.Warn("Shutdown grace over, releasing job")
+			if err := in.Release(j.id, 0); err != nil {
+				j.log.Error("Release job", "err", err)
+			}
+			continue
+		}
+		if err != nil {
+			u.fail(in, j, fmt.Errorf("send events: %s", err))
+			continue
+		}
+		for i, event := range j.events {
+			plateLog := j.log.With("plate", event.Plate, "event_id", event.ID)
+			if already[i] {
+				// Sent by an earlier try at the job, or an earlier replay.
+				metrics.Inserts.WithLabelValues("duplicate").Inc()
+				plateLog.Info("Event already recorded")
+				continue
+			}
+			metrics.Inserts.WithLabelValues(metrics.Result(nil)).Inc()
+			metrics.EventLagSeconds.Observe(time.Since(event.Time).Seconds())
+			plateLog.Info("Event sent to remote database", "lag", time.Since(event.Time))
+		}
+		u.finish(in, j)
+	}
+}
+
+// fail hands a job that couldn't be done to the retry policy.
+func (u *Uploader) fail(in queue.Tube, j *job, cause error) {
+	if j.done != nil {
+		j.done()
+	}
+	outcome, err := config.Opts.RetryPolicy().Fail(in, j.id, cause, u.deadLetters)
+	if err != nil {
+		j.log.Error("Queue", "err", err)
+		return
+	}
+	j.log.Error("Job failed", "outcome", outcome, "err", cause)
+	metrics.JobFailures.WithLabelValues(in.Name(), outcome).Inc()
+}
+
+// finish deletes a job whose events are all sent.
+func (u *Uploader) finish(in queue.Tube, j *job) {
+	j.done()
+	if err := in.Delete(j.id); err != nil {
+		// Maybe the queue connection went away, a reconnect will be
+		// attempted on the next reserve.
+		j.log.Error("Delete job", "err", err)
+		return
+	}
+	u.pending.Done(j.filename)
+}
@@ -0,0 +1,46 @@
+package uploader
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchTimeout(t *testing.T) {
+	var b batch
+	if got := b.timeout(5 * time.Second); got != 5*time.Second {
+		t.Errorf("Expected the full timeout with nothing waiting, got %s", got)
+	}
+	b.add(&job{events: make([]Event, 2)}, 3*time.Second)
+	if got := b.timeout(5 * time.Second); got != 3*time.Second {
+		t.Errorf("Expected to wait until the batch is due, got %s", got)
+	}
+	if got := b.timeout(2 * time.Second); got != 2*time.Second {
+		t.Errorf("Expected at most the timeout, got %s", got)
+	}
+	b.add(&job{events: make([]Event, 1)}, time.Hour)
+	if b.events != 3 || b.timeout(5*time.Second) != 3*time.Second {
+		t.Errorf("Expected the first job to set when the batch is due, got %+v", b)
+	}
+	b.due = time.Now().Add(100 * time.Millisecond)
+	if got := b.timeout(5 * time.Second); got != time.Second {
+		t.Errorf("Expected a whole second, got %s", got)
+	}
+	b.due = time.Now().Add(-time.Millisecond)
+	if got := b.timeout(5 * time.Second); got != 0 {
+		t.Errorf("Expected the batch due now, got %s", got)
+	}
+}
+
+func TestInsertEvents(t *testing.T) {
+	query, args, err := insertEvents([]Event{{ID: "a1", Plate: "CA982063"}, {ID: "b2", Plate: "AB12CDE"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 40 || args[18] != "a1" || args[38] != "b2" || args[39] != nil {
+		t.Errorf("Expected 20 arguments for each event, got %v", args)
+	}
+	if !strings.Contains(query, "($21, $22, ") || !strings.HasSuffix(query, "$40) ON CONFLICT (uid) DO NOTHING RETURNING uid") {
+		t.Errorf("Unexpected query %s", query)
+	}
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"pgconn"
+	"pseudonym"
+	"settings"
+	"sync"
+	"time"
+)
+
+// Options describes all the CLI flags that can be passed. Those tagged
+// reload:"true" are re-read from the config file on SIGHUP.
+type Options struct {
+	settings.Common
+
+	S3Bucket              string   `long:"s3-bucket" env:"UPLOADER_S3_BUCKET" required:"true" short:"a"`
+	S3Prefix              string   `long:"s3-prefix" env:"UPLOADER_S3_PREFIX" required:"true" short:"b"`
+	S3Region              string   `long:"s3-region" env:"UPLOADER_S3_REGION" default:"eu-west-1" short:"c"`
+	RemotePostgresPass    string   `long:"remote-postgres-pass" env:"UPLOADER_REMOTE_POSTGRES_PASS" short:"d" secret:"true"`
+	LocalPostgresPass     string   `long:"local-postgres-pass" env:"UPLOADER_LOCAL_POSTGRES_PASS" short:"e" secret:"true"`
+	Camera                string   `long:"camera" env:"UPLOADER_CAMERA" default:"lpr-camera" short:"f"`
+	Site                  string   `long:"site" env:"UPLOADER_SITE" default:"lpr-site" short:"g"`
+	PlateImageHeight      int      `long:"plate-image-height" env:"UPLOADER_PLATE_IMAGE_HEIGHT" default:"60" short:"h" reload:"true"`
+	PlateImageQuality     uint     `long:"plate-image-quality" env:"UPLOADER_PLATE_IMAGE_QUALITY" default:"80" short:"i" reload:"true"`
+	FrameImageHeight      int      `long:"frame-image-height" env:"UPLOADER_FRAME_IMAGE_HEIGHT" default:"200" short:"j" reload:"true"`
+	FrameImageQuality     int      `long:"frame-image-quality" env:"UPLOADER_FRAME_IMAGE_QUALITY" default:"70" short:"k" reload:"true"`
+	EventIntervalTimeSecs int      `long:"event-interval-time" env:"UPLOADER_EVENT_INTERVAL_TIME" default:"15" short:"l" reload:"true"`
+	FrameDir              string   `long:"frame-dir" env:"UPLOADER_FRAME_DIR" default:"./" short:"m"`
+	PlateDir              string   `long:"plate-dir" env:"UPLOADER_PLATE_DIR" default:"./" short:"n"`
+	AccessKey             string   `long:"aws-access-key-id" env:"AWS_ACCESS_KEY_ID" required:"true" short:"o"`
+	SecretKey             string   `long:"aws-secret-access-key" env:"AWS_SECRET_ACCESS_KEY" required:"true" short:"p" secret:"true"`
+	LedgerDir             string   `long:"ledger-dir" env:"UPLOADER_LEDGER_DIR" short:"q" description:"Shared dir recording files with pending jobs"`
+	FilenameTemplate      string   `long:"filename-template" env:"UPLOADER_FILENAME_TEMPLATE" default:"%v-%Y%m%d%H%M%S-%q" short:"r" description:"Motion picture_filename or Go time layout"`
+	CameraTimezone        string   `long:"camera-timezone" env:"UPLOADER_CAMERA_TIMEZONE" default:"UTC" short:"s"`
+	TimeFallbacks         []string `long:"time-fallbacks" env:"UPLOADER_TIME_FALLBACKS" env-delim:"," default:"exif" default:"mtime" default:"now" short:"t"`
+	BackoffMaxSecs        int      `long:"backoff-max" env:"UPLOADER_BACKOFF_MAX" default:"30"`
+	HTTPAddr              string   `long:"http-addr" env:"UPLOADER_HTTP_ADDR" default:":9103" description:"Serves /metrics, /healthz and /readyz, empty to disable"`
+	PlaceholderImageURL   string   `long:"placeholder-image-url" env:"UPLOADER_PLACEHOLDER_IMAGE_URL" default:"https://lpr-events.s3-eu-west-1.amazonaws.com/placeholder/error.jpg"`
+	RemotePostgresDSN     string   `long:"remote-postgres-dsn" env:"UPLOADER_REMOTE_POSTGRES_DSN" description:"Connection string, as a postgres:// URL or key=value pairs, instead of the other remote-postgres settings but the password" secret:"true"`
+	RemotePostgresHost    string   `long:"remote-postgres-host" env:"UPLOADER_REMOTE_POSTGRES_HOST"`
+	RemotePostgresPort    int      `long:"remote-postgres-port" env:"UPLOADER_REMOTE_POSTGRES_PORT" default:"5432"`
+	RemotePostgresUser    string   `long:"remote-postgres-user" env:"UPLOADER_REMOTE_POSTGRES_USER" default:"lpr_uploader" description:"The least privileged role in scripts/roles.sql; migrating needs one that may create tables"`
+	RemotePostgresDB      string   `long:"remote-postgres-db" env:"UPLOADER_REMOTE_POSTGRES_DB" default:"postgres"`
+	RemotePostgresSSLMode string   `long:"remote-postgres-sslmode" env:"UPLOADER_REMOTE_POSTGRES_SSLMODE" default:"verify-full"`
+	RemotePostgresSSLRoot string   `long:"remote-postgres-sslrootcert" env:"UPLOADER_REMOTE_POSTGRES_SSLROOTCERT" description:"CA certificate the server's is checked against"`
+	RemotePostgresSSLCert string   `long:"remote-postgres-sslcert" env:"UPLOADER_REMOTE_POSTGRES_SSLCERT" description:"Client certificate, if the server asks for one"`
+	RemotePostgresSSLKey  string   `long:"remote-postgres-sslkey" env:"UPLOADER_REMOTE_POSTGRES_SSLKEY" description:"Client certificate's key"`
+	LocalPostgresDSN      string   `long:"local-postgres-dsn" env:"UPLOADER_LOCAL_POSTGRES_DSN" description:"Connection string instead of the other local-postgres settings but the password" secret:"true"`
+	LocalPostgresHost     string   `long:"local-postgres-host" env:"UPLOADER_LOCAL_POSTGRES_HOST" default:"localhost"`
+	LocalPostgresPort     int      `long:"local-postgres-port" env:"UPLOADER_LOCAL_POSTGRES_PORT" default:"5432"`
+	LocalPostgresUser     string   `long:"local-postgres-user" env:"UPLOADER_LOCAL_POSTGRES_USER" default:"lpr"`
+	LocalPostgresDB       string   `long:"local-postgres-db" env:"UPLOADER_LOCAL_POSTGRES_DB" default:"lpr"`
+	LocalPostgresSSLMode  string   `long:"local-postgres-sslmode" env:"UPLOADER_LOCAL_POSTGRES_SSLMODE" default:"disable"`
+	AllowInsecureDB       bool     `long:"allow-insecure-db" env:"UPLOADER_ALLOW_INSECURE_DB" description:"Connect to a database on another host without verify-full TLS"`
+	Migrate               string   `long:"migrate" env:"UPLOADER_MIGRATE" default:"check" choice:"auto" choice:"check" description:"On startup, only check both databases' schemas are up to date, or bring them up to date as a user that may"`
+	UploadWorkers         int      `long:"upload-workers" env:"UPLOADER_UPLOAD_WORKERS" default:"4" description:"Images uploaded to S3 at once"`
+	BatchSize             int      `long:"batch-size" env:"UPLOADER_BATCH_SIZE" default:"20" description:"Events inserted together, at most"`
+	BatchWaitMs           int      `long:"batch-wait-ms" env:"UPLOADER_BATCH_WAIT_MS" default:"1000" description:"Longest an event waits for others to be inserted with"`
+	PlateMode             string   `long:"plate-mode" env:"UPLOADER_PLATE_MODE" default:"plain" choice:"plain" choice:"hashed" description:"Record plates as read, or only as keyed hashes"`
+	PlateKeys             []string `long:"plate-keys" env:"UPLOADER_PLATE_KEYS" env-delim:"," description:"Keys plates are hashed with, as id=key, the first hashing new events" secret:"true"`
+	PlateSealKey          string   `long:"plate-seal-key" env:"UPLOADER_PLATE_SEAL_KEY" description:"RSA public key, as a PEM file, hashed plates are also encrypted to"`
+	EventIntervalTime     time.Duration
+	BatchWait             time.Duration
+	// Pseudonyms hash the plates, and Sealer seals them, with plate-mode:
+	// hashed. They are loaded once, by Init, and never change.
+	Pseudonyms pseudonym.Keys
+	Sealer     *pseudonym.Sealer
+}
+
+// maxBatchSize keeps a batch's insert within Postgres's 65535 parameters.
+const maxBatchSize = 1000
+
+// Validate checks the options make sense together.
+func (o *Options) Validate() error {
+	switch {
+	case o.PlateImageHeight <= 0 || o.FrameImageHeight <= 0:
+		return errors.New("plate-image-height and frame-image-height must be positive")
+	case o.PlateImageQuality > 100 || o.FrameImageQuality <= 0 || o.FrameImageQuality > 100:
+		return errors.New("image qualities are between 1 and 100")
+	case o.EventIntervalTimeSecs < 0:
+		return errors.New("event-interval-time must not be negative")
+	case o.BackoffMaxSecs <= 0:
+		return errors.New("backoff-max must be positive")
+	case o.RemotePostgresHost == "" && o.RemotePostgresDSN == "":
+		return errors.New("remote-postgres-host or remote-postgres-dsn must be set")
+	case o.LocalPostgresHost == "" && o.LocalPostgresDSN == "":
+		return errors.New("local-postgres-host or local-postgres-dsn must be set")
+	case o.UploadWorkers <= 0:
+		return errors.New("upload-workers must be positive")
+	case o.BatchSize <= 0 || o.BatchSize > maxBatchSize:
+		return fmt.Errorf("batch-size must be between 1 and %d", maxBatchSize)
+	case o.BatchWaitMs < 0:
+		return errors.New("batch-wait-ms must not be negative")
+	case o.BatchWaitMs >= o.JobTTRSecs*1000/2:
+		// Jobs are held while their batch fills, and must be deleted
+		// before their time-to-run is up.
+		return errors.New("batch-wait-ms must be under half of job-ttr")
+	}
+	if err := o.validatePlates(); err != nil {
+		return err
+	}
+	if err := o.RemoteDB().Check(o.AllowInsecureDB); err != nil {
+		return fmt.Errorf("remote database: %s", err)
+	}
+	if err := o.LocalDB().Check(o.AllowInsecureDB); err != nil {
+		return fmt.Errorf("local database: %s", err)
+	}
+	return o.Common.Validate()
+}
+
+// validatePlates checks the keys plate-mode: hashed needs.
+func (o *Options) validatePlates() error {
+	if o.PlateMode != "hashed" {
+		if len(o.PlateKeys) > 0 || o.PlateSealKey != "" {
+			return errors.New("plate-keys and plate-seal-key are only used with plate-mode: hashed")
+		}
+		return nil
+	}
+	if len(o.PlateKeys) == 0 {
+		return errors.New("plate-mode: hashed needs plate-keys")
+	}
+	if _, err := pseudonym.ParseKeys(o.PlateKeys); err != nil {
+		return err
+	}
+	if o.PlateSealKey != "" {
+		if _, err := pseudonym.LoadSealer(o.PlateSealKey); err != nil {
+			return fmt.Errorf("plate-seal-key: %s", err)
+		}
+	}
+	return nil
+}
+
+// RemoteDB is how to connect to the events database.
+func (o *Options) RemoteDB() pgconn.Config {
+	return pgconn.Config{
+		DSN:         o.RemotePostgresDSN,
+		Host:        o.RemotePostgresHost,
+		Port:        o.RemotePostgresPort,
+		User:        o.RemotePostgresUser,
+		Password:    o.RemotePostgresPass,
+		DB:          o.RemotePostgresDB,
+		SSLMode:     o.RemotePostgresSSLMode,
+		SSLRootCert: o.RemotePostgresSSLRoot,
+		SSLCert:     o.RemotePostgresSSLCert,
+		SSLKey:      o.RemotePostgresSSLKey,
+	}
+}
+
+// LocalDB is how to connect to the Pi's own database, which keeps when
+// plates were last seen.
+func (o *Options) LocalDB() pgconn.Config {
+	return pgconn.Config{
+		DSN:      o.LocalPostgresDSN,
+		Host:     o.LocalPostgresHost,
+		Port:     o.LocalPostgresPort,
+		User:     o.LocalPostgresUser,
+		Password: o.LocalPostgresPass,
+		DB:       o.LocalPostgresDB,
+		SSLMode:  o.LocalPostgresSSLMode,
+	}
+}
+
+func (o *Options) derive() {
+	o.EventIntervalTime = time.Duration(o.EventIntervalTimeSecs) * time.Second
+	o.BatchWait = time.Duration(o.BatchWaitMs) * time.Millisecond
+}
+
+// loadPlateKeys loads the plate keys and seal key.
+func (o *Options) loadPlateKeys() error {
+	var err error
+	if o.Pseudonyms, err = pseudonym.ParseKeys(o.PlateKeys); err != nil {
+		return err
+	}
+	if o.PlateSealKey != "" {
+		if o.Sealer, err = pseudonym.LoadSealer(o.PlateSealKey); err != nil {
+			return fmt.Errorf("plate-seal-key: %s", err)
+		}
+	}
+	return nil
+}
+
+// Opts is the application config struct that we allow external access too.
+// Reloadable settings must be read through Snapshot.
+var Opts Options
+
+var (
+	mu   sync.RWMutex
+	args []string
+)
+
+// Init parses the options from the config file, env vars and args.
+func Init(cliArgs []string) {
+	args = cliArgs
+	err := settings.Parse("uploader", &Opts, args)
+	if err != nil {
+		log.Println(err)
+		log.Println("Missing ENV vars containing configuration, try `. lpr.env`")
+		os.Exit(1)
+	}
+	if err := Opts.loadPlateKeys(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	Opts.derive()
+	Opts.SetupLogging("uploader")
+}
+
+// Reload re-reads the configuration and applies the reloadable settings,
+// returning the names of those that changed.
+func Reload() ([]string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	changed, err := settings.Reload("uploader", &Opts, args)
+	if err != nil {
+		return nil, err
+	}
+	Opts.derive()
+	Opts.ReloadLogging()
+	return changed, nil
+}
+
+// Snapshot returns a copy of the options that is safe to read during a reload.
+func Snapshot() Options {
+	mu.RLock()
+	defer mu.RUnlock()
+	return Opts
+}
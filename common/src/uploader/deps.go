@@ -0,0 +1,207 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"sync"
+	"time"
+
+	"uploader/config"
+	"uploader/img"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/openalpr/openalpr"
+)
+
+// Dependencies are everything the uploader talks to outside the process, so
+// tests can swap in fakes.
+type Dependencies struct {
+	Images ImageMaker
+	Store  ObjectStore
+	Events EventSink
+	Recent RecentPlates
+}
+
+// ImageMaker makes the plate crop and frame thumbnail sent with an event.
+type ImageMaker interface {
+	Plate(filename string, points []openalpr.AlprCoordinate) (*bytes.Buffer, error)
+	Frame(filename string) (*bytes.Buffer, error)
+}
+
+// ObjectStore keeps the images, returning the URL each can be fetched from.
+type ObjectStore interface {
+	Put(ctx context.Context, name string, body *bytes.Buffer) (string, error)
+}
+
+// Event is a plate seen by a camera, as sent to the event sink.
+type Event struct {
+	// ID is the same every time the event is sent, so the sink can tell a
+	// retry from a new event.
+	ID string
+	// PriorIDs are the IDs the event had under older plate keys, so one
+	// sent before the keys were rotated is still recognised.
+	PriorIDs   []string
+	Time       time.Time
+	Camera     string
+	Site       string
+	Plate      string
+	Confidence float32
+	PlateImage string
+	FrameImage string
+	// With plate-mode: hashed, Plate is the pseudonym and PlateSealed the
+	// plate encrypted to the seal key, if there is one.
+	PlateSealed string
+	// What OpenALPR gave for the plate, kept as evidence.
+	Candidates       []openalpr.AlprPlate
+	Coordinates      []openalpr.AlprCoordinate
+	Region           string
+	RegionConfidence int
+	MatchesTemplate  bool
+	ProcessingMs     float32
+	ImageWidth       int
+	ImageHeight      int
+	// Host is the detector's, and CorrelationID and JobID identify the frame
+	// and detection job.
+	Host          string
+	CorrelationID string
+	JobID         uint64
+}
+
+// EventSink receives the events. Send records a batch of events together,
+// all or none of them, and reports for each whether the sink already had an
+// event with its ID or one of its PriorIDs, which is then left as it was.
+type EventSink interface {
+	Send(ctx context.Context, events []Event) (recorded []bool, err error)
+}
+
+// RecentPlates remembers when each plate was last seen, so a car sat in
+// front of the camera is only sent once per event interval. Seen records the
+// sighting and reports whether the plate, or any of its aliases, was seen
+// within the interval. Aliases are names the plate had before, under older
+// plate keys, which are checked but not recorded. Forget drops the record,
+// for when its event couldn't be sent after all.
+type RecentPlates interface {
+	Seen(ctx context.Context, plate string, at time.Time, aliases ...string) (bool, error)
+	Forget(ctx context.Context, plate string) error
+}
+
+// Close closes the dependencies that can be closed.
+func (d Dependencies) Close() {
+	for _, dep := range []interface{}{d.Images, d.Store, d.Events, d.Recent} {
+		if c, ok := dep.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// pinger is a dependency that can report whether it is reachable.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Magick makes the images with GraphicsMagick or ImageMagick.
+type Magick struct{}
+
+// Plate crops the plate out of the frame.
+func (Magick) Plate(filename string, points []openalpr.AlprCoordinate) (*bytes.Buffer, error) {
+	return img.CreatePlateImage(filename, points)
+}
+
+// Frame makes a thumbnail of the frame.
+func (Magick) Frame(filename string) (*bytes.Buffer, error) {
+	return img.CreateFrameThumbnail(filename)
+}
+
+// S3 stores the images in the configured bucket.
+type S3 struct {
+	Uploader *s3manager.Uploader
+}
+
+// Put uploads the image.
+func (s S3) Put(ctx context.Context, name string, body *bytes.Buffer) (string, error) {
+	return UploadFile(ctx, name, body, s.Uploader)
+}
+
+// PostgresEvents inserts the events into the remote database.
+type PostgresEvents struct {
+	DB *sql.DB
+}
+
+// Send inserts the events.
+func (p PostgresEvents) Send(ctx context.Context, events []Event) ([]bool, error) {
+	return SendEvents(ctx, p.DB, events)
+}
+
+// Ping checks the database can be reached.
+func (p PostgresEvents) Ping(ctx context.Context) error {
+	return p.DB.PingContext(ctx)
+}
+
+// Close disconnects from the database.
+func (p PostgresEvents) Close() error {
+	return p.DB.Close()
+}
+
+// PostgresRecent keeps when plates were last seen in the local database.
+type PostgresRecent struct {
+	DB *sql.DB
+}
+
+// Seen records the sighting, reporting whether the plate was seen recently.
+func (p PostgresRecent) Seen(ctx context.Context, plate string, at time.Time, aliases ...string) (bool, error) {
+	return CheckRecent(ctx, p.DB, plate, &at, aliases...)
+}
+
+// Forget drops the plate's last seen marker.
+func (p PostgresRecent) Forget(ctx context.Context, plate string) error {
+	return ForgetRecent(ctx, p.DB, plate)
+}
+
+// Ping checks the database can be reached.
+func (p PostgresRecent) Ping(ctx context.Context) error {
+	return p.DB.PingContext(ctx)
+}
+
+// Close disconnects from the database.
+func (p PostgresRecent) Close() error {
+	return p.DB.Close()
+}
+
+// MemoryRecent keeps when plates were last seen in memory, comparing event
+// times rather than the clock, so frames from the past dedup as they did
+// when they were live.
+type MemoryRecent struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// NewMemoryRecent returns an empty MemoryRecent.
+func NewMemoryRecent() *MemoryRecent {
+	return &MemoryRecent{last: make(map[string]time.Time)}
+}
+
+// Seen records the sighting, reporting whether the plate was seen within the
+// event interval before it.
+func (m *MemoryRecent) Seen(ctx context.Context, plate string, at time.Time, aliases ...string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	interval := config.Snapshot().EventIntervalTime
+	seen := false
+	for _, name := range append([]string{plate}, aliases...) {
+		if last, ok := m.last[name]; ok && at.Sub(last) <= interval {
+			seen = true
+		}
+	}
+	m.last[plate] = at
+	return seen, nil
+}
+
+// Forget drops the plate's sighting.
+func (m *MemoryRecent) Forget(ctx context.Context, plate string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.last, plate)
+	return nil
+}
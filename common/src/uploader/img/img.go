@@ -1,11 +1,12 @@
+//go:build gm
 // +build gm
 
 package img
 
 import (
 	"bytes"
-	"config"
 	"errors"
+	"uploader/config"
 
 	"github.com/openalpr/openalpr"
 	"github.com/rainycape/magick"
@@ -63,7 +64,8 @@ func CreatePlateImage(filename string, points []openalpr.AlprCoordinate) (*bytes
 	}
 
 	// Resize the thumb
-	resizedCropped, err := croppedPlate.Resize(-1, config.Opts.PlateImageHeight, magick.FLanczos)
+	opts := config.Snapshot()
+	resizedCropped, err := croppedPlate.Resize(-1, opts.PlateImageHeight, magick.FLanczos)
 	if err != nil {
 		return nil, err
 	}
@@ -73,7 +75,7 @@ func CreatePlateImage(filename string, points []openalpr.AlprCoordinate) (*bytes
 
 	// Set output options
 	info := magick.NewInfo()
-	info.SetQuality(config.Opts.PlateImageQuality)
+	info.SetQuality(opts.PlateImageQuality)
 	info.SetColorspace(magick.GRAY)
 
 	// Encode the final image.
@@ -94,7 +96,8 @@ func CreateFrameThumbnail(filename string) (*bytes.Buffer, error) {
 	}
 
 	// Resize it.
-	resized, err := img.Resize(-1, config.Opts.FrameImageHeight, magick.FLanczos)
+	opts := config.Snapshot()
+	resized, err := img.Resize(-1, opts.FrameImageHeight, magick.FLanczos)
 	if err != nil {
 		return nil, err
 	}
@@ -104,7 +107,7 @@ func CreateFrameThumbnail(filename string) (*bytes.Buffer, error) {
 
 	// Set output options
 	info := magick.NewInfo()
-	info.SetQuality(config.Opts.PlateImageQuality)
+	info.SetQuality(opts.PlateImageQuality)
 
 	// Encode the final image.
 	err = resized.Encode(&plateBytes, info)
@@ -1,11 +1,12 @@
+//go:build gm
 // +build gm
 
 package img
 
 import (
-	"config"
 	"testing"
-	"utils"
+	"uploader/config"
+	"uploader/utils"
 
 	"github.com/openalpr/openalpr"
 )
@@ -0,0 +1,16 @@
+package uploader
+
+import "migrate"
+
+// RecentSchema is the local database's tables, where each Pi remembers the
+// plates it has seen recently.
+//
+// Migrations are only ever added: a deployed one must not change.
+var RecentSchema = migrate.Schema{Name: "recent", Migrations: []migrate.Migration{
+	{Version: 1, Name: "baseline", SQL: `
+CREATE TABLE IF NOT EXISTS last_seen (
+    plate text PRIMARY KEY,
+    time timestamptz NOT NULL
+);
+`},
+}}
@@ -0,0 +1,229 @@
+package timestamp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Where a timestamp came from.
+const (
+	FromFilename = "filename"
+	FromExif     = "exif"
+	FromMtime    = "mtime"
+	FromNow      = "now"
+)
+
+// MotionTemplate is the picture_filename in our motion.conf.
+const MotionTemplate = "%v-%Y%m%d%H%M%S-%q"
+
+// Parser extracts the time an image was taken. It first parses the file name
+// using a template, then tries each fallback in turn. Times in file names and
+// EXIF have no zone, so they are read in the camera's Location.
+type Parser struct {
+	Location  *time.Location
+	Fallbacks []string
+
+	// Either a Go layout or a regexp compiled from Motion specifiers.
+	layout string
+	re     *regexp.Regexp
+
+	fallbackCount uint64
+}
+
+// motionSpecifiers maps the Motion/strftime conversion specifiers we know how
+// to read into regexps. Named groups hold the date and time parts.
+var motionSpecifiers = map[byte]string{
+	'Y': `(?P<Y>\d{4})`,
+	'y': `(?P<y>\d{2})`,
+	'm': `(?P<m>\d{2})`,
+	'd': `(?P<d>\d{2})`,
+	'H': `(?P<H>\d{2})`,
+	'M': `(?P<M>\d{2})`,
+	'S': `(?P<S>\d{2})`,
+	'F': `(?P<Y>\d{4})-(?P<m>\d{2})-(?P<d>\d{2})`,
+	'T': `(?P<H>\d{2}):(?P<M>\d{2}):(?P<S>\d{2})`,
+	'v': `\d+`,
+	'q': `\d+`,
+	't': `\d+`,
+	'D': `\d+`,
+	'N': `\d+`,
+	'i': `\d+`,
+	'J': `\d+`,
+	'K': `\d+`,
+	'L': `\d+`,
+	'C': `.*?`,
+	'%': `%`,
+}
+
+// compileMotion turns a Motion filename template into an anchored regexp.
+func compileMotion(template string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '%' {
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+			continue
+		}
+		i++
+		if i == len(template) {
+			return nil, fmt.Errorf("Template %q ends with a lone %%", template)
+		}
+		spec, ok := motionSpecifiers[template[i]]
+		if !ok {
+			return nil, fmt.Errorf("Template %q has unsupported specifier %%%c", template, template[i])
+		}
+		expr.WriteString(spec)
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	names := strings.Join(re.SubexpNames(), ",")
+	if !strings.Contains(names, "Y") && !strings.Contains(names, "y") {
+		return nil, fmt.Errorf("Template %q has no year", template)
+	}
+	return re, nil
+}
+
+// NewParser returns a Parser for the template, which is either a Motion
+// picture_filename (anything containing a %) or a Go time layout, matched
+// against the file name without its extension. Fallbacks are tried in order
+// and may be "exif", "mtime" or "now".
+func NewParser(template string, location string, fallbacks []string) (*Parser, error) {
+	loc, err := time.LoadLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	p := &Parser{Location: loc}
+
+	if strings.Contains(template, "%") {
+		p.re, err = compileMotion(template)
+		if err != nil {
+			return nil, err
+		}
+	} else if template != "" {
+		p.layout = template
+	} else {
+		return nil, errors.New("Empty filename template")
+	}
+
+	for _, fallback := range fallbacks {
+		switch fallback {
+		case FromExif, FromMtime, FromNow:
+			p.Fallbacks = append(p.Fallbacks, fallback)
+		case "":
+		default:
+			return nil, fmt.Errorf("Unknown timestamp fallback %q", fallback)
+		}
+	}
+	return p, nil
+}
+
+// FallbackCount returns how many times the file name couldn't be parsed.
+func (p *Parser) FallbackCount() uint64 {
+	return atomic.LoadUint64(&p.fallbackCount)
+}
+
+// Parse returns the UTC time the image was taken and where that time came
+// from. When the file name can't be parsed the error says why, and the time
+// comes from the first fallback that works. If none do, the time is zero.
+func (p *Parser) Parse(file string) (time.Time, string, error) {
+	t, err := p.ParseFilename(file)
+	if err == nil {
+		return t.UTC(), FromFilename, nil
+	}
+	atomic.AddUint64(&p.fallbackCount, 1)
+
+	for _, fallback := range p.Fallbacks {
+		var fallbackErr error
+		switch fallback {
+		case FromExif:
+			t, fallbackErr = p.ParseExif(file)
+		case FromMtime:
+			var info os.FileInfo
+			info, fallbackErr = os.Stat(file)
+			if fallbackErr == nil {
+				t = info.ModTime()
+			}
+		case FromNow:
+			t = time.Now()
+		}
+		if fallbackErr == nil {
+			return t.UTC(), fallback, err
+		}
+	}
+	return time.Time{}, "", err
+}
+
+// ParseFilename reads the time from the file name only.
+func (p *Parser) ParseFilename(file string) (time.Time, error) {
+	name := filepath.Base(file)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+
+	if p.re == nil {
+		return time.ParseInLocation(p.layout, name, p.Location)
+	}
+
+	match := p.re.FindStringSubmatch(name)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("File name %q doesn't match the template", name)
+	}
+	parts := map[string]int{"m": 1, "d": 1}
+	for i, group := range p.re.SubexpNames() {
+		if group == "" {
+			continue
+		}
+		n, err := strconv.Atoi(match[i])
+		if err != nil {
+			return time.Time{}, err
+		}
+		parts[group] = n
+	}
+	year, ok := parts["Y"]
+	if !ok {
+		year = 2000 + parts["y"]
+	}
+	t := time.Date(year, time.Month(parts["m"]), parts["d"], parts["H"], parts["M"], parts["S"], 0, p.Location)
+
+	// time.Date normalises out of range values, so 20161340 would otherwise
+	// quietly become a date in 2017.
+	if int(t.Month()) != parts["m"] || t.Day() != parts["d"] || t.Hour() != parts["H"] ||
+		t.Minute() != parts["M"] || t.Second() != parts["S"] {
+		return time.Time{}, fmt.Errorf("File name %q has an invalid date", name)
+	}
+	return t, nil
+}
+
+// ParseExif reads DateTimeOriginal from the image's EXIF data.
+func (p *Parser) ParseExif(file string) (time.Time, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	x, err := exif.Decode(f)
+	if err != nil {
+		return time.Time{}, err
+	}
+	tag, err := x.Get(exif.DateTimeOriginal)
+	if err != nil {
+		return time.Time{}, err
+	}
+	value, err := tag.StringVal()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation("2006:01:02 15:04:05", strings.TrimRight(value, "\x00 "), p.Location)
+}
@@ -0,0 +1,100 @@
+package timestamp
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseMotionTemplate(t *testing.T) {
+	p, err := NewParser(MotionTemplate, "UTC", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stamp, source, err := p.Parse("/var/lib/motion/02-20160920135426-14.jpg")
+	if err != nil || source != FromFilename || stamp.String() != "2016-09-20 13:54:26 +0000 UTC" {
+		t.Errorf("Failed happy path: %s %s %v", stamp, source, err)
+	}
+
+	for _, file := range []string{"20160920135426-14.jpg", "", "02-201d0920135426-14.jpg", "02-20161340135426-14.jpg"} {
+		stamp, source, err = p.Parse(file)
+		if err == nil || !stamp.IsZero() || source != "" {
+			t.Errorf("Expected an error and no time for %q: %s %s", file, stamp, source)
+		}
+	}
+	if p.FallbackCount() != 4 {
+		t.Errorf("Expected 4 fallbacks, got %d", p.FallbackCount())
+	}
+}
+
+func TestParseTimezone(t *testing.T) {
+	p, err := NewParser(MotionTemplate, "Europe/London", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// BST is an hour ahead of UTC.
+	stamp, _, err := p.Parse("02-20160920135426-14.jpg")
+	if err != nil || stamp.String() != "2016-09-20 12:54:26 +0000 UTC" {
+		t.Errorf("Expected local time converted to UTC: %s %v", stamp, err)
+	}
+
+	if _, err = NewParser(MotionTemplate, "Nowhere/Special", nil); err == nil {
+		t.Error("Expected an error for an unknown timezone")
+	}
+}
+
+func TestParseOtherTemplates(t *testing.T) {
+	cases := map[string]string{
+		"cam%t_%F_%T":        "cam1_2016-09-20_13:54:26.jpg",
+		"%C-%y%m%d%H%M%S":    "gate-160920135426.png",
+		"img-20060102150405": "img-20160920135426.jpg",
+	}
+	for template, file := range cases {
+		p, err := NewParser(template, "UTC", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stamp, _, err := p.Parse(file)
+		if err != nil || stamp.String() != "2016-09-20 13:54:26 +0000 UTC" {
+			t.Errorf("Template %q file %q: %s %v", template, file, stamp, err)
+		}
+	}
+
+	for _, template := range []string{"", "%v-%Z", "%v-%", "%v-%q"} {
+		if _, err := NewParser(template, "UTC", nil); err == nil {
+			t.Errorf("Expected an error for template %q", template)
+		}
+	}
+}
+
+func TestParseFallbacks(t *testing.T) {
+	f, err := ioutil.TempFile("", "noexif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	mtime := time.Date(2016, 9, 20, 13, 54, 26, 0, time.UTC)
+	os.Chtimes(f.Name(), mtime, mtime)
+
+	p, err := NewParser(MotionTemplate, "UTC", []string{FromExif, FromMtime, FromNow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp, source, err := p.Parse(f.Name())
+	if err == nil || source != FromMtime || !stamp.Equal(mtime) {
+		t.Errorf("Expected mtime fallback: %s %s %v", stamp, source, err)
+	}
+
+	stamp, source, err = p.Parse("/does/not/exist.jpg")
+	if err == nil || source != FromNow || time.Since(stamp) > time.Minute {
+		t.Errorf("Expected now fallback: %s %s %v", stamp, source, err)
+	}
+
+	if _, err = NewParser(MotionTemplate, "UTC", []string{"sundial"}); err == nil {
+		t.Error("Expected an error for an unknown fallback")
+	}
+}
@@ -0,0 +1,730 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/openalpr/openalpr"
+
+	"github.com/lib/pq"
+
+	"deadletter"
+	"events"
+	"health"
+	"jobs"
+	"ledger"
+	"logging"
+	"metrics"
+	"migrate"
+	"pgconn"
+	"queue"
+	"settings"
+	"shutdown"
+	"uploader/config"
+	"uploader/img"
+	"uploader/timestamp"
+)
+
+var logger = logging.With("service", "uploader")
+
+// Uploader sends an event for each plate in a detection event, with the
+// plate and frame images kept in an object store.
+type Uploader struct {
+	deps        Dependencies
+	timeParser  *timestamp.Parser
+	pending     *ledger.Ledger
+	deadLetters *deadletter.Store
+	status      *health.Registry
+	// workers holds a place for each image being uploaded.
+	workers chan struct{}
+}
+
+// New connects to the databases and S3 and sets up the uploader from
+// config.Opts, which config.Init must have filled in. Close disconnects.
+func New() (*Uploader, error) {
+	deps, err := Connect()
+	if err != nil {
+		return nil, err
+	}
+	u, err := NewWith(deps)
+	if err != nil {
+		deps.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+// Connect connects to the databases and S3 configured in config.Opts.
+func Connect() (Dependencies, error) {
+	logger.Info("Uploader startup")
+	logger.Info("Image library", "lib", img.GetImageLib())
+
+	// Amazon S3 parameters
+	logger.Info("S3", "bucket", config.Opts.S3Bucket, "prefix", config.Opts.S3Prefix, "region", config.Opts.S3Region)
+	store := S3{Uploader: s3manager.NewUploader(session.New(&aws.Config{Region: aws.String(config.Opts.S3Region)}))}
+
+	// Remote Postgres DB parameters, checked by config.Init.
+	logger.Info("Remote DB", "host", config.Opts.RemotePostgresHost, "db", config.Opts.RemotePostgresDB, "sslmode", config.Opts.RemotePostgresSSLMode)
+	if config.Opts.RemoteDB().Superuser() {
+		logger.Warn("Connected as the postgres superuser, which is only needed to migrate: see lpr_uploader in scripts/roles.sql")
+	}
+	remoteDB, err := openDB(config.Opts.RemoteDB())
+	if err != nil {
+		return Dependencies{}, fmt.Errorf("remote DB: %s", err)
+	}
+
+	// Local Postgres DB parameters
+	localDB, err := openDB(config.Opts.LocalDB())
+	if err != nil {
+		remoteDB.Close()
+		return Dependencies{}, fmt.Errorf("local DB: %s", err)
+	}
+
+	// Sending events assumes the columns of the schema it was built with.
+	auto := config.Opts.Migrate == "auto"
+	for _, d := range []struct {
+		schema migrate.Schema
+		db     *sql.DB
+	}{{events.Schema, remoteDB}, {RecentSchema, localDB}} {
+		if err := ensureSchema(d.schema, d.db, auto); err != nil {
+			remoteDB.Close()
+			localDB.Close()
+			return Dependencies{}, err
+		}
+	}
+	if config.Opts.PlateMode == "hashed" {
+		if err := forgetPlain(localDB); err != nil {
+			remoteDB.Close()
+			localDB.Close()
+			return Dependencies{}, fmt.Errorf("local DB: %s", err)
+		}
+	}
+
+	return Dependencies{
+		Images: Magick{},
+		Store:  store,
+		Events: PostgresEvents{DB: remoteDB},
+		Recent: PostgresRecent{DB: localDB},
+	}, nil
+}
+
+// NewWith sets up the uploader from config.Opts to use the given
+// dependencies. Dependencies that can be pinged are checked for readiness,
+// and those that can be closed are closed by Close.
+func NewWith(deps Dependencies) (*Uploader, error) {
+	u := &Uploader{deps: deps, workers: make(chan struct{}, config.Opts.UploadWorkers)}
+
+	// Event times come from the frame's file name, in the camera's timezone.
+	var err error
+	u.timeParser, err = timestamp.NewParser(config.Opts.FilenameTemplate, config.Opts.CameraTimezone, config.Opts.TimeFallbacks)
+	if err != nil {
+		return nil, fmt.Errorf("timestamp: %s", err)
+	}
+	logger.Info("Event times", "filename_template", config.Opts.FilenameTemplate, "timezone", u.timeParser.Location, "fallbacks", u.timeParser.Fallbacks)
+
+	// Frames are pinned against retention until their event is uploaded.
+	u.pending, err = ledger.Open(config.Opts.LedgerDir)
+	if err != nil {
+		return nil, fmt.Errorf("ledger: %s", err)
+	}
+
+	// Jobs that keep failing are buried, with the reason kept for dlq.
+	u.deadLetters, err = deadletter.Open(config.Opts.DeadLetterDir)
+	if err != nil {
+		return nil, fmt.Errorf("dead letter: %s", err)
+	}
+
+	// The loop comes round at least every reserve timeout, unless a single
+	// event outlasts the job's time-to-run.
+	u.status = health.New(config.Opts.ReserveTimeout() + 2*config.Opts.JobTTR())
+	u.status.Expect("queue")
+	u.status.Set("s3", nil)
+	u.status.Info("last_upload", "never")
+	if p, ok := deps.Recent.(pinger); ok {
+		u.status.Check("local_db", p.Ping)
+	}
+	if p, ok := deps.Events.(pinger); ok {
+		u.status.Check("remote_db", p.Ping)
+	}
+	return u, nil
+}
+
+// ensureSchema brings the database up to date, if auto, or checks it is.
+func ensureSchema(schema migrate.Schema, db *sql.DB, auto bool) error {
+	// Another uploader may hold the lock while it migrates.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	applied, err := schema.Ensure(ctx, db, auto)
+	if err != nil {
+		return fmt.Errorf("%s schema: %s", schema.Name, err)
+	}
+	if len(applied) > 0 {
+		logger.Info("Migrated", "schema", schema.Name, "applied", applied, "version", schema.Latest())
+	}
+	return nil
+}
+
+// openDB opens a Postgres connection pool and checks it can connect.
+func openDB(c pgconn.Config) (*sql.DB, error) {
+	connectStr, err := c.ConnectString()
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", connectStr)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Status is the uploader's health.
+func (u *Uploader) Status() *health.Registry {
+	return u.status
+}
+
+// Close closes the dependencies that can be closed.
+func (u *Uploader) Close() {
+	u.deps.Close()
+}
+
+// Run reserves detection events from in until ctx is cancelled or in is
+// closed and drained. The job in hand when ctx is cancelled gets the shutdown
+// grace to finish, after which it is released for a retry.
+func (u *Uploader) Run(ctx context.Context, in queue.Tube) error {
+	// Image sizes and the dedup interval can be changed without a restart.
+	settings.OnSighup(func() {
+		changed, err := config.Reload()
+		if err != nil {
+			logger.Error("Reload", "err", err)
+			return
+		}
+		logger.Info("Reloaded configuration", "changed", changed)
+	})
+
+	// Metrics and health are served over HTTP for Prometheus and monitoring.
+	server := &http.Server{Addr: config.Opts.HTTPAddr}
+	if server.Addr != "" {
+		mux := http.NewServeMux()
+		u.status.Handle(mux)
+		mux.Handle("/metrics", metrics.Handler(append(metrics.Uploader(), metrics.Tubes(in)...)...))
+		server.Handler = mux
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Error("HTTP", "err", err)
+			}
+		}()
+	}
+	defer server.Close()
+
+	// Jobs are held until their events are sent with the rest of a batch,
+	// and the batch in hand when shutdown starts is sent before Run returns.
+	var pending batch
+	defer u.flush(in, &pending)
+
+	reserveTimeout := config.Opts.ReserveTimeout()
+	backoff := config.Opts.Backoff(time.Duration(config.Opts.BackoffMaxSecs) * time.Second)
+	logger.Info("Reserving", "detection_tube", in.Name(), "reserve_timeout", reserveTimeout,
+		"batch_size", config.Opts.BatchSize, "batch_wait", config.Opts.BatchWait, "upload_workers", config.Opts.UploadWorkers)
+
+	// Once shutdown starts no more jobs are reserved, which takes at most the
+	// reserve timeout to notice.
+	for ctx.Err() == nil {
+		timeout := pending.timeout(reserveTimeout)
+		if timeout == 0 {
+			u.flush(in, &pending)
+			continue
+		}
+		id, payloadBytes, err := in.Reserve(timeout)
+		u.status.Beat()
+		switch {
+		case err == queue.ErrClosed && len(pending.jobs) > 0:
+			// Jobs that fail are released, and come back to be retried.
+			u.flush(in, &pending)
+			continue
+		case err == queue.ErrClosed:
+			logger.Info("Uploader stopped", "reason", "input closed")
+			return nil
+		case err != nil && err != queue.ErrTimeout:
+			// The tube reconnects on the next reserve.
+			backoffTime := backoff.Duration()
+			logger.Error("Reserve", "sleeping", backoffTime, "err", err)
+			u.status.Set("queue", err)
+			shutdown.Sleep(ctx, backoffTime)
+			continue
+		}
+		backoff.Reset()
+		u.status.Set("queue", nil)
+		u.status.NotifyReady()
+		if err == nil {
+			if j := u.prepare(ctx, in, id, payloadBytes); j != nil {
+				pending.add(j, config.Opts.BatchWait)
+			}
+			if pending.events >= config.Opts.BatchSize {
+				u.flush(in, &pending)
+			}
+		}
+	}
+	logger.Info("Uploader stopped")
+	return nil
+}
+
+// prepare makes the events for one detection event and starts uploading
+// their images, returning the job to be finished once its events are sent,
+// or nil if it has already failed.
+func (u *Uploader) prepare(ctx context.Context, in queue.Tube, id uint64, payloadBytes []byte) *job {
+	j := &job{id: id, log: logger.With("job_id", id)}
+
+	// Unmarshal the payload containing the filename and detection event.
+	payload, err := jobs.DecodeDetectionEvent(payloadBytes)
+	if err != nil {
+		u.fail(in, j, deadletter.Permanent(fmt.Errorf("payload: %s", err)))
+		return nil
+	}
+	j.filename = payload.Filename
+	j.ctx, j.done = shutdown.Grace(ctx, config.Opts.ShutdownGrace())
+
+	// Events from older detectors carry no camera identity.
+	camera, site := payload.Camera, payload.Site
+	if camera == "" {
+		camera = config.Opts.Camera
+	}
+	if site == "" {
+		site = config.Opts.Site
+	}
+	j.log = j.log.With("correlation_id", payload.CorrelationID, "file", payload.Filename, "camera", camera)
+	j.log.Info("Uploading detection", "plates", len(payload.AlprResults.Plates))
+
+	eventTime, source, err := u.timeParser.Parse(payload.Filename)
+	if err != nil {
+		// We're supposed to be able to extract the timestamp from the
+		// file name, so count and log every time we fall back.
+		j.log.Error("Timestamp", "err", err, "using", source, "fallbacks", u.timeParser.FallbackCount())
+		metrics.TimestampFallbacks.WithLabelValues(source).Inc()
+		if eventTime.IsZero() {
+			eventTime = time.Now().UTC()
+		}
+	}
+
+	// Iterate over all the detected plates in the image. The job is
+	// retried if its events can't be sent, and the events already sent
+	// are then caught by the dedup check, or failing that by their ids.
+	hashed := config.Opts.PlateMode == "hashed"
+	var plates []openalpr.AlprPlateResult
+	for i, plate := range payload.AlprResults.Plates {
+		if j.ctx.Err() != nil {
+			return j
+		}
+		eventID := payload.PlateEventID(i, camera)
+		plateText := plate.BestPlate
+		var priorIDs, aliases []string
+		if hashed {
+			// The uploader records neither the plate nor anything it could
+			// be guessed from without the keys. The older keys' ids and
+			// pseudonyms catch events and sightings from before the keys
+			// were rotated.
+			ids := config.Opts.Pseudonyms.EventIDs(eventID)
+			eventID, priorIDs = ids[0], ids[1:]
+			pseudonyms := config.Opts.Pseudonyms.All(plate.BestPlate)
+			plateText, aliases = pseudonyms[0], pseudonyms[1:]
+		}
+		plateLog := j.log.With("plate", plateText, "event_id", eventID)
+		// First check we haven't just sent this plate out
+		seenRecently, err := u.deps.Recent.Seen(j.ctx, plateText, eventTime, aliases...)
+		if err != nil {
+			// An error checking if the plate was seen recently: we will
+			// just log an error and then continue to attempt to send the event.
+			plateLog.Error("LocalDB", "err", err)
+		} else if seenRecently {
+			plateLog.Info("Plate seen recently, skipping")
+			metrics.DedupHits.Inc()
+			continue
+		}
+
+		event := Event{
+			ID:         eventID,
+			PriorIDs:   priorIDs,
+			Time:       eventTime,
+			Camera:     camera,
+			Site:       site,
+			Plate:      plateText,
+			Confidence: metrics.BestConfidence(plate),
+			PlateImage: config.Opts.PlaceholderImageURL,
+			FrameImage: config.Opts.PlaceholderImageURL,
+
+			Candidates:       plate.TopNPlates,
+			Coordinates:      plate.PlatePoints,
+			Region:           plate.Region,
+			RegionConfidence: plate.RegionConfidence,
+			MatchesTemplate:  metrics.BestCandidate(plate).MatchesTemplate,
+			ProcessingMs:     payload.AlprResults.TotalProcessingTimeMs,
+			ImageWidth:       payload.AlprResults.ImgWidth,
+			ImageHeight:      payload.AlprResults.ImgHeight,
+			Host:             payload.Host,
+			CorrelationID:    payload.CorrelationID,
+			JobID:            id,
+		}
+		if hashed {
+			if err := hidePlate(&event, plate.BestPlate); err != nil {
+				// An event sent without its sealed plate could never be
+				// revealed, so the job is retried instead.
+				for _, e := range append(j.events, event) {
+					if err := u.deps.Recent.Forget(context.Background(), e.Plate); err != nil {
+						j.log.Error("LocalDB", "plate", e.Plate, "err", err)
+					}
+				}
+				u.fail(in, j, fmt.Errorf("seal plate: %s", err))
+				return nil
+			}
+		}
+		plates = append(plates, plate)
+		j.events = append(j.events, event)
+	}
+
+	// Create the plate image and frame thumbnail for each event, and upload
+	// them to S3. The images are named after the event, so a retry
+	// overwrites the ones it sent before. In the event of errors creating
+	// the images, we still send the event, with the placeholder. Hashed
+	// plates keep the placeholders, as both images would show the plate.
+	if hashed {
+		return j
+	}
+	for i := range j.events {
+		event := &j.events[i]
+		plateLog := j.log.With("plate", event.Plate, "event_id", event.ID)
+		if plateBytes, err := u.deps.Images.Plate(payload.Filename, plates[i].PlatePoints); err != nil {
+			plateLog.Error("CreatePlateImage", "err", err)
+		} else {
+			u.upload(j, plateLog, event.ID+".plate.jpg", plateBytes, &event.PlateImage)
+		}
+		frameBytes, err := u.deps.Images.Frame(payload.Filename)
+		if err != nil {
+			plateLog.Error("CreateFrameThumbnail", "err", err)
+		} else {
+			u.upload(j, plateLog, event.ID+".frame.jpg", frameBytes, &event.FrameImage)
+		}
+	}
+	return j
+}
+
+// hidePlate replaces the candidates' plates with their pseudonyms, and
+// seals the plate if there is a seal key.
+func hidePlate(event *Event, plate string) error {
+	candidates := make([]openalpr.AlprPlate, len(event.Candidates))
+	for i, candidate := range event.Candidates {
+		candidate.Characters = config.Opts.Pseudonyms.Pseudonym(candidate.Characters)
+		candidates[i] = candidate
+	}
+	event.Candidates = candidates
+	if config.Opts.Sealer == nil {
+		return nil
+	}
+	sealed, err := config.Opts.Sealer.Seal(plate, event.Plate)
+	if err != nil {
+		return err
+	}
+	event.PlateSealed = sealed
+	return nil
+}
+
+// Main runs the uploader as a process of its own, taking detection events
+// from beanstalkd, and returns its exit code.
+func Main(args []string) int {
+	// Parse from the command line, allows testing to work.
+	config.Init(args)
+
+	// SIGTERM stops new jobs being reserved. The one in hand gets the
+	// shutdown grace to finish, after which it is released for a retry.
+	ctx := shutdown.OnSignal(config.Opts.ShutdownTimeout())
+
+	u, err := New()
+	if err != nil {
+		logger.Error("Startup", "err", err)
+		return 1
+	}
+	defer u.Close()
+	u.Status().Watchdog()
+	u.Status().NotifyStopping(ctx)
+
+	in := queue.NewBeanstalk(config.Opts.BeanstalkAddr, config.Opts.DetectionTube, config.Opts.JobPriority, config.Opts.JobTTR())
+	defer in.Close()
+	if err := u.Run(ctx, in); err != nil {
+		logger.Error("Stopped", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// MigrateMain brings the local and remote databases' schemas up to date.
+func MigrateMain(args []string) int {
+	config.Init(args)
+	config.Opts.Migrate = "auto"
+	deps, err := Connect()
+	if err != nil {
+		logger.Error("Migrate", "err", err)
+		return 1
+	}
+	deps.Close()
+	logger.Info("Schemas up to date", events.Schema.Name, events.Schema.Latest(), RecentSchema.Name, RecentSchema.Latest())
+	return 0
+}
+
+// recordUpload reports the outcome of the latest S3 upload as its health.
+func recordUpload(status *health.Registry, err error) {
+	status.Set("s3", err)
+	if err == nil {
+		status.Info("last_upload", time.Now().UTC().Format(time.RFC3339))
+	}
+}
+
+// CheckRecent checks whether we've seen this plate recently, under its name
+// or any of its aliases, and records the sighting under its name.
+func CheckRecent(ctx context.Context, db *sql.DB, plate string, timestamp *time.Time, aliases ...string) (bool, error) {
+	upsertQuery := "INSERT INTO last_seen (plate, time) VALUES (($1), ($2)) ON CONFLICT (plate) DO UPDATE SET time = ($2)"
+	var last_seen time.Time
+
+	names := pq.Array(append([]string{plate}, aliases...))
+	err := db.QueryRowContext(ctx, "SELECT time FROM last_seen WHERE plate = ANY($1) ORDER BY time DESC LIMIT 1", names).Scan(&last_seen)
+	switch {
+	case err == sql.ErrNoRows:
+		logger.Debug("Plate not seen before, inserting marker", "plate", plate, "time", *timestamp)
+		_, err = db.ExecContext(ctx, upsertQuery, plate, timestamp)
+		if err != nil {
+			return false, err
+		}
+		return false, nil
+
+	case err != nil:
+		return false, err
+
+	default:
+		timeago := Round(time.Since(last_seen), time.Millisecond)
+		interval := config.Snapshot().EventIntervalTime
+		if timeago > interval {
+			logger.Debug("Plate not seen recently, updating marker", "plate", plate, "marker_age", timeago, "interval", interval, "time", *timestamp)
+			_, err = db.ExecContext(ctx, upsertQuery, plate, timestamp)
+			if err != nil {
+				return false, err
+			}
+			return false, nil
+		} else {
+			logger.Debug("Plate seen recently, updating marker", "plate", plate, "marker_age", timeago, "time", *timestamp)
+			_, err = db.ExecContext(ctx, upsertQuery, plate, timestamp)
+			if err != nil {
+				return true, err
+			}
+			return true, nil
+		}
+	}
+}
+
+// ForgetRecent removes the plate's last seen marker, for when its event
+// couldn't be sent after all.
+func ForgetRecent(ctx context.Context, db *sql.DB, plate string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM last_seen WHERE plate = $1", plate)
+	return err
+}
+
+// forgetPlain drops the last seen markers of plates recorded as they were
+// read, left from before plate-mode: hashed, which only keeps pseudonyms.
+func forgetPlain(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	result, err := db.ExecContext(ctx, "DELETE FROM last_seen WHERE plate NOT LIKE '%:%'")
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		logger.Info("Dropped plates seen before plate-mode: hashed", "markers", n)
+	}
+	return nil
+}
+
+// SendEvents sends the events to the remote Postgres database in a single
+// insert, so either all or none of them are recorded. Events with the ID,
+// or one of the PriorIDs, of one already there are left out, and reported
+// as already recorded.
+func SendEvents(ctx context.Context, db *sql.DB, events []Event) ([]bool, error) {
+	prior, err := priorRecorded(ctx, db, events)
+	if err != nil {
+		return nil, err
+	}
+	var fresh []Event
+	for _, event := range events {
+		if !prior[event.ID] {
+			fresh = append(fresh, event)
+		}
+	}
+	recorded := make([]bool, len(events))
+	if len(fresh) == 0 {
+		for i := range recorded {
+			recorded[i] = true
+		}
+		return recorded, nil
+	}
+	query, args, err := insertEvents(fresh)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	inserted := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		inserted[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// An event sent twice in the batch is only inserted once.
+	for i, event := range events {
+		recorded[i] = !inserted[event.ID]
+		delete(inserted, event.ID)
+	}
+	return recorded, nil
+}
+
+// priorRecorded returns the IDs of the events that were recorded under one
+// of their PriorIDs, before the plate keys were rotated.
+func priorRecorded(ctx context.Context, db *sql.DB, events []Event) (map[string]bool, error) {
+	owners := make(map[string]string)
+	var ids []string
+	for _, event := range events {
+		for _, id := range event.PriorIDs {
+			owners[id] = event.ID
+			ids = append(ids, id)
+		}
+	}
+	recorded := make(map[string]bool)
+	if len(ids) == 0 {
+		return recorded, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT uid FROM events WHERE uid = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		recorded[owners[id]] = true
+	}
+	return recorded, rows.Err()
+}
+
+// eventColumns are the columns insertEvents fills, in order.
+const eventColumns = "time, camera, plate, confidence, plate_image, frame_image, site, " +
+	"candidates, coordinates, region, region_confidence, matches_template, processing_ms, " +
+	"image_width, image_height, host, correlation_id, job_id, uid, plate_sealed"
+
+// insertEvents builds the insert of the events, which returns the ids of
+// those that weren't there already.
+func insertEvents(events []Event) (string, []interface{}, error) {
+	var args []interface{}
+	var rows []string
+	for _, event := range events {
+		candidates, err := jsonColumn(event.Candidates, len(event.Candidates))
+		if err != nil {
+			return "", nil, err
+		}
+		coordinates, err := jsonColumn(event.Coordinates, len(event.Coordinates))
+		if err != nil {
+			return "", nil, err
+		}
+		values := []interface{}{event.Time, event.Camera, event.Plate, event.Confidence, event.PlateImage, event.FrameImage, event.Site,
+			candidates, coordinates, event.Region, event.RegionConfidence, event.MatchesTemplate, event.ProcessingMs,
+			event.ImageWidth, event.ImageHeight, event.Host, event.CorrelationID, int64(event.JobID), event.ID, nullable(event.PlateSealed)}
+		params := make([]string, len(values))
+		for i, value := range values {
+			args = append(args, value)
+			params[i] = "$" + strconv.Itoa(len(args))
+		}
+		rows = append(rows, "("+strings.Join(params, ", ")+")")
+	}
+	query := "INSERT INTO events (" + eventColumns + ") VALUES " + strings.Join(rows, ", ") +
+		" ON CONFLICT (uid) DO NOTHING RETURNING uid"
+	return query, args, nil
+}
+
+// nullable is NULL for an empty string.
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// jsonColumn encodes a list for a jsonb column, or NULL if it has no items.
+func jsonColumn(list interface{}, items int) (interface{}, error) {
+	if items == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// UploadFile sends the give image bytes to Amazon S3.
+func UploadFile(ctx context.Context, fileName string, fileBytes *bytes.Buffer, s3uploader *s3manager.Uploader) (string, error) {
+	class := s3.ObjectStorageClassReducedRedundancy
+	contentType := "image/jpeg"
+
+	// Upload the file to S3 using the S3 Manager
+	uploadRes, err := s3uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:       aws.String(config.Opts.S3Bucket),
+		Key:          aws.String(path.Join(config.Opts.S3Prefix, fileName)),
+		Body:         fileBytes,
+		ContentType:  &contentType,
+		StorageClass: &class,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return uploadRes.Location, nil
+}
+
+// Round out a duration for printing
+func Round(d, r time.Duration) time.Duration {
+	if r <= 0 {
+		return d
+	}
+	neg := d < 0
+	if neg {
+		d = -d
+	}
+	if m := d % r; m+m < r {
+		d = d - m
+	} else {
+		d = d + r - m
+	}
+	if neg {
+		return -d
+	}
+	return d
+}
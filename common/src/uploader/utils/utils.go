@@ -2,36 +2,13 @@ package utils
 
 import (
 	"bytes"
-	"config"
-	"errors"
 	"io/ioutil"
 	"path"
 	"path/filepath"
 	"strings"
-	"time"
+	"uploader/config"
 )
 
-// ExtractTime returns the UTC time from the filepath
-func ExtractTime(file string) (*time.Time, error) {
-	// This must match the motion.conf format.
-	const shortForm = "20060102150405"
-
-	_, filename := filepath.Split(file)
-
-	exploded := strings.Split(filename, "-")
-
-	if len(exploded) != 3 || len(exploded[1]) != 14 {
-		now := time.Now().UTC()
-		return &now, errors.New("Invalid file name, defaulting to UTC timestamp")
-	}
-
-	t, err := time.Parse(shortForm, exploded[1])
-	if err != nil {
-		return nil, err
-	}
-	return &t, nil
-}
-
 // GetPlateFilename returns the full path to the plate image file's location.
 func GetPlateFilename(filename string) string {
 	_, file := filepath.Split(filename)
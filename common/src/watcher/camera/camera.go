@@ -0,0 +1,101 @@
+package camera
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Source maps a watched directory to the camera writing images into it.
+type Source struct {
+	Dir    string
+	Camera string
+	Site   string
+}
+
+// Sources is the set of directories the watcher is responsible for.
+type Sources []Source
+
+// ParseSource parses a source given as "dir=camera@site". The camera and site
+// parts are optional and default to the given values, so a bare directory is
+// also accepted.
+func ParseSource(spec string, defaultCamera string, defaultSite string) (Source, error) {
+	source := Source{Camera: defaultCamera, Site: defaultSite}
+
+	dir := spec
+	if i := strings.LastIndex(spec, "="); i >= 0 {
+		dir = spec[:i]
+		identity := spec[i+1:]
+		if j := strings.Index(identity, "@"); j >= 0 {
+			if site := identity[j+1:]; site != "" {
+				source.Site = site
+			}
+			identity = identity[:j]
+		}
+		if identity != "" {
+			source.Camera = identity
+		}
+	}
+
+	dir = strings.TrimSpace(dir)
+	if dir == "" {
+		return source, fmt.Errorf("No directory in camera source %q", spec)
+	}
+
+	// Filesystem events come back with absolute paths.
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return source, err
+	}
+	source.Dir = abs
+	return source, nil
+}
+
+// ParseSources parses all the given specs, refusing the same directory twice.
+func ParseSources(specs []string, defaultCamera string, defaultSite string) (Sources, error) {
+	var sources Sources
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		source, err := ParseSource(spec, defaultCamera, defaultSite)
+		if err != nil {
+			return nil, err
+		}
+		if seen[source.Dir] {
+			return nil, fmt.Errorf("Directory %s is configured more than once", source.Dir)
+		}
+		seen[source.Dir] = true
+		sources = append(sources, source)
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("No camera directories configured")
+	}
+	return sources, nil
+}
+
+// Lookup returns the source whose directory most specifically contains the
+// file, so nested camera directories in a recursive watch resolve correctly.
+func (s Sources) Lookup(file string) (Source, bool) {
+	var best Source
+	found := false
+	for _, source := range s {
+		rel, err := filepath.Rel(source.Dir, file)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if !found || len(source.Dir) > len(best.Dir) {
+			best = source
+			found = true
+		}
+	}
+	return best, found
+}
+
+// WatchPath returns the path to hand to notify.Watch, which uses the "/..."
+// suffix to watch a directory tree recursively.
+func (s Source) WatchPath(recursive bool) string {
+	if recursive {
+		return filepath.Join(s.Dir, "...")
+	}
+	return s.Dir
+}
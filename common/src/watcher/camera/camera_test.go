@@ -0,0 +1,69 @@
+package camera
+
+import "testing"
+
+func TestParseSource(t *testing.T) {
+	source, err := ParseSource("/var/lib/motion/cam1=gate@depot", "lpr-camera", "lpr-site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.Dir != "/var/lib/motion/cam1" || source.Camera != "gate" || source.Site != "depot" {
+		t.Errorf("Unexpected source: %+v", source)
+	}
+
+	source, err = ParseSource("/var/lib/motion/cam2=exit", "lpr-camera", "lpr-site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.Camera != "exit" || source.Site != "lpr-site" {
+		t.Errorf("Expected default site: %+v", source)
+	}
+
+	source, err = ParseSource("/var/lib/motion", "lpr-camera", "lpr-site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.Camera != "lpr-camera" || source.Site != "lpr-site" {
+		t.Errorf("Expected defaults: %+v", source)
+	}
+
+	if _, err = ParseSource("=gate@depot", "lpr-camera", "lpr-site"); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+}
+
+func TestParseSourcesDuplicate(t *testing.T) {
+	_, err := ParseSources([]string{"/motion/cam1=a", "/motion/cam1/=b"}, "", "")
+	if err == nil {
+		t.Error("Expected an error for a duplicate directory")
+	}
+
+	_, err = ParseSources(nil, "", "")
+	if err == nil {
+		t.Error("Expected an error for no directories")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	sources, err := ParseSources([]string{"/motion=all@depot", "/motion/cam1=gate@depot", "/other=exit@yard"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"/motion/cam1/01-20160920135426-14.jpg":     "gate",
+		"/motion/cam1/sub/01-20160920135426-14.jpg": "gate",
+		"/motion/cam2/01-20160920135426-14.jpg":     "all",
+		"/other/01-20160920135426-14.jpg":           "exit",
+	}
+	for file, camera := range cases {
+		source, ok := sources.Lookup(file)
+		if !ok || source.Camera != camera {
+			t.Errorf("Lookup %s: got %+v, expected camera %s", file, source, camera)
+		}
+	}
+
+	if _, ok := sources.Lookup("/motionless/01.jpg"); ok {
+		t.Error("Expected no source for a sibling directory")
+	}
+}
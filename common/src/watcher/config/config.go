@@ -0,0 +1,148 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"settings"
+	"sync"
+	"time"
+)
+
+// Options describes all the CLI flags that can be passed. Those tagged
+// reload:"true" are re-read from the config file on SIGHUP.
+type Options struct {
+	settings.Common
+
+	WatchDir       string   `long:"dir" env:"WATCHER_DIR" required:"true" default:"./testdata" short:"a"`
+	Camera         string   `long:"camera" env:"WATCHER_CAMERA" default:"lpr-camera" short:"b"`
+	Site           string   `long:"site" env:"WATCHER_SITE" default:"lpr-site" short:"c"`
+	Cameras        []string `long:"cameras" env:"WATCHER_CAMERAS" env-delim:"," short:"d" description:"dir=camera@site, overrides WATCHER_DIR"`
+	Recursive      bool     `long:"recursive" env:"WATCHER_RECURSIVE" short:"r"`
+	BackoffMaxSecs int      `long:"backoff-max" env:"WATCHER_BACKOFF_MAX" default:"10"`
+	HTTPAddr       string   `long:"http-addr" env:"WATCHER_HTTP_ADDR" default:":9101" description:"Serves /metrics, /healthz and /readyz, empty to disable"`
+	Include        []string `long:"include" env:"WATCHER_INCLUDE" env-delim:"," default:"*.jpg" default:"*.jpeg" default:"*.png" short:"i" reload:"true"`
+	Exclude        []string `long:"exclude" env:"WATCHER_EXCLUDE" env-delim:"," default:"lastsnap.jpg" default:"*-snapshot.jpg" default:"re:-[0-9]+m\\.jpg$" short:"x" reload:"true"`
+	MinSize        int64    `long:"min-size" env:"WATCHER_MIN_SIZE" default:"1024" short:"s" reload:"true"`
+	StableMs       int      `long:"stable-ms" env:"WATCHER_STABLE_MS" default:"250" short:"t" reload:"true"`
+	StableFor      time.Duration
+
+	LedgerDir             string   `long:"ledger-dir" env:"WATCHER_LEDGER_DIR" short:"l" description:"Shared dir recording files with pending jobs"`
+	LedgerExpiryHours     int      `long:"ledger-expiry-hours" env:"WATCHER_LEDGER_EXPIRY_HOURS" default:"24" short:"e" reload:"true"`
+	RetentionDirs         []string `long:"retention-dirs" env:"WATCHER_RETENTION_DIRS" env-delim:"," short:"k" description:"Defaults to the watched and output dirs"`
+	OutputDirs            []string `long:"output-dirs" env:"WATCHER_OUTPUT_DIRS" env-delim:"," description:"Local dirs the uploader writes plate and frame images to"`
+	RetentionMaxAgeHours  int      `long:"retention-max-age-hours" env:"WATCHER_RETENTION_MAX_AGE_HOURS" default:"0" short:"m" reload:"true"`
+	RetentionMinAgeSecs   int      `long:"retention-min-age" env:"WATCHER_RETENTION_MIN_AGE" default:"600" short:"n" reload:"true"`
+	RetentionHighPct      float64  `long:"retention-high-watermark" env:"WATCHER_RETENTION_HIGH_WATERMARK" default:"0" short:"g" reload:"true"`
+	RetentionLowPct       float64  `long:"retention-low-watermark" env:"WATCHER_RETENTION_LOW_WATERMARK" default:"80" short:"w" reload:"true"`
+	RetentionIntervalSecs int      `long:"retention-interval" env:"WATCHER_RETENTION_INTERVAL" default:"300" short:"v" reload:"true"`
+	LedgerExpiry          time.Duration
+	RetentionMaxAge       time.Duration
+	RetentionMinAge       time.Duration
+	RetentionInterval     time.Duration
+}
+
+// Validate checks the options make sense together.
+func (o *Options) Validate() error {
+	switch {
+	case o.BackoffMaxSecs <= 0:
+		return errors.New("backoff-max must be positive")
+	case o.MinSize < 0 || o.StableMs < 0:
+		return errors.New("min-size and stable-ms must not be negative")
+	case o.RetentionHighPct < 0 || o.RetentionHighPct > 100 || o.RetentionLowPct < 0 || o.RetentionLowPct > 100:
+		return errors.New("retention watermarks are percentages between 0 and 100")
+	case o.RetentionHighPct > 0 && o.RetentionLowPct >= o.RetentionHighPct:
+		return errors.New("retention-low-watermark must be below retention-high-watermark")
+	case o.RetentionIntervalSecs <= 0:
+		return errors.New("retention-interval must be positive")
+	case (o.RetentionMaxAgeHours > 0 || o.RetentionHighPct > 0) && o.LedgerDir == "":
+		// Without the ledger, retention can't tell frames still waiting to
+		// be processed from those that are done with.
+		return errors.New("retention needs ledger-dir, so frames with pending jobs are kept")
+	}
+	if len(o.RetentionDirs) > 0 {
+		for _, dir := range o.OutputDirs {
+			if !containsDir(o.RetentionDirs, dir) {
+				return fmt.Errorf("retention-dirs must include output dir %s", dir)
+			}
+		}
+	}
+	return o.Common.Validate()
+}
+
+// RetentionDirsFor returns the dirs retention looks after: retention-dirs if
+// set, or else the watched dirs and the output dirs.
+func (o *Options) RetentionDirsFor(watched []string) []string {
+	if len(o.RetentionDirs) > 0 {
+		return o.RetentionDirs
+	}
+	dirs := append([]string{}, watched...)
+	for _, dir := range o.OutputDirs {
+		if !containsDir(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func containsDir(dirs []string, dir string) bool {
+	for _, d := range dirs {
+		if filepath.Clean(d) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Options) derive() {
+	o.StableFor = time.Duration(o.StableMs) * time.Millisecond
+	o.LedgerExpiry = time.Duration(o.LedgerExpiryHours) * time.Hour
+	o.RetentionMaxAge = time.Duration(o.RetentionMaxAgeHours) * time.Hour
+	o.RetentionMinAge = time.Duration(o.RetentionMinAgeSecs) * time.Second
+	o.RetentionInterval = time.Duration(o.RetentionIntervalSecs) * time.Second
+}
+
+// Opts is the application config struct that we allow external access too.
+// Reloadable settings must be read through Snapshot.
+var Opts Options
+
+var (
+	mu   sync.RWMutex
+	args []string
+)
+
+// Init parses the options from the config file, env vars and args.
+func Init(cliArgs []string) {
+	args = cliArgs
+	err := settings.Parse("watcher", &Opts, args)
+	if err != nil {
+		log.Println(err)
+		log.Println("Missing ENV vars containing configuration, try `. lpr.env`")
+		os.Exit(1)
+	}
+	Opts.derive()
+	Opts.SetupLogging("watcher")
+}
+
+// Reload re-reads the configuration and applies the reloadable settings,
+// returning the names of those that changed.
+func Reload() ([]string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	changed, err := settings.Reload("watcher", &Opts, args)
+	if err != nil {
+		return nil, err
+	}
+	Opts.derive()
+	Opts.ReloadLogging()
+	return changed, nil
+}
+
+// Snapshot returns a copy of the options that is safe to read during a reload.
+func Snapshot() Options {
+	mu.RLock()
+	defer mu.RUnlock()
+	return Opts
+}
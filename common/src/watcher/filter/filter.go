@@ -0,0 +1,157 @@
+package filter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Rules decide which files written to the watched directories are queued.
+// Patterns prefixed with "re:" are regular expressions matched against the
+// full path; anything else is a glob matched case-insensitively against the
+// base name, so "*.jpg" also catches "IMG.JPG".
+type Rules struct {
+	include []pattern
+	exclude []pattern
+}
+
+type pattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func (p pattern) match(path string) bool {
+	if p.re != nil {
+		return p.re.MatchString(path)
+	}
+	ok, _ := filepath.Match(p.glob, strings.ToLower(filepath.Base(path)))
+	return ok
+}
+
+func compile(specs []string) ([]pattern, error) {
+	var patterns []pattern
+	for _, spec := range specs {
+		if spec == "" {
+			continue
+		}
+		if strings.HasPrefix(spec, "re:") {
+			re, err := regexp.Compile(strings.TrimPrefix(spec, "re:"))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern %q: %s", spec, err)
+			}
+			patterns = append(patterns, pattern{re: re})
+			continue
+		}
+		glob := strings.ToLower(spec)
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q: %s", spec, err)
+		}
+		patterns = append(patterns, pattern{glob: glob})
+	}
+	return patterns, nil
+}
+
+// NewRules compiles the include and exclude patterns.
+func NewRules(include []string, exclude []string) (*Rules, error) {
+	inc, err := compile(include)
+	if err != nil {
+		return nil, err
+	}
+	exc, err := compile(exclude)
+	if err != nil {
+		return nil, err
+	}
+	return &Rules{include: inc, exclude: exc}, nil
+}
+
+// MatchName reports whether the path matches at least one include pattern and
+// no exclude pattern. The file itself isn't looked at.
+func (r *Rules) MatchName(path string) bool {
+	included := false
+	for _, p := range r.include {
+		if p.match(path) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, p := range r.exclude {
+		if p.match(path) {
+			return false
+		}
+	}
+	return true
+}
+
+type candidate struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// Stabilizer holds on to files until their size has stopped changing for
+// StableFor, so images that are still being written are never queued.
+type Stabilizer struct {
+	StableFor time.Duration
+	MinSize   int64
+	pending   map[string]*candidate
+}
+
+// NewStabilizer returns an empty Stabilizer.
+func NewStabilizer(stableFor time.Duration, minSize int64) *Stabilizer {
+	return &Stabilizer{
+		StableFor: stableFor,
+		MinSize:   minSize,
+		pending:   make(map[string]*candidate),
+	}
+}
+
+// Add starts tracking a file. Adding a file that is already pending is a
+// no-op: its size is compared on the next Check.
+func (s *Stabilizer) Add(path string, now time.Time) {
+	if _, ok := s.pending[path]; ok {
+		return
+	}
+	s.pending[path] = &candidate{size: -1, since: now}
+}
+
+// Pending returns the number of files waiting to become stable.
+func (s *Stabilizer) Pending() int {
+	return len(s.pending)
+}
+
+// Check stats every pending file and returns those that have kept the same
+// size and modification time for StableFor and are at least MinSize bytes.
+// Files that disappear are forgotten, as are stable files under MinSize.
+func (s *Stabilizer) Check(now time.Time) (ready []string, tooSmall []string) {
+	for path, c := range s.pending {
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(s.pending, path)
+			continue
+		}
+		if info.Size() != c.size || !info.ModTime().Equal(c.modTime) {
+			c.size = info.Size()
+			c.modTime = info.ModTime()
+			c.since = now
+			if s.StableFor > 0 {
+				continue
+			}
+		}
+		if now.Sub(c.since) < s.StableFor {
+			continue
+		}
+		delete(s.pending, path)
+		if c.size < s.MinSize {
+			tooSmall = append(tooSmall, path)
+			continue
+		}
+		ready = append(ready, path)
+	}
+	return ready, tooSmall
+}
@@ -0,0 +1,104 @@
+package filter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMatchName(t *testing.T) {
+	rules, err := NewRules(
+		[]string{"*.jpg", "*.jpeg", "*.png"},
+		[]string{"lastsnap.jpg", "*-snapshot.jpg", "re:/debug/"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"/motion/01-20160920135426-14.jpg":       true,
+		"/motion/01-20160920135426-14.JPG":       true,
+		"/motion/01-20160920135426-14.jpeg":      true,
+		"/motion/01-20160920135426-14.png":       true,
+		"/motion/01-20160920135426-14.avi":       false,
+		"/motion/notajpg":                        false,
+		"/motion/lastsnap.jpg":                   false,
+		"/motion/01-20160920135426-snapshot.jpg": false,
+		"/motion/debug/01-20160920135426-14.jpg": false,
+	}
+	for path, expected := range cases {
+		if rules.MatchName(path) != expected {
+			t.Errorf("MatchName %s: expected %t", path, expected)
+		}
+	}
+}
+
+func TestNewRulesInvalid(t *testing.T) {
+	if _, err := NewRules([]string{"re:("}, nil); err == nil {
+		t.Error("Expected an error for an invalid regexp")
+	}
+	if _, err := NewRules([]string{"[.jpg"}, nil); err == nil {
+		t.Error("Expected an error for an invalid glob")
+	}
+}
+
+func TestStabilizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	growing := filepath.Join(dir, "growing.jpg")
+	small := filepath.Join(dir, "small.jpg")
+	ioutil.WriteFile(growing, make([]byte, 100), 0644)
+	ioutil.WriteFile(small, make([]byte, 10), 0644)
+
+	s := NewStabilizer(time.Second, 50)
+	start := time.Now()
+	s.Add(growing, start)
+	s.Add(small, start)
+	s.Add(filepath.Join(dir, "gone.jpg"), start)
+
+	// First look records the sizes, and a missing file is forgotten.
+	ready, tooSmall := s.Check(start)
+	if len(ready) != 0 || len(tooSmall) != 0 || s.Pending() != 2 {
+		t.Fatalf("Expected nothing ready yet, got %v %v pending %d", ready, tooSmall, s.Pending())
+	}
+
+	// The file grows, which restarts its clock.
+	ioutil.WriteFile(growing, make([]byte, 200), 0644)
+	ready, tooSmall = s.Check(start.Add(1500 * time.Millisecond))
+	if len(ready) != 0 || len(tooSmall) != 1 || tooSmall[0] != small {
+		t.Fatalf("Expected only the small file to settle, got %v %v", ready, tooSmall)
+	}
+
+	ready, _ = s.Check(start.Add(2000 * time.Millisecond))
+	if len(ready) != 0 {
+		t.Fatalf("Expected growing file to still be settling, got %v", ready)
+	}
+
+	ready, _ = s.Check(start.Add(2600 * time.Millisecond))
+	if len(ready) != 1 || ready[0] != growing || s.Pending() != 0 {
+		t.Fatalf("Expected growing file to be ready, got %v", ready)
+	}
+}
+
+func TestStabilizerImmediate(t *testing.T) {
+	f, err := ioutil.TempFile("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 10))
+	f.Close()
+	defer os.Remove(f.Name())
+
+	s := NewStabilizer(0, 1)
+	s.Add(f.Name(), time.Now())
+	ready, _ := s.Check(time.Now())
+	if len(ready) != 1 {
+		t.Fatalf("Expected file to be ready straight away, got %v", ready)
+	}
+}
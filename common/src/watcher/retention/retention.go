@@ -0,0 +1,233 @@
+package retention
+
+import (
+	"ledger"
+	"logging"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Policy describes when frames and generated images are deleted. A zero
+// MaxAge or HighWatermark disables that rule.
+type Policy struct {
+	// Delete files older than this.
+	MaxAge time.Duration
+	// Never delete files younger than this, whatever the disk usage.
+	MinAge time.Duration
+	// When the filesystem is fuller than HighWatermark percent, delete the
+	// oldest files until it is under LowWatermark percent.
+	HighWatermark float64
+	LowWatermark  float64
+}
+
+// Stats describes the outcome of one sweep.
+type Stats struct {
+	Files        int
+	Bytes        int64
+	Deleted      int
+	DeletedBytes int64
+	Pinned       int
+	// DiskUsedPct is the usage of the fullest filesystem after the sweep.
+	DiskUsedPct float64
+}
+
+// Manager deletes files from a set of directories according to a Policy,
+// skipping any file the ledger says is still referenced by a pending job.
+type Manager struct {
+	Dirs   []string
+	Policy Policy
+	Ledger *ledger.Ledger
+
+	// DiskUsage returns the used and total bytes of the filesystem holding
+	// dir. Defaults to statfs.
+	DiskUsage func(dir string) (used uint64, total uint64, err error)
+	// Filesystem identifies the filesystem holding dir, so dirs sharing one
+	// are counted against it together. Defaults to the device from stat.
+	Filesystem func(dir string) (uint64, error)
+	// Remove defaults to os.Remove.
+	Remove func(path string) error
+}
+
+// NewManager returns a Manager for the dirs.
+func NewManager(dirs []string, policy Policy, l *ledger.Ledger) *Manager {
+	return &Manager{
+		Dirs:       dirs,
+		Policy:     policy,
+		Ledger:     l,
+		DiskUsage:  statfs,
+		Filesystem: device,
+		Remove:     os.Remove,
+	}
+}
+
+type file struct {
+	path    string
+	size    int64
+	modTime time.Time
+	fs      uint64
+}
+
+// disk is the usage of one filesystem during a sweep.
+type disk struct {
+	used, total uint64
+	// over is set while the filesystem is being brought back under the
+	// watermarks.
+	over bool
+}
+
+func (d *disk) usedPct() float64 {
+	if d.total == 0 {
+		return 0
+	}
+	return float64(d.used) / float64(d.total) * 100
+}
+
+// Sweep applies the policy once. The watermarks apply to each filesystem
+// holding the dirs on its own, deleting only the files on one that is too
+// full.
+func (m *Manager) Sweep(now time.Time) (Stats, error) {
+	var stats Stats
+
+	filesystems, disks, err := m.disks()
+	if err != nil {
+		return stats, err
+	}
+	files, err := m.scan(filesystems)
+	if err != nil {
+		return stats, err
+	}
+	// Oldest first.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, f := range files {
+		stats.Files++
+		stats.Bytes += f.size
+	}
+
+	for _, d := range disks {
+		d.over = m.Policy.HighWatermark > 0 && d.usedPct() > m.Policy.HighWatermark
+	}
+
+	for _, f := range files {
+		age := now.Sub(f.modTime)
+		if age < m.Policy.MinAge {
+			// Sorted oldest first, so everything after this is younger still.
+			break
+		}
+		expired := m.Policy.MaxAge > 0 && age > m.Policy.MaxAge
+		d := disks[f.fs]
+		if d != nil && d.over && d.usedPct() <= m.Policy.LowWatermark {
+			d.over = false
+		}
+		if !expired && (d == nil || !d.over) {
+			continue
+		}
+		if m.Ledger.Pending(f.path) {
+			stats.Pinned++
+			continue
+		}
+		if err := m.Remove(f.path); err != nil {
+			if !os.IsNotExist(err) {
+				logging.Error("Retention", "file", f.path, "err", err)
+			}
+			continue
+		}
+		stats.Deleted++
+		stats.DeletedBytes += f.size
+		if d == nil {
+			continue
+		}
+		if uint64(f.size) > d.used {
+			d.used = 0
+		} else {
+			d.used -= uint64(f.size)
+		}
+	}
+
+	for _, d := range disks {
+		if pct := d.usedPct(); pct > stats.DiskUsedPct {
+			stats.DiskUsedPct = pct
+		}
+	}
+	return stats, nil
+}
+
+// disks finds the filesystem holding each dir, and each filesystem's usage.
+// Dirs that don't exist yet are skipped, as they have no files.
+func (m *Manager) disks() (map[string]uint64, map[uint64]*disk, error) {
+	filesystems := make(map[string]uint64)
+	disks := make(map[uint64]*disk)
+	if m.DiskUsage == nil || m.Filesystem == nil {
+		return filesystems, disks, nil
+	}
+	for _, dir := range m.Dirs {
+		fs, err := m.Filesystem(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		filesystems[dir] = fs
+		if disks[fs] != nil {
+			continue
+		}
+		used, total, err := m.DiskUsage(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		disks[fs] = &disk{used: used, total: total}
+	}
+	return filesystems, disks, nil
+}
+
+// scan returns every regular file below the directories, with the
+// filesystem of the dir it was found in. Symlinks such as Motion's
+// lastsnap.jpg are left alone.
+func (m *Manager) scan(filesystems map[string]uint64) ([]file, error) {
+	var files []file
+	seen := make(map[string]bool)
+	for _, dir := range m.Dirs {
+		fs := filesystems[dir]
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() || seen[path] {
+				return nil
+			}
+			seen[path] = true
+			files = append(files, file{path: path, size: info.Size(), modTime: info.ModTime(), fs: fs})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func device(dir string) (uint64, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.Sys().(*syscall.Stat_t).Dev), nil
+}
+
+func statfs(dir string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	total := uint64(st.Blocks) * uint64(st.Bsize)
+	used := total - uint64(st.Bfree)*uint64(st.Bsize)
+	return used, total, nil
+}
@@ -0,0 +1,147 @@
+package retention
+
+import (
+	"io/ioutil"
+	"ledger"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setup creates four 100 byte files aged 4, 3, 2 and 1 hours.
+func setup(t *testing.T) (string, []string, time.Time) {
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	var paths []string
+	for i, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, make([]byte, 100), 0644)
+		age := now.Add(-time.Duration(4-i) * time.Hour)
+		os.Chtimes(path, age, age)
+		paths = append(paths, path)
+	}
+	return dir, paths, now
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestSweepMaxAge(t *testing.T) {
+	dir, paths, now := setup(t)
+	defer os.RemoveAll(dir)
+
+	pendingDir, err := ioutil.TempDir("", "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pendingDir)
+	l, _ := ledger.Open(pendingDir)
+	l.Add(paths[0])
+
+	m := NewManager([]string{dir}, Policy{MaxAge: 150 * time.Minute}, l)
+	stats, err := m.Sweep(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a is pinned by the ledger, b is expired, c and d are young enough.
+	if !exists(paths[0]) || exists(paths[1]) || !exists(paths[2]) || !exists(paths[3]) {
+		t.Error("Unexpected files deleted")
+	}
+	if stats.Deleted != 1 || stats.DeletedBytes != 100 || stats.Pinned != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestSweepWatermark(t *testing.T) {
+	dir, paths, now := setup(t)
+	defer os.RemoveAll(dir)
+
+	m := NewManager([]string{dir}, Policy{MinAge: 90 * time.Minute, HighWatermark: 90, LowWatermark: 75}, nil)
+	m.DiskUsage = func(string) (uint64, uint64, error) {
+		return 950, 1000, nil
+	}
+	stats, err := m.Sweep(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deleting the two oldest brings usage to 75%.
+	if exists(paths[0]) || exists(paths[1]) || !exists(paths[2]) || !exists(paths[3]) {
+		t.Error("Expected only the two oldest files deleted")
+	}
+	if stats.Deleted != 2 || stats.DiskUsedPct != 75 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	// However full the disk, files under MinAge are kept.
+	m.DiskUsage = func(string) (uint64, uint64, error) {
+		return 1000, 1000, nil
+	}
+	stats, err = m.Sweep(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists(paths[2]) || !exists(paths[3]) || stats.Deleted != 1 {
+		t.Errorf("Expected only c deleted: %+v", stats)
+	}
+}
+
+func TestSweepUnderWatermark(t *testing.T) {
+	dir, _, now := setup(t)
+	defer os.RemoveAll(dir)
+
+	m := NewManager([]string{dir}, Policy{HighWatermark: 90, LowWatermark: 75}, nil)
+	m.DiskUsage = func(string) (uint64, uint64, error) {
+		return 500, 1000, nil
+	}
+	stats, err := m.Sweep(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Deleted != 0 || stats.Files != 4 || stats.Bytes != 400 || stats.DiskUsedPct != 50 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestSweepWatermarkPerFilesystem(t *testing.T) {
+	full, fullPaths, now := setup(t)
+	defer os.RemoveAll(full)
+	roomy, roomyPaths, _ := setup(t)
+	defer os.RemoveAll(roomy)
+
+	m := NewManager([]string{roomy, full}, Policy{HighWatermark: 90, LowWatermark: 75}, nil)
+	m.Filesystem = func(dir string) (uint64, error) {
+		if dir == full {
+			return 1, nil
+		}
+		return 2, nil
+	}
+	m.DiskUsage = func(dir string) (uint64, uint64, error) {
+		if dir == full {
+			return 950, 1000, nil
+		}
+		return 500, 1000, nil
+	}
+	stats, err := m.Sweep(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the full filesystem's two oldest files go, though the other
+	// filesystem's are as old.
+	if exists(fullPaths[0]) || exists(fullPaths[1]) || !exists(fullPaths[2]) {
+		t.Error("Expected the two oldest files on the full filesystem deleted")
+	}
+	for _, path := range roomyPaths {
+		if !exists(path) {
+			t.Error("Expected files on the other filesystem kept:", path)
+		}
+	}
+	if stats.Deleted != 2 || stats.DiskUsedPct != 75 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,331 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	"health"
+	"jobs"
+	"ledger"
+	"logging"
+	"metrics"
+	"queue"
+	"settings"
+	"shutdown"
+	"watcher/camera"
+	"watcher/config"
+	"watcher/filter"
+	"watcher/listen_event"
+	"watcher/retention"
+
+	"github.com/rjeczalik/notify"
+)
+
+var logger = logging.With("service", "watcher")
+
+// Watcher puts a motion event on a tube for each frame Motion writes to the
+// camera directories.
+type Watcher struct {
+	sources  camera.Sources
+	rules    *filter.Rules
+	pending  *ledger.Ledger
+	fsEvents chan notify.EventInfo
+	status   *health.Registry
+}
+
+// New sets up the watcher from config.Opts, which config.Init must have
+// filled in, and starts watching the camera directories. Run stops watching.
+func New() (*Watcher, error) {
+	logger.Info("Watcher startup", "arch", runtime.GOOS, "event_type", listen_event.ListenEvent)
+
+	// Each watched directory belongs to a camera. Without an explicit list we
+	// watch the single WATCHER_DIR as the default camera.
+	specs := config.Opts.Cameras
+	if len(specs) == 0 {
+		specs = []string{config.Opts.WatchDir}
+	}
+	sources, err := camera.ParseSources(specs, config.Opts.Camera, config.Opts.Site)
+	if err != nil {
+		return nil, fmt.Errorf("cameras: %s", err)
+	}
+
+	rules, err := newRules(config.Snapshot())
+	if err != nil {
+		return nil, fmt.Errorf("filter rules: %s", err)
+	}
+
+	pending, err := ledger.Open(config.Opts.LedgerDir)
+	if err != nil {
+		return nil, fmt.Errorf("ledger: %s", err)
+	}
+
+	// Setup a filesystem watch on the directories, so files written from
+	// here on are seen once Run starts.
+	fsEvents := make(chan notify.EventInfo, 100000)
+	for _, source := range sources {
+		logger.Info("Watching dir", "dir", source.Dir, "camera", source.Camera, "site", source.Site, "recursive", config.Opts.Recursive)
+		if err := notify.Watch(source.WatchPath(config.Opts.Recursive), fsEvents, listen_event.ListenEvent); err != nil {
+			notify.Stop(fsEvents)
+			return nil, fmt.Errorf("watch %s: %s", source.Dir, err)
+		}
+	}
+
+	// The file loop ticks constantly, so a short silence means it's stuck.
+	status := health.New(30 * time.Second)
+	status.Set("queue", nil)
+
+	return &Watcher{sources: sources, rules: rules, pending: pending, fsEvents: fsEvents, status: status}, nil
+}
+
+// Status is the watcher's health.
+func (w *Watcher) Status() *health.Registry {
+	return w.status
+}
+
+// Run watches the camera directories until ctx is cancelled, putting a motion
+// event on out for each new frame. Files already found to be ready are still
+// queued, those still being written are left for the next start.
+func (w *Watcher) Run(ctx context.Context, out queue.Tube) error {
+	// Retention always runs, as a reload may turn it on.
+	var watched []string
+	for _, source := range w.sources {
+		watched = append(watched, source.Dir)
+	}
+	go retain(ctx, retention.NewManager(config.Opts.RetentionDirsFor(watched), retention.Policy{}, w.pending))
+
+	// Metrics and health are served over HTTP for Prometheus and monitoring.
+	server := &http.Server{Addr: config.Opts.HTTPAddr}
+	if server.Addr != "" {
+		mux := http.NewServeMux()
+		w.status.Handle(mux)
+		mux.Handle("/metrics", metrics.Handler(append(metrics.Watcher(), metrics.Tubes(out)...)...))
+		server.Handler = mux
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Error("HTTP", "err", err)
+			}
+		}()
+	}
+	defer server.Close()
+
+	defer notify.Stop(w.fsEvents)
+	w.status.NotifyReady()
+
+	// Matching files are only queued once they have finished being written.
+	readyFiles := make(chan string, 1000)
+	reloads := make(chan config.Options, 1)
+	go stabilize(ctx, w.fsEvents, w.rules, readyFiles, reloads, w.status)
+
+	// Filter rules and retention settings can be changed without a restart.
+	settings.OnSighup(func() {
+		changed, err := config.Reload()
+		if err != nil {
+			logger.Error("Reload", "err", err)
+			return
+		}
+		logger.Info("Reloaded configuration", "changed", changed)
+		// Only the newest options matter, so they replace any stabilize
+		// hasn't picked up yet rather than wait for it.
+		opts := config.Snapshot()
+		for {
+			select {
+			case reloads <- opts:
+				return
+			default:
+			}
+			select {
+			case <-reloads:
+			default:
+			}
+		}
+	})
+
+	logger.Info("Queueing frames", "tube", out.Name())
+	backoff := config.Opts.Backoff(time.Duration(config.Opts.BackoffMaxSecs) * time.Second)
+
+	// The loop ends once stabilize has stopped and every ready file has been
+	// queued.
+	for filePath := range readyFiles {
+		source, ok := w.sources.Lookup(filePath)
+		if !ok {
+			logger.Error("No camera for file", "file", filePath)
+			metrics.FilesIgnored.WithLabelValues("no_camera").Inc()
+			continue
+		}
+		// Every log line about the frame, in every service, carries its
+		// correlation id.
+		correlationID := jobs.NewCorrelationID()
+		frameLog := logger.With("correlation_id", correlationID, "file", filePath, "camera", source.Camera)
+		motionEvent, _ := json.Marshal(jobs.MotionEvent{
+			CorrelationID: correlationID,
+			Filename:      filePath,
+			Camera:        source.Camera,
+			Site:          source.Site,
+		})
+
+		// Pin the file before the job exists, so retention can't race
+		// the detector for it.
+		if err := w.pending.Add(filePath); err != nil {
+			frameLog.Error("Ledger", "err", err)
+		}
+
+		// Keep trying while the queue is down, which holds back the files
+		// behind this one.
+		for {
+			id, err := out.Put(motionEvent)
+			if err == nil {
+				backoff.Reset()
+				w.status.Set("queue", nil)
+				frameLog.Info("Queued frame", "job_id", id)
+				metrics.FilesEnqueued.WithLabelValues(source.Camera).Inc()
+				break
+			}
+			backoffTime := backoff.Duration()
+			frameLog.Error("Queue put", "sleeping", backoffTime, "err", err)
+			metrics.EnqueueErrors.Inc()
+			w.status.Set("queue", err)
+			if err == queue.ErrClosed || !shutdown.Sleep(ctx, backoffTime) {
+				w.pending.Done(filePath)
+				return fmt.Errorf("shutting down with %d ready files not queued", len(readyFiles)+1)
+			}
+		}
+	}
+	logger.Info("Watcher stopped")
+	return nil
+}
+
+// Main runs the watcher as a process of its own, putting motion events on
+// beanstalkd, and returns its exit code.
+func Main(args []string) int {
+	config.Init(args)
+	ctx := shutdown.OnSignal(config.Opts.ShutdownTimeout())
+
+	w, err := New()
+	if err != nil {
+		logger.Error("Startup", "err", err)
+		return 1
+	}
+	w.Status().Watchdog()
+	w.Status().NotifyStopping(ctx)
+
+	out := queue.NewBeanstalk(config.Opts.BeanstalkAddr, config.Opts.MotionTube, config.Opts.JobPriority, config.Opts.JobTTR())
+	defer out.Close()
+	if err := w.Run(ctx, out); err != nil {
+		logger.Error("Stopped", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// newRules compiles the file matching rules from the options.
+func newRules(opts config.Options) (*filter.Rules, error) {
+	logger.Info("Filter rules", "include", opts.Include, "exclude", opts.Exclude,
+		"min_size", opts.MinSize, "stable_for", opts.StableFor)
+	return filter.NewRules(opts.Include, opts.Exclude)
+}
+
+// stabilize filters filesystem events by name and passes on the files that
+// have reached their final size. It closes readyFiles when ctx is cancelled.
+func stabilize(ctx context.Context, fsEvents <-chan notify.EventInfo, rules *filter.Rules, readyFiles chan<- string, reloads <-chan config.Options, status *health.Registry) {
+	opts := config.Snapshot()
+	stabilizer := filter.NewStabilizer(opts.StableFor, opts.MinSize)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if n := stabilizer.Pending(); n > 0 {
+				logger.Warn("Shutting down with files still being written", "files", n)
+			}
+			close(readyFiles)
+			return
+		case opts := <-reloads:
+			newRules, err := newRules(opts)
+			if err != nil {
+				logger.Error("Reload", "err", err)
+				continue
+			}
+			rules = newRules
+			stabilizer.StableFor = opts.StableFor
+			stabilizer.MinSize = opts.MinSize
+		case event := <-fsEvents:
+			if rules.MatchName(event.Path()) {
+				stabilizer.Add(event.Path(), time.Now())
+			}
+		case now := <-ticker.C:
+			status.Beat()
+			ready, tooSmall := stabilizer.Check(now)
+			for _, filePath := range tooSmall {
+				logger.Info("Ignoring file under min size", "file", filePath)
+				metrics.FilesIgnored.WithLabelValues("too_small").Inc()
+			}
+			for _, filePath := range ready {
+				select {
+				case readyFiles <- filePath:
+				case <-ctx.Done():
+					// Run may have stopped reading.
+					close(readyFiles)
+					return
+				}
+			}
+		}
+	}
+}
+
+// retain runs the retention policy every interval, also expiring ledger
+// entries for jobs that were lost. The policy is re-read each time round,
+// and nothing is swept while it is off.
+func retain(ctx context.Context, manager *retention.Manager) {
+	logger.Info("Retention", "dirs", manager.Dirs)
+	for {
+		opts := config.Snapshot()
+		policy := retention.Policy{
+			MaxAge:        opts.RetentionMaxAge,
+			MinAge:        opts.RetentionMinAge,
+			HighWatermark: opts.RetentionHighPct,
+			LowWatermark:  opts.RetentionLowPct,
+		}
+		if policy != manager.Policy {
+			logger.Info("Retention policy", "max_age", policy.MaxAge, "min_age", policy.MinAge,
+				"high_watermark", policy.HighWatermark, "low_watermark", policy.LowWatermark)
+			manager.Policy = policy
+		}
+
+		now := time.Now()
+		expired, err := manager.Ledger.Expire(opts.LedgerExpiry, now)
+		if err != nil {
+			logger.Error("Ledger", "err", err)
+		} else if expired > 0 {
+			logger.Info("Expired stale ledger entries", "entries", expired)
+		}
+
+		if policy.MaxAge > 0 || policy.HighWatermark > 0 {
+			sweep(manager, now)
+		}
+		if !shutdown.Sleep(ctx, opts.RetentionInterval) {
+			return
+		}
+	}
+}
+
+// sweep applies the retention policy once, recording the outcome.
+func sweep(manager *retention.Manager, now time.Time) {
+	stats, err := manager.Sweep(now)
+	if err != nil {
+		logger.Error("Retention", "err", err)
+		return
+	}
+	logger.Info("Retention sweep", "files", stats.Files, "bytes", stats.Bytes, "deleted", stats.Deleted,
+		"deleted_bytes", stats.DeletedBytes, "pinned", stats.Pinned, "disk_used_pct", fmt.Sprintf("%.1f", stats.DiskUsedPct))
+	metrics.RetentionFiles.Set(float64(stats.Files - stats.Deleted))
+	metrics.RetentionBytes.Set(float64(stats.Bytes - stats.DeletedBytes))
+	metrics.RetentionPinned.Set(float64(stats.Pinned))
+	metrics.RetentionDeleted.Add(float64(stats.Deleted))
+	metrics.RetentionDeletedBytes.Add(float64(stats.DeletedBytes))
+	metrics.DiskUsed.Set(stats.DiskUsedPct)
+}
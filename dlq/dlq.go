@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"deadletter"
+	"settings"
+
+	"github.com/kr/beanstalk"
+)
+
+// Options for the dead letter inspector. It reads the same config file and
+// env vars as the services, from the "dlq" section.
+type Options struct {
+	settings.Common
+
+	All  bool `long:"all" description:"Kick or purge every buried job in the tube"`
+	Args struct {
+		Command string   `positional-arg-name:"command" description:"list, inspect, kick or purge"`
+		Tube    string   `positional-arg-name:"tube" description:"Defaults to both tubes for list"`
+		IDs     []string `positional-arg-name:"id"`
+	} `positional-args:"yes"`
+}
+
+// Validate checks the command has what it needs.
+func (o *Options) Validate() error {
+	switch o.Args.Command {
+	case "list":
+	case "inspect":
+		if o.Args.Tube == "" || len(o.Args.IDs) != 1 {
+			return errors.New("usage: dlq inspect <tube> <id>")
+		}
+	case "kick", "purge":
+		if o.Args.Tube == "" || (len(o.Args.IDs) == 0) == !o.All {
+			return fmt.Errorf("usage: dlq %s <tube> <id>... | --all", o.Args.Command)
+		}
+	default:
+		return errors.New("command must be list, inspect, kick or purge")
+	}
+	return o.Common.Validate()
+}
+
+var opts Options
+
+func main() {
+	if err := settings.Parse("dlq", &opts, os.Args[1:]); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	var ids []uint64
+	for _, arg := range opts.Args.IDs {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			log.Println("[ERROR]: Job id:", arg)
+			os.Exit(1)
+		}
+		ids = append(ids, id)
+	}
+
+	store, err := deadletter.Open(opts.DeadLetterDir)
+	if err != nil {
+		log.Println("[ERROR]: Dead letter:", err)
+		os.Exit(1)
+	}
+	conn, err := beanstalk.Dial("tcp", opts.BeanstalkAddr)
+	if err != nil {
+		log.Println("[ERROR]: Beanstalk:", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	tube := &beanstalk.Tube{Conn: conn, Name: opts.Args.Tube}
+	switch opts.Args.Command {
+	case "list":
+		tubes := []string{opts.MotionTube, opts.DetectionTube}
+		if opts.Args.Tube != "" {
+			tubes = []string{opts.Args.Tube}
+		}
+		for _, name := range tubes {
+			err = list(&beanstalk.Tube{Conn: conn, Name: name}, store)
+			if err != nil {
+				break
+			}
+		}
+	case "inspect":
+		err = inspect(tube, ids[0], store)
+	case "kick":
+		err = kick(tube, ids, store)
+	case "purge":
+		err = purge(tube, ids, store)
+	}
+	if err != nil {
+		log.Println("[ERROR]:", err)
+		os.Exit(1)
+	}
+}
+
+// buried returns how many jobs are buried in the tube. A tube nobody has
+// used yet doesn't exist, which counts as none.
+func buried(tube *beanstalk.Tube) (int, error) {
+	stats, err := tube.Stats()
+	if connErr, ok := err.(beanstalk.ConnError); ok && connErr.Err == beanstalk.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(stats["current-jobs-buried"])
+}
+
+// jobState returns the job's state, or "gone" if beanstalkd no longer has
+// it, checking it belongs to the tube.
+func jobState(tube *beanstalk.Tube, id uint64) (string, error) {
+	stats, err := tube.Conn.StatsJob(id)
+	if connErr, ok := err.(beanstalk.ConnError); ok && connErr.Err == beanstalk.ErrNotFound {
+		return "gone", nil
+	} else if err != nil {
+		return "", err
+	}
+	if stats["tube"] != tube.Name {
+		return "", fmt.Errorf("job %d is in tube %s, not %s", id, stats["tube"], tube.Name)
+	}
+	return stats["state"], nil
+}
+
+// list prints the buried jobs in the tube along with why they were buried.
+// Beanstalkd can only show the first buried job, so the rest come from the
+// dead letter store.
+func list(tube *beanstalk.Tube, store *deadletter.Store) error {
+	count, err := buried(tube)
+	if err != nil {
+		return err
+	}
+	entries, err := store.List(tube.Name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d buried\n", tube.Name, count)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tBURIED AT\tRETRIES\tREASON")
+	recorded := 0
+	for _, entry := range entries {
+		state, err := jobState(tube, entry.ID)
+		if err != nil {
+			return err
+		}
+		if state == "buried" {
+			recorded++
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n", entry.ID, state, entry.BuriedAt.Format("2006-01-02 15:04:05"), entry.Releases, entry.Reason)
+	}
+	if count > recorded {
+		if id, _, err := tube.PeekBuried(); err == nil {
+			if _, ok, _ := store.Get(tube.Name, id); !ok {
+				fmt.Fprintf(w, "%d\tburied\t\t\t(no reason recorded)\n", id)
+			}
+		}
+	}
+	w.Flush()
+	if count > recorded {
+		fmt.Printf("%d buried without a recorded reason, set dead-letter-dir on the services to keep them\n", count-recorded)
+	}
+	return nil
+}
+
+// inspect prints a job's payload, stats and the reason it was buried.
+func inspect(tube *beanstalk.Tube, id uint64, store *deadletter.Store) error {
+	if _, err := jobState(tube, id); err != nil {
+		return err
+	}
+	body, err := tube.Conn.Peek(id)
+	if err != nil {
+		return err
+	}
+	stats, err := tube.Conn.StatsJob(id)
+	if err != nil {
+		return err
+	}
+	for _, key := range []string{"id", "tube", "state", "pri", "age", "reserves", "timeouts", "releases", "buries", "kicks"} {
+		fmt.Printf("%-9s %s\n", key+":", stats[key])
+	}
+	if entry, ok, err := store.Get(tube.Name, id); err != nil {
+		return err
+	} else if ok {
+		fmt.Printf("%-9s %s\n", "buried:", entry.BuriedAt.Format("2006-01-02 15:04:05"))
+		fmt.Printf("%-9s %s\n", "reason:", entry.Reason)
+	}
+
+	var indented bytes.Buffer
+	if json.Indent(&indented, body, "", "  ") == nil {
+		body = indented.Bytes()
+	}
+	fmt.Printf("payload:\n%s\n", body)
+	return nil
+}
+
+// kick moves buried jobs back to ready to be tried again.
+func kick(tube *beanstalk.Tube, ids []uint64, store *deadletter.Store) error {
+	if opts.All {
+		count, err := buried(tube)
+		if err != nil || count == 0 {
+			return err
+		}
+		n, err := tube.Kick(count)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Kicked", n, "jobs in", tube.Name)
+		return forgetAll(tube, store)
+	}
+	for _, id := range ids {
+		if _, err := jobState(tube, id); err != nil {
+			return err
+		}
+		if err := tube.Conn.KickJob(id); err != nil {
+			return fmt.Errorf("kick %d: %s", id, err)
+		}
+		store.Remove(tube.Name, id)
+		fmt.Println("Kicked", id)
+	}
+	return nil
+}
+
+// purge deletes buried jobs for good.
+func purge(tube *beanstalk.Tube, ids []uint64, store *deadletter.Store) error {
+	if opts.All {
+		n := 0
+		for {
+			id, _, err := tube.PeekBuried()
+			if connErr, ok := err.(beanstalk.ConnError); ok && connErr.Err == beanstalk.ErrNotFound {
+				break
+			} else if err != nil {
+				return err
+			}
+			if err := tube.Conn.Delete(id); err != nil {
+				return fmt.Errorf("delete %d: %s", id, err)
+			}
+			n++
+		}
+		fmt.Println("Purged", n, "jobs from", tube.Name)
+		return forgetAll(tube, store)
+	}
+	for _, id := range ids {
+		state, err := jobState(tube, id)
+		if err != nil {
+			return err
+		}
+		if state != "buried" && state != "gone" {
+			return fmt.Errorf("job %d is %s, not buried", id, state)
+		}
+		if state == "buried" {
+			if err := tube.Conn.Delete(id); err != nil {
+				return fmt.Errorf("delete %d: %s", id, err)
+			}
+		}
+		store.Remove(tube.Name, id)
+		fmt.Println("Purged", id)
+	}
+	return nil
+}
+
+// forgetAll removes the recorded reasons for jobs in the tube that are no
+// longer buried.
+func forgetAll(tube *beanstalk.Tube, store *deadletter.Store) error {
+	entries, err := store.List(tube.Name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if state, err := jobState(tube, entry.ID); err == nil && state != "buried" {
+			store.Remove(tube.Name, entry.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+#  psql -h hostname -U postgres
+#
+# The tables are made by `api migrate` or `uploader migrate`. Run this after
+# them, and again after any migration that adds a table the API uses.
+
+# The uploaders' user may only add events. Uploaders connecting as it need
+# migrate: check, and migrating is left to `uploader migrate` as postgres.
+CREATE USER lpr_uploader WITH PASSWORD '';
+GRANT INSERT, SELECT (uid) ON events TO lpr_uploader;
+GRANT USAGE ON SEQUENCE events_id_seq TO lpr_uploader;
+GRANT SELECT ON schema_migrations TO lpr_uploader;
+
+# The query API's user reads events and may only change their plates, with
+# each change recorded.
+CREATE USER lpr_api WITH PASSWORD '';
+GRANT SELECT, UPDATE (plate) ON events TO lpr_api;
+GRANT SELECT, INSERT ON event_corrections TO lpr_api;
+GRANT USAGE ON SEQUENCE event_corrections_id_seq TO lpr_api;
+GRANT SELECT ON schema_migrations TO lpr_api;
+
+# Create user + db
+CREATE USER metabase_app WITH PASSWORD '';
+CREATE DATABASE metabase_app;
+GRANT ALL PRIVILEGES ON DATABASE metabase_app to metabase_app;